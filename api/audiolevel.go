@@ -0,0 +1,37 @@
+package api
+
+import "math"
+
+// Audio levels let the relay rank sources without decoding them. The
+// level is the payload's RMS in dBov (-127..0) offset by 128, so louder
+// audio has a higher level and 0 means the sender didn't measure it.
+
+const (
+	AudioLevelUnknown = 0
+	AudioLevelSilence = 1
+	AudioLevelMax     = 128
+)
+
+func AudioLevel(pcm []int16) uint8 {
+	if len(pcm) == 0 {
+		return AudioLevelSilence
+	}
+
+	var sum float64
+	for _, v := range pcm {
+		sum += float64(v) * float64(v)
+	}
+	rms := math.Sqrt(sum / float64(len(pcm)))
+	if rms == 0 {
+		return AudioLevelSilence
+	}
+
+	dBov := 20 * math.Log10(rms/32768)
+	if dBov > 0 {
+		dBov = 0
+	}
+	if dBov < -127 {
+		dBov = -127
+	}
+	return uint8(math.Round(dBov) + AudioLevelMax)
+}
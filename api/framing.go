@@ -0,0 +1,43 @@
+package api
+
+import "errors"
+
+// Media payloads carry several codec frames, each prefixed by its
+// length as a 2 byte big endian integer.
+
+func PackFrames(frames [][]byte) []byte {
+	size := 2 * len(frames)
+	for _, frame := range frames {
+		size += len(frame)
+	}
+
+	data := make([]byte, size)
+	offset := 0
+	for _, frame := range frames {
+		size := len(frame)
+		data[offset] = byte(size >> 8)
+		data[offset+1] = byte(size)
+		copy(data[offset+2:], frame)
+		offset += size + 2
+	}
+
+	return data
+}
+
+func UnpackFrames(data []byte) ([][]byte, error) {
+	offset := 0
+	frames := [][]byte{}
+	for offset < len(data) {
+		if len(data)-offset < 2 {
+			return nil, errors.New("api: truncated frame header")
+		}
+		size := (int(data[offset]) << 8) + int(data[offset+1])
+		if size > len(data)-offset-2 {
+			return nil, errors.New("api: truncated frame")
+		}
+		frames = append(frames, data[offset+2:offset+2+size])
+		offset += size + 2
+	}
+
+	return frames, nil
+}
@@ -1,5 +1,7 @@
 package api
 
+import "strings"
+
 // API definitions for ript
 // TODO: Use RAML/Swagger for auto generating the code
 // TODO: some of these can move into common/
@@ -11,6 +13,9 @@ const (
 	StreamMediaPacket         PacketType = 5
 	StreamMediaAckPacket      PacketType = 6
 	StreamMediaRequestPacket  PacketType = 7
+	CallHangupPacket          PacketType = 8
+	PeerCallPacket            PacketType = 9
+	CallEventPacket           PacketType = 10
 )
 
 type FaceName string
@@ -24,6 +29,19 @@ type Packet struct {
 	StreamMedia        StreamContentMedia
 	StreamMediaAck     Acknowledgement
 	StreamMediaRequest StreamContentRequest
+	PeerCall           PeerCallMessage
+	CallEvent          CallEvent
+	// call context for transports without per call resources (ws)
+	CallId string
+	// set on requests, echoed on the responses to them
+	RequestId string
+	// why a request was refused, empty on responses to those that succeeded
+	Error string
+}
+
+// CallId from the call's uri
+func CallIdFromUri(uri string) string {
+	return uri[strings.LastIndex(uri, "/")+1:]
 }
 
 type PacketEvent struct {
@@ -33,6 +51,10 @@ type PacketEvent struct {
 	Packet Packet
 }
 
+// header carrying the session token the h3 transport issues on
+// /media/join, identifies the face on every later request
+const SessionHeader = "Ript-Session"
+
 ////
 //// ript semantics
 ////
@@ -67,11 +89,11 @@ type RegisterHandlerMessage struct {
 ////
 
 type TrunkGroupInfo struct {
-	Uri string
+	Uri string `json:"uri"`
 }
 
 type TrunkGroupsInfoMessage struct {
-	TrunkGroups []TrunkGroupInfo
+	TrunkGroups []TrunkGroupInfo `json:"trunkGroups"`
 }
 
 //////
@@ -81,10 +103,15 @@ type TrunkGroupsInfoMessage struct {
 type CallRequest struct {
 	HandlerUri  string `json:"uri"`
 	Destination string `json:"destination"`
+	// uri of an existing call to join, as handed out by one of its
+	// participants, instead of placing a new call
+	CallUri string `json:"call,omitempty"`
 }
 
 type CallResponse struct {
-	CallUri         string    `json:"uri"`
+	CallUri string `json:"uri"`
+	// the participant's id in call events
+	ParticipantId   string    `json:"participantId"`
 	ClientDirective Directive `json:"clientDirectives"`
 	ServerDirective Directive `json:"serverDirectives"`
 }
@@ -94,6 +121,58 @@ type CallsMessage struct {
 	Response CallResponse
 }
 
+/////
+// Relay cascading
+/////
+
+// Announces (or withdraws) a relay's local participation in a call
+// to its peer relays. Relays share the call's id, participants on any of
+// them join it by its uri.
+type PeerCallMessage struct {
+	Relay       string
+	TgId        string
+	Destination string
+	CallId      string
+	Active      bool
+}
+
+/////
+// Call events
+/////
+
+const (
+	// the loudest sources being forwarded, loudest first
+	CallEventActiveSpeakers = "active_speakers"
+	// sent by participants, relayed to the others in the call
+	CallEventHangup   = "hangup"
+	CallEventMute     = "mute"
+	CallEventDTMF     = "dtmf"
+	CallEventTransfer = "transfer"
+)
+
+// event pulls carry the cursor to pull from next, and the number of
+// events missed when the client fell behind
+const (
+	EventCursorHeader = "Ript-Event-Cursor"
+	EventGapHeader    = "Ript-Event-Gap"
+)
+
+// Sent by the relay to the participants of a call, or by a participant
+// to the others
+type CallEvent struct {
+	Type string `json:"type"`
+	// participant ids, speakers on other relays are left out
+	ActiveSpeakers []string `json:"activeSpeakers,omitempty"`
+	// participant id the event is from, set by the relay
+	From string `json:"from,omitempty"`
+	// mute
+	Muted bool `json:"muted,omitempty"`
+	// dtmf, out of 0-9, *, # and A-D
+	Digits string `json:"digits,omitempty"`
+	// transfer, uri of the call or handler to move to
+	Target string `json:"target,omitempty"`
+}
+
 /////
 // Media
 /////
@@ -105,11 +184,39 @@ const (
 
 	// media codec types
 	PayloadTypeOpus = 1
+	PayloadTypePCMU = 2
+	PayloadTypePCMA = 3
 
 	// control message types
 	StreamContentControlTypeAck = 0
+
+	// media flags
+	// the payload is an end-to-end encrypted frame the relay can't read
+	MediaFlagProtected = 1 << 0
 )
 
+// codec names as used in advertisements and directives
+var payloadTypeCodecs = map[uint32]string{
+	PayloadTypeOpus: "opus",
+	PayloadTypePCMU: "PCMU",
+	PayloadTypePCMA: "PCMA",
+}
+
+// PayloadTypeCodec returns the codec name of a payload type, empty if unknown
+func PayloadTypeCodec(payloadType uint32) string {
+	return payloadTypeCodecs[payloadType]
+}
+
+// CodecPayloadType returns the payload type of a codec name
+func CodecPayloadType(codec string) (uint32, bool) {
+	for pt, name := range payloadTypeCodecs {
+		if name == codec {
+			return pt, true
+		}
+	}
+	return 0, false
+}
+
 type StreamContentType uint8
 type StreamContentControlType int16
 
@@ -124,6 +231,15 @@ type StreamContentMedia struct {
 	SourceId    uint8
 	SinkId      uint8
 	Media       []byte `tls:"head=varint"`
+	// loudness of the payload, see AudioLevel
+	AudioLevel uint8
+	// MediaFlag bits
+	Flags uint8
+}
+
+// Protected reports whether the payload is end-to-end encrypted
+func (m StreamContentMedia) Protected() bool {
+	return m.Flags&MediaFlagProtected != 0
 }
 
 type Acknowledgement struct {
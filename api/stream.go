@@ -0,0 +1,61 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/bifurcation/mint/syntax"
+)
+
+// Long lived h3 media streams carry StreamContentMedia packets, each
+// prefixed by its encoded length as a 4 byte big endian integer.
+
+const (
+	// content type of the streaming media request and response bodies
+	MediaStreamContentType = "application/ript-media-stream"
+	// media pull responses carry the cursor to pull from next, and the
+	// number of packets missed when the client fell behind
+	MediaCursorHeader = "Ript-Media-Cursor"
+	MediaGapHeader    = "Ript-Media-Gap"
+	// bound on a single packet, rejects garbage lengths
+	maxStreamPacketSize = 64 << 10
+)
+
+func WriteMediaPacket(w io.Writer, m StreamContentMedia) error {
+	enc, err := syntax.Marshal(m)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4+len(enc))
+	binary.BigEndian.PutUint32(frame, uint32(len(enc)))
+	copy(frame[4:], enc)
+	_, err = w.Write(frame)
+	return err
+}
+
+// ReadMediaPacket returns io.EOF if the stream ended between packets
+func ReadMediaPacket(r io.Reader) (StreamContentMedia, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return StreamContentMedia{}, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxStreamPacketSize {
+		return StreamContentMedia{}, errors.New("api: media packet too large")
+	}
+
+	enc := make([]byte, size)
+	if _, err := io.ReadFull(r, enc); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return StreamContentMedia{}, err
+	}
+
+	var m StreamContentMedia
+	if _, err := syntax.Unmarshal(enc, &m); err != nil {
+		return StreamContentMedia{}, err
+	}
+	return m, nil
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestMediaPacketStream(t *testing.T) {
+	var buf bytes.Buffer
+	for i := 0; i < 3; i++ {
+		m := StreamContentMedia{SeqNo: uint64(i), PayloadType: PayloadTypeOpus, Media: []byte{byte(i), 1, 2}}
+		if err := WriteMediaPacket(&buf, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		m, err := ReadMediaPacket(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.SeqNo != uint64(i) || !bytes.Equal(m.Media, []byte{byte(i), 1, 2}) {
+			t.Fatalf("unexpected packet [%+v]", m)
+		}
+	}
+	if _, err := ReadMediaPacket(&buf); err != io.EOF {
+		t.Fatalf("expected EOF, got [%v]", err)
+	}
+
+	WriteMediaPacket(&buf, StreamContentMedia{Media: []byte{1, 2, 3}})
+	buf.Truncate(buf.Len() - 1)
+	if _, err := ReadMediaPacket(&buf); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected truncation error, got [%v]", err)
+	}
+}
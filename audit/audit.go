@@ -0,0 +1,235 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Structured audit trail of signaling activity, written as JSON lines.
+// With hash chaining enabled every record carries the hash of its
+// predecessor, so removing or editing records breaks the chain.
+
+type Event string
+
+const (
+	EventFaceJoined        Event = "face_joined"
+	EventFaceLeft          Event = "face_left"
+	EventHandlerRegistered Event = "handler_registered"
+	EventCallCreated       Event = "call_created"
+	EventCallJoined        Event = "call_joined"
+	EventCallLeft          Event = "call_left"
+	EventCallEnded         Event = "call_ended"
+	EventCallRejected      Event = "call_rejected"
+	EventAuthFailure       Event = "auth_failure"
+)
+
+type Record struct {
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Event    Event     `json:"event"`
+	Face     string    `json:"face,omitempty"`
+	Uri      string    `json:"uri,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+	PrevHash string    `json:"prevHash,omitempty"`
+	Hash     string    `json:"hash,omitempty"`
+}
+
+type Config struct {
+	Path string
+	// rotate once the file would grow beyond MaxSize bytes (0 disables)
+	MaxSize int64
+	// number of rotated files to keep (path.1 .. path.N)
+	MaxFiles  int
+	HashChain bool
+}
+
+type Logger struct {
+	config   Config
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+	seq      uint64
+	lastHash string
+}
+
+// NewLogger opens (or continues) the audit log at config.Path.
+func NewLogger(config Config) (*Logger, error) {
+	if config.Path == "" {
+		return nil, errors.New("audit: missing log path")
+	}
+
+	l := &Logger{config: config}
+
+	// pick up seq and chain from an existing log
+	if f, err := os.Open(config.Path); err == nil {
+		last, err := lastRecord(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			l.seq = last.Seq
+			l.lastHash = last.Hash
+		}
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Log appends a record, filling in seq, time and hashes. A nil
+// logger discards records, so callers needn't check for auditing.
+func (l *Logger) Log(rec Record) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.seq++
+	rec.Seq = l.seq
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+
+	if l.config.HashChain {
+		rec.PrevHash = l.lastHash
+		rec.Hash = ""
+		h, err := recordHash(rec)
+		if err != nil {
+			log.Printf("audit: hash error [%v]", err)
+			return
+		}
+		rec.Hash = h
+		l.lastHash = h
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("audit: marshal error [%v]", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if l.config.MaxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.config.MaxSize {
+		if err := l.rotate(); err != nil {
+			log.Printf("audit: rotate error [%v]", err)
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("audit: write error [%v]", err)
+	}
+}
+
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Close()
+}
+
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// shift path.N-1 -> path.N .. path -> path.1 and start a fresh file.
+// The hash chain continues across files.
+func (l *Logger) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+
+	if l.config.MaxFiles > 0 {
+		os.Remove(rotatedName(l.config.Path, l.config.MaxFiles))
+		for i := l.config.MaxFiles - 1; i >= 1; i-- {
+			os.Rename(rotatedName(l.config.Path, i), rotatedName(l.config.Path, i+1))
+		}
+		if err := os.Rename(l.config.Path, rotatedName(l.config.Path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.config.Path); err != nil {
+		return err
+	}
+
+	return l.open()
+}
+
+func rotatedName(path string, idx int) string {
+	return fmt.Sprintf("%s.%d", path, idx)
+}
+
+func recordHash(rec Record) (string, error) {
+	rec.Hash = ""
+	enc, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(enc)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func lastRecord(r io.Reader) (*Record, error) {
+	var last *Record
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("audit: corrupt record [%v]", err)
+		}
+		last = &rec
+	}
+	return last, scanner.Err()
+}
+
+// Verify checks the hash chain of a log read in order, starting after the
+// record with hash prevHash ("" for the first file). It returns the hash of
+// the last record, to be passed on when verifying the next file.
+func Verify(r io.Reader, prevHash string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return "", fmt.Errorf("audit: corrupt record [%v]", err)
+		}
+		if rec.PrevHash != prevHash {
+			return "", fmt.Errorf("audit: chain broken at seq [%d]", rec.Seq)
+		}
+		h, err := recordHash(rec)
+		if err != nil {
+			return "", err
+		}
+		if h != rec.Hash {
+			return "", fmt.Errorf("audit: hash mismatch at seq [%d]", rec.Seq)
+		}
+		prevHash = rec.Hash
+	}
+	return prevHash, scanner.Err()
+}
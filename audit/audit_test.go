@@ -0,0 +1,107 @@
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func newTestLogger(t *testing.T, config Config) (*Logger, string) {
+	dir, err := ioutil.TempDir("", "ript-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Path = path.Join(dir, "audit.jsonl")
+	l, err := NewLogger(config)
+	if err != nil {
+		t.Fatalf("logger error [%v]", err)
+	}
+	return l, dir
+}
+
+func TestHashChainAcrossRotation(t *testing.T) {
+	l, dir := newTestLogger(t, Config{MaxSize: 400, MaxFiles: 5, HashChain: true})
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 6; i++ {
+		l.Log(Record{Event: EventFaceJoined, Face: "127.0.0.1:1234", Uri: "/media/join"})
+	}
+	l.Close()
+
+	// oldest file first
+	var files []string
+	for i := 5; i >= 1; i-- {
+		name := rotatedName(l.config.Path, i)
+		if _, err := os.Stat(name); err == nil {
+			files = append(files, name)
+		}
+	}
+	files = append(files, l.config.Path)
+	if len(files) < 2 {
+		t.Fatalf("expected log to be rotated")
+	}
+
+	prev := ""
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prev, err = Verify(f, prev)
+		f.Close()
+		if err != nil {
+			t.Fatalf("verify [%s] error [%v]", name, err)
+		}
+	}
+
+	// reopening continues the sequence and the chain
+	l, err := NewLogger(l.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Log(Record{Event: EventFaceLeft})
+	l.Close()
+	if l.seq != 7 || l.lastHash == prev {
+		t.Fatalf("unexpected state after reopen seq [%d]", l.seq)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	l, dir := newTestLogger(t, Config{HashChain: true})
+	defer os.RemoveAll(dir)
+
+	l.Log(Record{Event: EventHandlerRegistered, Uri: "/handlers/1"})
+	l.Log(Record{Event: EventCallCreated, Uri: "/calls/1"})
+	l.Log(Record{Event: EventCallEnded, Uri: "/calls/1"})
+	l.Close()
+
+	raw, err := ioutil.ReadFile(l.config.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(bytes.NewReader(raw), ""); err != nil {
+		t.Fatalf("unexpected verify error [%v]", err)
+	}
+
+	edited := strings.Replace(string(raw), "/calls/1", "/calls/2", 1)
+	if _, err := Verify(strings.NewReader(edited), ""); err == nil {
+		t.Fatalf("expected edited record to fail verification")
+	}
+
+	lines := strings.SplitAfter(string(raw), "\n")
+	removed := lines[0] + lines[2]
+	if _, err := Verify(strings.NewReader(removed), ""); err == nil {
+		t.Fatalf("expected removed record to fail verification")
+	}
+}
+
+func TestNilLoggerDiscards(t *testing.T) {
+	var l *Logger
+	l.Log(Record{Event: EventFaceJoined})
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
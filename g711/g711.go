@@ -0,0 +1,131 @@
+package g711
+
+import "errors"
+
+// G.711 μ-law and A-law companding of 16 bit linear samples, after the
+// reference implementation (Sun Microsystems' g711.c). Audio is 8kHz,
+// one byte per sample.
+
+const SampleRate = 8000
+
+type Law int
+
+const (
+	Ulaw Law = iota
+	Alaw
+)
+
+const (
+	ulawBias = 0x84
+	ulawClip = 32635
+)
+
+var alawSegEnd = [8]int{0x1f, 0x3f, 0x7f, 0xff, 0x1ff, 0x3ff, 0x7ff, 0xfff}
+
+// Codec converts whole frames, usable as mixer.Decoder and mixer.Encoder
+type Codec struct {
+	Law Law
+}
+
+func (c Codec) Decode(frame []byte, pcm []int16) (int, error) {
+	if len(pcm) < len(frame) {
+		return 0, errors.New("g711: pcm buffer too small")
+	}
+	for i, b := range frame {
+		if c.Law == Alaw {
+			pcm[i] = AlawToLinear(b)
+		} else {
+			pcm[i] = UlawToLinear(b)
+		}
+	}
+	return len(frame), nil
+}
+
+func (c Codec) Encode(pcm []int16, frame []byte) (int, error) {
+	if len(frame) < len(pcm) {
+		return 0, errors.New("g711: frame buffer too small")
+	}
+	for i, v := range pcm {
+		if c.Law == Alaw {
+			frame[i] = LinearToAlaw(v)
+		} else {
+			frame[i] = LinearToUlaw(v)
+		}
+	}
+	return len(pcm), nil
+}
+
+func LinearToUlaw(sample int16) byte {
+	v := int(sample)
+	sign := 0
+	if v < 0 {
+		v = -v
+		sign = 0x80
+	}
+	if v > ulawClip {
+		v = ulawClip
+	}
+	v += ulawBias
+
+	exp := 7
+	for mask := 0x4000; v&mask == 0 && exp > 0; mask >>= 1 {
+		exp--
+	}
+	mantissa := (v >> uint(exp+3)) & 0x0f
+	return ^byte(sign | exp<<4 | mantissa)
+}
+
+func UlawToLinear(u byte) int16 {
+	u = ^u
+	exp := uint(u>>4) & 0x07
+	v := ((int(u&0x0f) << 3) + ulawBias) << exp
+	v -= ulawBias
+	if u&0x80 != 0 {
+		return int16(-v)
+	}
+	return int16(v)
+}
+
+func LinearToAlaw(sample int16) byte {
+	v := int(sample) >> 3
+	mask := 0xd5
+	if v < 0 {
+		mask = 0x55
+		v = -v - 1
+	}
+
+	seg := 0
+	for seg < len(alawSegEnd) && v > alawSegEnd[seg] {
+		seg++
+	}
+	if seg >= len(alawSegEnd) {
+		return byte(0x7f ^ mask)
+	}
+
+	a := seg << 4
+	if seg < 2 {
+		a |= (v >> 1) & 0x0f
+	} else {
+		a |= (v >> uint(seg)) & 0x0f
+	}
+	return byte(a ^ mask)
+}
+
+func AlawToLinear(a byte) int16 {
+	a ^= 0x55
+	t := int(a&0x0f) << 4
+	seg := uint(a&0x70) >> 4
+	switch seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= seg - 1
+	}
+	if a&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
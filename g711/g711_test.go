@@ -0,0 +1,43 @@
+package g711
+
+import "testing"
+
+func TestCompandingRoundTrip(t *testing.T) {
+	for _, law := range []Law{Ulaw, Alaw} {
+		codec := Codec{Law: law}
+		for s := -32768; s <= 32767; s += 7 {
+			frame := make([]byte, 1)
+			pcm := make([]int16, 1)
+			codec.Encode([]int16{int16(s)}, frame)
+			codec.Decode(frame, pcm)
+
+			// quantization error grows with the amplitude, ~1/16th
+			if abs(int(pcm[0])-s) > 16+abs(s)/16 {
+				t.Fatalf("law [%d]: [%d] decoded as [%d]", law, s, pcm[0])
+			}
+		}
+	}
+}
+
+func TestKnownCodes(t *testing.T) {
+	// silence and full scale
+	if LinearToUlaw(0) != 0xff || UlawToLinear(0xff) != 0 {
+		t.Fatalf("bad μ-law silence")
+	}
+	if LinearToUlaw(32767) != 0x80 || LinearToUlaw(-32768) != 0x00 {
+		t.Fatalf("bad μ-law full scale [%x] [%x]", LinearToUlaw(32767), LinearToUlaw(-32768))
+	}
+	if LinearToAlaw(0) != 0xd5 || LinearToAlaw(-1) != 0x55 {
+		t.Fatalf("bad A-law silence [%x] [%x]", LinearToAlaw(0), LinearToAlaw(-1))
+	}
+	if LinearToAlaw(32767) != 0xaa || LinearToAlaw(-32768) != 0x2a {
+		t.Fatalf("bad A-law full scale [%x] [%x]", LinearToAlaw(32767), LinearToAlaw(-32768))
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
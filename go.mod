@@ -1,9 +1,8 @@
-module goRIPT
+module github.com/WhatIETF/goRIPT
 
 go 1.14
 
 require (
-	github.com/WhatIETF/goRIPT v0.0.0-20200327214451-0d5d430c4da1
 	github.com/bifurcation/mint v0.0.0-20200214151656-93c820e81448
 	github.com/golang/protobuf v1.3.5 // indirect
 	github.com/google/uuid v1.1.1
@@ -16,7 +15,7 @@ require (
 	github.com/onsi/ginkgo v1.11.0
 	github.com/onsi/gomega v1.8.1
 	github.com/valyala/fasttemplate v1.1.0 // indirect
-	golang.org/x/crypto v0.0.0-20200323165209-0ec3e9974c59 // indirect
+	golang.org/x/crypto v0.0.0-20200323165209-0ec3e9974c59
 	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e // indirect
 	golang.org/x/sys v0.0.0-20200327173247-9dae0f8f5775 // indirect
 	golang.org/x/text v0.3.2 // indirect
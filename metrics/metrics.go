@@ -0,0 +1,356 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Small Prometheus text format (0.0.4) exposition, covering the counters,
+// gauges and histograms the relay needs. Metrics are created on a
+// Registry; a nil Registry creates nil metrics, which discard updates, so
+// instrumented code needn't check whether metrics are enabled.
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets suit request latencies, in seconds
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+// Value of a metric collected at scrape time, label values in the order
+// the labels were declared
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+type Registry struct {
+	lock    sync.Mutex
+	metrics map[string]metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]metric{}}
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.metrics[name]; ok {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.metrics[name] = m
+}
+
+// Write renders all metrics, ordered by name
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, len(names))
+	for i, name := range names {
+		metrics[i] = r.metrics[name]
+	}
+	r.lock.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	r.Write(w)
+}
+
+/////
+// Counters and gauges
+/////
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+// values keyed by their joined label values
+type series struct {
+	lock        sync.Mutex
+	values      map[string]float64
+	labelValues map[string][]string
+}
+
+func newSeries() series {
+	return series{values: map[string]float64{}, labelValues: map[string][]string{}}
+}
+
+func (s *series) add(v float64, labelValues []string) {
+	key := strings.Join(labelValues, "\xff")
+	s.lock.Lock()
+	if _, ok := s.labelValues[key]; !ok {
+		s.labelValues[key] = append([]string(nil), labelValues...)
+	}
+	s.values[key] += v
+	s.lock.Unlock()
+}
+
+func (s *series) set(v float64, labelValues []string) {
+	key := strings.Join(labelValues, "\xff")
+	s.lock.Lock()
+	if _, ok := s.labelValues[key]; !ok {
+		s.labelValues[key] = append([]string(nil), labelValues...)
+	}
+	s.values[key] = v
+	s.lock.Unlock()
+}
+
+func (s *series) samples() []Sample {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	samples := make([]Sample, 0, len(s.values))
+	for key, v := range s.values {
+		samples = append(samples, Sample{LabelValues: s.labelValues[key], Value: v})
+	}
+	return samples
+}
+
+type Counter struct {
+	desc
+	series
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	if r == nil {
+		return nil
+	}
+	c := &Counter{desc: desc{name, help, "counter", labels}, series: newSeries()}
+	r.register(name, c)
+	return c
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if c == nil {
+		return
+	}
+	c.add(v, labelValues)
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.header(w)
+	writeSamples(w, c.name, c.labels, c.samples())
+}
+
+type Gauge struct {
+	desc
+	series
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	if r == nil {
+		return nil
+	}
+	g := &Gauge{desc: desc{name, help, "gauge", labels}, series: newSeries()}
+	r.register(name, g)
+	return g
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	if g == nil {
+		return
+	}
+	g.set(v, labelValues)
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	if g == nil {
+		return
+	}
+	g.add(v, labelValues)
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.header(w)
+	writeSamples(w, g.name, g.labels, g.samples())
+}
+
+// collected when scraped, for values the instrumented code already keeps
+type funcMetric struct {
+	desc
+	collect func() []Sample
+}
+
+func (r *Registry) NewGaugeFunc(name, help string, collect func() []Sample, labels ...string) {
+	if r == nil {
+		return
+	}
+	r.register(name, &funcMetric{desc{name, help, "gauge", labels}, collect})
+}
+
+func (r *Registry) NewCounterFunc(name, help string, collect func() []Sample, labels ...string) {
+	if r == nil {
+		return
+	}
+	r.register(name, &funcMetric{desc{name, help, "counter", labels}, collect})
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	f.header(w)
+	writeSamples(w, f.name, f.labels, f.collect())
+}
+
+/////
+// Histograms
+/////
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+type Histogram struct {
+	desc
+	buckets []float64
+	lock    sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if r == nil {
+		return nil
+	}
+	h := &Histogram{
+		desc:    desc{name, help, "histogram", labels},
+		buckets: append([]float64(nil), buckets...),
+		series:  map[string]*histogramSeries{},
+	}
+	sort.Float64s(h.buckets)
+	r.register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	if h == nil {
+		return
+	}
+	key := strings.Join(labelValues, "\xff")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{
+			labelValues: append([]string(nil), labelValues...),
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.header(w)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	bucketLabels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range keys {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			values := append(append([]string(nil), s.labelValues...), formatFloat(bound))
+			writeSample(w, h.name+"_bucket", bucketLabels, values, float64(s.counts[i]))
+		}
+		values := append(append([]string(nil), s.labelValues...), "+Inf")
+		writeSample(w, h.name+"_bucket", bucketLabels, values, float64(s.count))
+		writeSample(w, h.name+"_sum", h.labels, s.labelValues, s.sum)
+		writeSample(w, h.name+"_count", h.labels, s.labelValues, float64(s.count))
+	}
+}
+
+/////
+// Text format
+/////
+
+func writeSamples(w *bufio.Writer, name string, labels []string, samples []Sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].LabelValues, "\xff") < strings.Join(samples[j].LabelValues, "\xff")
+	})
+	for _, s := range samples {
+		writeSample(w, name, labels, s.LabelValues, s.Value)
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			value := ""
+			if i < len(values) {
+				value = values[i]
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", label, escapeLabel(value))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
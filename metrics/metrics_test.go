@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	reg := NewRegistry()
+	packets := reg.NewCounter("test_packets_total", "Packets.", "type")
+	packets.Inc("media")
+	packets.Add(2, "media")
+	packets.Inc("calls")
+	reg.NewGaugeFunc("test_calls", "Calls.", func() []Sample {
+		return []Sample{{Value: 3}}
+	})
+	latency := reg.NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1}, "method")
+	latency.Observe(0.05, "GET")
+	latency.Observe(0.5, "GET")
+
+	var buf bytes.Buffer
+	if err := reg.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP test_calls Calls.
+# TYPE test_calls gauge
+test_calls 3
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{method="GET",le="0.1"} 1
+test_latency_seconds_bucket{method="GET",le="1"} 2
+test_latency_seconds_bucket{method="GET",le="+Inf"} 2
+test_latency_seconds_sum{method="GET"} 0.55
+test_latency_seconds_count{method="GET"} 2
+# HELP test_packets_total Packets.
+# TYPE test_packets_total counter
+test_packets_total{type="calls"} 1
+test_packets_total{type="media"} 3
+`
+	if buf.String() != expected {
+		t.Fatalf("unexpected exposition:\n%s", buf.String())
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewGauge("test_gauge", "Help with \\ and\nnewline.", "face").Set(1, "a\"b\\c\nd")
+
+	var buf bytes.Buffer
+	reg.Write(&buf)
+	if !strings.Contains(buf.String(), `# HELP test_gauge Help with \\ and\nnewline.`) ||
+		!strings.Contains(buf.String(), `test_gauge{face="a\"b\\c\nd"} 1`) {
+		t.Fatalf("bad escaping:\n%s", buf.String())
+	}
+}
+
+func TestNilRegistry(t *testing.T) {
+	var reg *Registry
+	reg.NewCounter("c", "").Inc("x")
+	reg.NewGauge("g", "").Set(1)
+	reg.NewHistogram("h", "", DefaultBuckets).Observe(1)
+	reg.NewGaugeFunc("f", "", func() []Sample { return nil })
+}
@@ -0,0 +1,250 @@
+package mixer
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+// Audio mixing for multi-party calls (MCU mode). Every participant's
+// frames are decoded into a small per source queue. Each tick one
+// packet's worth of frames is taken from every source, and each
+// receiver gets the mix of everybody but itself, encoded with its own
+// encoder as a single stream.
+
+type Decoder interface {
+	Decode(frame []byte, pcm []int16) (int, error)
+}
+
+type Encoder interface {
+	Encode(pcm []int16, frame []byte) (int, error)
+}
+
+type Codec struct {
+	NewDecoder func() (Decoder, error)
+	NewEncoder func() (Encoder, error)
+}
+
+type Config struct {
+	Codec Codec
+	// optional, codec of each member at the mixer's rate, Codec for
+	// the members it returns nothing for
+	MemberCodec func(name string) (Codec, bool)
+	// samples per codec frame
+	FrameSamples int
+	// frames mixed into each outgoing packet
+	FramesPerPacket int
+	// frames buffered per source before the oldest are dropped
+	MaxQueuedFrames int
+	// current participants of the call, asked on every tick
+	Members func() []string
+	// sends a mixed payload to a receiver
+	Emit func(receiver string, payload []byte)
+}
+
+const maxFrameSize = 1275
+
+type source struct {
+	decoder Decoder
+	frames  [][]int16
+}
+
+type Mixer struct {
+	config   Config
+	lock     sync.Mutex
+	sources  map[string]*source
+	encoders map[string]Encoder
+	stop     chan struct{}
+}
+
+func New(config Config) (*Mixer, error) {
+	if config.Codec.NewDecoder == nil || config.Codec.NewEncoder == nil {
+		return nil, errors.New("mixer: no codec")
+	}
+	if config.FrameSamples <= 0 || config.FramesPerPacket <= 0 {
+		return nil, errors.New("mixer: bad frame config")
+	}
+	if config.MaxQueuedFrames < config.FramesPerPacket {
+		config.MaxQueuedFrames = 3 * config.FramesPerPacket
+	}
+	return &Mixer{
+		config:   config,
+		sources:  map[string]*source{},
+		encoders: map[string]Encoder{},
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+// Push decodes a media payload from a participant
+func (m *Mixer) Push(name string, payload []byte) error {
+	frames, err := api.UnpackFrames(payload)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s, ok := m.sources[name]
+	if !ok {
+		decoder, err := m.codec(name).NewDecoder()
+		if err != nil {
+			return err
+		}
+		s = &source{decoder: decoder}
+		m.sources[name] = s
+	}
+
+	for _, frame := range frames {
+		pcm := make([]int16, m.config.FrameSamples)
+		n, err := s.decoder.Decode(frame, pcm)
+		if err != nil {
+			return err
+		}
+		s.frames = append(s.frames, pcm[:n])
+	}
+	if over := len(s.frames) - m.config.MaxQueuedFrames; over > 0 {
+		s.frames = s.frames[over:]
+	}
+	return nil
+}
+
+// Run ticks every interval until Stop
+func (m *Mixer) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.Tick()
+		}
+	}
+}
+
+func (m *Mixer) Stop() {
+	close(m.stop)
+}
+
+// Tick mixes and emits one packet for every receiver that has
+// somebody else to hear
+func (m *Mixer) Tick() {
+	members := m.config.Members()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	isMember := make(map[string]bool, len(members))
+	for _, name := range members {
+		isMember[name] = true
+	}
+	for name := range m.sources {
+		if !isMember[name] {
+			delete(m.sources, name)
+		}
+	}
+	for name := range m.encoders {
+		if !isMember[name] {
+			delete(m.encoders, name)
+		}
+	}
+
+	samples := m.config.FrameSamples * m.config.FramesPerPacket
+	total := make([]int32, samples)
+	own := map[string][]int16{}
+	for name, s := range m.sources {
+		pcm := m.takeFrames(s)
+		if pcm == nil {
+			continue
+		}
+		own[name] = pcm
+		for i, v := range pcm {
+			total[i] += int32(v)
+		}
+	}
+
+	for _, name := range members {
+		// nobody else talking
+		if len(own) == 0 || (len(own) == 1 && own[name] != nil) {
+			continue
+		}
+
+		pcm := make([]int16, samples)
+		mine := own[name]
+		for i := range pcm {
+			v := total[i]
+			if mine != nil {
+				v -= int32(mine[i])
+			}
+			pcm[i] = clip(v)
+		}
+
+		payload, err := m.encode(name, pcm)
+		if err != nil {
+			log.Printf("mixer: encode error for [%s]: %v", name, err)
+			continue
+		}
+		m.config.Emit(name, payload)
+	}
+}
+
+// takeFrames returns a packet's worth of samples, padded with
+// silence, or nil if the source has nothing queued
+func (m *Mixer) takeFrames(s *source) []int16 {
+	if len(s.frames) == 0 {
+		return nil
+	}
+	pcm := make([]int16, m.config.FrameSamples*m.config.FramesPerPacket)
+	for i := 0; i < m.config.FramesPerPacket && len(s.frames) > 0; i++ {
+		copy(pcm[i*m.config.FrameSamples:(i+1)*m.config.FrameSamples], s.frames[0])
+		s.frames = s.frames[1:]
+	}
+	return pcm
+}
+
+// Needs lock held.
+func (m *Mixer) encode(receiver string, pcm []int16) ([]byte, error) {
+	encoder, ok := m.encoders[receiver]
+	if !ok {
+		var err error
+		encoder, err = m.codec(receiver).NewEncoder()
+		if err != nil {
+			return nil, err
+		}
+		m.encoders[receiver] = encoder
+	}
+
+	frames := make([][]byte, m.config.FramesPerPacket)
+	for i := range frames {
+		frame := make([]byte, maxFrameSize)
+		n, err := encoder.Encode(pcm[i*m.config.FrameSamples:(i+1)*m.config.FrameSamples], frame)
+		if err != nil {
+			return nil, err
+		}
+		frames[i] = frame[:n]
+	}
+	return api.PackFrames(frames), nil
+}
+
+func (m *Mixer) codec(name string) Codec {
+	if m.config.MemberCodec != nil {
+		if c, ok := m.config.MemberCodec(name); ok {
+			return c
+		}
+	}
+	return m.config.Codec
+}
+
+func clip(v int32) int16 {
+	if v > 32767 {
+		return 32767
+	}
+	if v < -32768 {
+		return -32768
+	}
+	return int16(v)
+}
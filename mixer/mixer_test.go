@@ -0,0 +1,102 @@
+package mixer
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+// uncompressed 16 bit little endian samples
+type pcmCodec struct{}
+
+func (pcmCodec) Decode(frame []byte, pcm []int16) (int, error) {
+	n := len(frame) / 2
+	for i := 0; i < n; i++ {
+		pcm[i] = int16(binary.LittleEndian.Uint16(frame[2*i:]))
+	}
+	return n, nil
+}
+
+func (pcmCodec) Encode(pcm []int16, frame []byte) (int, error) {
+	for i, v := range pcm {
+		binary.LittleEndian.PutUint16(frame[2*i:], uint16(v))
+	}
+	return 2 * len(pcm), nil
+}
+
+var testCodec = Codec{
+	NewDecoder: func() (Decoder, error) { return pcmCodec{}, nil },
+	NewEncoder: func() (Encoder, error) { return pcmCodec{}, nil },
+}
+
+// payload of frames with every sample set to v
+func constantPayload(v int16, samples, frames int) []byte {
+	frame := make([]byte, 2*samples)
+	pcmCodec{}.Encode(constantSamples(v, samples), frame)
+	packed := make([][]byte, frames)
+	for i := range packed {
+		packed[i] = frame
+	}
+	return api.PackFrames(packed)
+}
+
+func constantSamples(v int16, n int) []int16 {
+	pcm := make([]int16, n)
+	for i := range pcm {
+		pcm[i] = v
+	}
+	return pcm
+}
+
+func TestMixerMixesEverybodyButTheReceiver(t *testing.T) {
+	const samples, frames = 4, 2
+	members := []string{"alice", "bob", "carol", "dave"}
+	got := map[string][]byte{}
+	m, err := New(Config{
+		Codec:           testCodec,
+		FrameSamples:    samples,
+		FramesPerPacket: frames,
+		Members:         func() []string { return members },
+		Emit:            func(receiver string, payload []byte) { got[receiver] = payload },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Push("alice", constantPayload(100, samples, frames)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Push("bob", constantPayload(200, samples, frames)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Push("carol", constantPayload(32700, samples, frames)); err != nil {
+		t.Fatal(err)
+	}
+	m.Tick()
+
+	// dave only listens, and carol's loudness clips
+	expected := map[string]int16{"alice": 32767, "bob": 32767, "carol": 300, "dave": 32767}
+	for name, v := range expected {
+		if got[name] == nil {
+			t.Fatalf("no mix for [%s]", name)
+		}
+		if want := constantPayload(v, samples, frames); string(got[name]) != string(want) {
+			t.Fatalf("bad mix for [%s]", name)
+		}
+	}
+
+	// nothing queued, nothing sent
+	got = map[string][]byte{}
+	m.Tick()
+	if len(got) != 0 {
+		t.Fatalf("unexpected mixes [%d]", len(got))
+	}
+
+	// a lone talker hears nobody, the others hear the talker
+	m.Push("alice", constantPayload(100, samples, frames))
+	m.Tick()
+	if got["alice"] != nil || got["bob"] == nil {
+		t.Fatalf("unexpected mixes [%v]", got)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build opus
+// +build opus
+
+package mixer
+
+import "gopkg.in/hraban/opus.v2"
+
+// OpusCodec needs libopus, build with -tags opus
+func OpusCodec(sampleRate, channels int) Codec {
+	return Codec{
+		NewDecoder: func() (Decoder, error) {
+			dec, err := opus.NewDecoder(sampleRate, channels)
+			if err != nil {
+				return nil, err
+			}
+			return dec, nil
+		},
+		NewEncoder: func() (Encoder, error) {
+			enc, err := opus.NewEncoder(sampleRate, channels, opus.AppVoIP)
+			if err != nil {
+				return nil, err
+			}
+			return enc, nil
+		},
+	}
+}
@@ -0,0 +1,69 @@
+package recording
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+)
+
+// Admin endpoints
+//
+//	POST|DELETE /recording/trunkGroups/{trunkGroupId}  turn recording on/off
+//	POST|DELETE /recording/calls/{callId}
+//	GET         /recordings                            list
+//	GET         /recordings/{callId}/{name}            download
+func (r *Recorder) AdminRoutes(router *mux.Router) {
+	router.HandleFunc("/recording/trunkGroups/{trunkGroupId}", func(w http.ResponseWriter, req *http.Request) {
+		tgId := mux.Vars(req)["trunkGroupId"]
+		enabled := req.Method == http.MethodPost
+		log.Printf("recording: trunk group [%s] enabled [%v]", tgId, enabled)
+		r.SetTrunkGroup(tgId, enabled)
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodPost, http.MethodDelete)
+
+	router.HandleFunc("/recording/calls/{callId}", func(w http.ResponseWriter, req *http.Request) {
+		callId := mux.Vars(req)["callId"]
+		enabled := req.Method == http.MethodPost
+		log.Printf("recording: call [%s] enabled [%v]", callId, enabled)
+		r.SetCall(callId, enabled)
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodPost, http.MethodDelete)
+
+	router.HandleFunc("/recordings", func(w http.ResponseWriter, req *http.Request) {
+		recordings, err := r.List()
+		if err != nil {
+			log.Printf("recording: list error [%v]", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		enc, err := json.Marshal(recordings)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(enc)
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc("/recordings/{callId}/{name}", func(w http.ResponseWriter, req *http.Request) {
+		params := mux.Vars(req)
+		f, err := r.Open(params["callId"], params["name"])
+		if os.IsNotExist(err) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "audio/ogg")
+		w.Header().Set("Content-Disposition", "attachment; filename="+params["name"])
+		io.Copy(w, f)
+	}).Methods(http.MethodGet)
+}
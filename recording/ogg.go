@@ -0,0 +1,184 @@
+package recording
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Minimal Ogg Opus writer (RFC 3533, RFC 7845). Every opus packet goes
+// on its own page, so a recording in progress is always playable.
+
+const (
+	// encoder lookahead of libopus, in 48kHz samples
+	opusPreSkip = 312
+
+	pageHeaderSize  = 27
+	maxPageSegments = 255
+
+	flagBOS = 0x02
+	flagEOS = 0x04
+)
+
+var crcTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func oggCRC(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+type oggOpusWriter struct {
+	w       io.Writer
+	serial  uint32
+	pageSeq uint32
+	granule int64
+	// last packet is held back, so it can be flagged end of stream
+	pending []byte
+}
+
+// lostOpusPacket returns a packet of a single empty frame in the
+// configuration of the given one, which decoders conceal as lost
+// (RFC 6716 section 3.2.1)
+func lostOpusPacket(like []byte) []byte {
+	return []byte{like[0] &^ 0x03}
+}
+
+// newOggOpusWriter writes the OpusHead and OpusTags pages
+func newOggOpusWriter(w io.Writer, serial uint32, sampleRate uint32, comments []string) (*oggOpusWriter, error) {
+	o := &oggOpusWriter{w: w, serial: serial}
+
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // version
+	head[9] = 1 // channels
+	binary.LittleEndian.PutUint16(head[10:], opusPreSkip)
+	binary.LittleEndian.PutUint32(head[12:], sampleRate)
+	// output gain and mapping family 0
+	if err := o.writePage(head, 0, flagBOS); err != nil {
+		return nil, err
+	}
+
+	vendor := "goRIPT"
+	tags := append([]byte("OpusTags"), le32(uint32(len(vendor)))...)
+	tags = append(tags, vendor...)
+	tags = append(tags, le32(uint32(len(comments)))...)
+	for _, c := range comments {
+		tags = append(tags, le32(uint32(len(c)))...)
+		tags = append(tags, c...)
+	}
+	if err := o.writePage(tags, 0, 0); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// WritePacket appends one opus packet
+func (o *oggOpusWriter) WritePacket(packet []byte) error {
+	samples, err := opusPacketSamples(packet)
+	if err != nil {
+		return err
+	}
+
+	if o.pending != nil {
+		if err := o.writePage(o.pending, o.granule, 0); err != nil {
+			return err
+		}
+	}
+	o.pending = append([]byte(nil), packet...)
+	o.granule += int64(samples)
+	return nil
+}
+
+// Close ends the stream, it doesn't close the underlying writer
+func (o *oggOpusWriter) Close() error {
+	if o.pending == nil {
+		// nothing recorded, still end the stream
+		return o.writePage(nil, o.granule, flagEOS)
+	}
+	err := o.writePage(o.pending, o.granule, flagEOS)
+	o.pending = nil
+	return err
+}
+
+func (o *oggOpusWriter) writePage(packet []byte, granule int64, flags byte) error {
+	segments := len(packet)/255 + 1
+	if segments > maxPageSegments {
+		return errors.New("recording: packet too large for a page")
+	}
+
+	page := make([]byte, pageHeaderSize+segments, pageHeaderSize+segments+len(packet))
+	copy(page, "OggS")
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], uint64(granule))
+	binary.LittleEndian.PutUint32(page[14:], o.serial)
+	binary.LittleEndian.PutUint32(page[18:], o.pageSeq)
+	page[26] = byte(segments)
+	for i := 0; i < segments-1; i++ {
+		page[pageHeaderSize+i] = 255
+	}
+	page[pageHeaderSize+segments-1] = byte(len(packet) % 255)
+	page = append(page, packet...)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+
+	o.pageSeq++
+	_, err := o.w.Write(page)
+	return err
+}
+
+// opusPacketSamples returns the duration of the packet from its TOC byte
+// (RFC 6716 section 3.1). Granule positions count 48kHz samples whatever
+// the input rate.
+func opusPacketSamples(packet []byte) (int, error) {
+	if len(packet) == 0 {
+		return 0, errors.New("recording: empty opus packet")
+	}
+
+	config := packet[0] >> 3
+	var frameSamples int
+	switch {
+	case config < 12:
+		// SILK 10, 20, 40, 60ms
+		frameSamples = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16:
+		// hybrid 10, 20ms
+		frameSamples = []int{480, 960}[config%2]
+	default:
+		// CELT 2.5, 5, 10, 20ms
+		frameSamples = []int{120, 240, 480, 960}[config%4]
+	}
+
+	frames := 1
+	switch packet[0] & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, errors.New("recording: truncated opus packet")
+		}
+		frames = int(packet[1] & 0x3f)
+	}
+	return frames * frameSamples, nil
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
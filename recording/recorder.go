@@ -0,0 +1,351 @@
+package recording
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+// Compliance recording of calls on the relay. Every source of a recorded
+// call is written to its own Ogg Opus file under <dir>/<callId>/.
+// Recording is switched on per trunk group, per call settings override it.
+// Packets lost on the way in are written as lost opus frames, so the
+// recording keeps its timing.
+
+const (
+	// rate the clients capture at, advertised in OpusHead
+	inputSampleRate = 16000
+	fileSuffix      = ".opus"
+	// packets arriving this far behind the newest one are taken as a
+	// restarted sender rather than late
+	maxReorder = 50
+	// longest gap filled with lost frames, in packets
+	maxGapFill = 3000
+)
+
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+type streamKey struct {
+	callId string
+	source string
+}
+
+type stream struct {
+	// held while writing, so recordings don't wait on each other
+	lock   sync.Mutex
+	file   *os.File
+	ogg    *oggOpusWriter
+	closed bool
+	// newest sequence number written
+	lastSeq uint64
+	started bool
+}
+
+type Recorder struct {
+	dir string
+	// guards the settings and the set of streams
+	lock        sync.Mutex
+	trunkGroups map[string]bool
+	// explicit per call settings, override the trunk group
+	calls   map[string]bool
+	streams map[streamKey]*stream
+}
+
+type Recording struct {
+	CallId   string    `json:"callId"`
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+func NewRecorder(dir string) (*Recorder, error) {
+	if dir == "" {
+		return nil, errors.New("recording: missing directory")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		dir:         dir,
+		trunkGroups: map[string]bool{},
+		calls:       map[string]bool{},
+		streams:     map[streamKey]*stream{},
+	}, nil
+}
+
+// SetTrunkGroup turns recording on or off for all calls on the trunk group
+func (r *Recorder) SetTrunkGroup(tgId string, enabled bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if enabled {
+		r.trunkGroups[tgId] = true
+	} else {
+		delete(r.trunkGroups, tgId)
+	}
+}
+
+// SetCall turns recording on or off for a single call. Turning it off
+// finishes the call's files.
+func (r *Recorder) SetCall(callId string, enabled bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.calls[callId] = enabled
+	if !enabled {
+		r.closeCall(callId)
+	}
+}
+
+// Write records a media payload, holding opus frames in the client's
+// 2 byte length framing. seqNo is the sender's sequence number of the
+// payload. A nil recorder records nothing.
+func (r *Recorder) Write(tgId, callId, source string, seqNo uint64, payload []byte) error {
+	if r == nil {
+		return nil
+	}
+
+	frames, err := api.UnpackFrames(payload)
+	if err != nil {
+		return err
+	}
+	s, err := r.stream(tgId, callId, source)
+	if s == nil || err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	return s.write(seqNo, frames)
+}
+
+// stream returns the source's stream, opening it if need be, or nil if
+// the call isn't recorded
+func (r *Recorder) stream(tgId, callId, source string) (*stream, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	enabled, ok := r.calls[callId]
+	if !ok {
+		enabled = r.trunkGroups[tgId]
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	key := streamKey{callId, source}
+	s, ok := r.streams[key]
+	if !ok {
+		var err error
+		s, err = r.open(tgId, callId, source)
+		if err != nil {
+			return nil, err
+		}
+		r.streams[key] = s
+	}
+	return s, nil
+}
+
+// Needs the stream's lock held.
+func (s *stream) write(seqNo uint64, frames [][]byte) error {
+	if len(frames) == 0 {
+		return nil
+	}
+
+	if s.started {
+		switch {
+		case seqNo <= s.lastSeq && s.lastSeq-seqNo < maxReorder:
+			// late or duplicate, its time has been filled already
+			return nil
+		case seqNo > s.lastSeq+1:
+			// the missing packets are assumed as long as this one
+			missing := seqNo - s.lastSeq - 1
+			if missing > maxGapFill {
+				missing = maxGapFill
+			}
+			if err := s.writeLost(missing, frames); err != nil {
+				return err
+			}
+		}
+	}
+	s.started = true
+	s.lastSeq = seqNo
+
+	for _, frame := range frames {
+		if err := s.ogg.WritePacket(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeLost fills the time of the missing packets with lost frames
+func (s *stream) writeLost(missing uint64, frames [][]byte) error {
+	samples := 0
+	for _, frame := range frames {
+		n, err := opusPacketSamples(frame)
+		if err != nil {
+			return err
+		}
+		samples += n
+	}
+	lost := lostOpusPacket(frames[0])
+	lostSamples, err := opusPacketSamples(lost)
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < missing*uint64(samples/lostSamples); i++ {
+		if err := s.ogg.WritePacket(lost); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EndCall finishes the call's files and forgets its settings
+func (r *Recorder) EndCall(callId string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closeCall(callId)
+	delete(r.calls, callId)
+}
+
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for key := range r.streams {
+		r.closeStream(key)
+	}
+	return nil
+}
+
+// List returns the recordings on disk, ordered by call and name
+func (r *Recorder) List() ([]Recording, error) {
+	callDirs, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	recordings := []Recording{}
+	for _, callDir := range callDirs {
+		if !callDir.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(path.Join(r.dir, callDir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if f.IsDir() || path.Ext(f.Name()) != fileSuffix {
+				continue
+			}
+			recordings = append(recordings, Recording{
+				CallId:   callDir.Name(),
+				Name:     f.Name(),
+				Size:     f.Size(),
+				Modified: f.ModTime(),
+			})
+		}
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		if recordings[i].CallId != recordings[j].CallId {
+			return recordings[i].CallId < recordings[j].CallId
+		}
+		return recordings[i].Name < recordings[j].Name
+	})
+	return recordings, nil
+}
+
+// Open opens a listed recording for download
+func (r *Recorder) Open(callId, name string) (*os.File, error) {
+	if !safeName(callId) || !safeName(name) || path.Ext(name) != fileSuffix {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(path.Join(r.dir, callId, name))
+}
+
+// Needs lock held.
+func (r *Recorder) open(tgId, callId, source string) (*stream, error) {
+	if !safeName(callId) {
+		return nil, fmt.Errorf("recording: bad call id [%s]", callId)
+	}
+	dir := path.Join(r.dir, callId)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	// a source recorded again (after being turned off) gets a new file
+	base := unsafeName.ReplaceAllString(source, "_")
+	var file *os.File
+	for i := 0; file == nil; i++ {
+		name := base + fileSuffix
+		if i > 0 {
+			name = fmt.Sprintf("%s-%d%s", base, i, fileSuffix)
+		}
+		f, err := os.OpenFile(path.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			file = f
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(file.Name()))
+	ogg, err := newOggOpusWriter(file, h.Sum32(), inputSampleRate, []string{
+		"RIPT_TRUNK_GROUP=" + tgId,
+		"RIPT_CALL=" + callId,
+		"RIPT_SOURCE=" + source,
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	log.Printf("recording: started [%s]", file.Name())
+	return &stream{file: file, ogg: ogg}, nil
+}
+
+// Needs lock held.
+func (r *Recorder) closeCall(callId string) {
+	for key := range r.streams {
+		if key.callId == callId {
+			r.closeStream(key)
+		}
+	}
+}
+
+// Needs lock held.
+func (r *Recorder) closeStream(key streamKey) {
+	s := r.streams[key]
+	delete(r.streams, key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	if err := s.ogg.Close(); err != nil {
+		log.Printf("recording: error ending [%s]: %v", s.file.Name(), err)
+	}
+	s.file.Close()
+	log.Printf("recording: finished [%s]", s.file.Name())
+}
+
+func safeName(name string) bool {
+	return name != "" && name[0] != '.' && !unsafeName.MatchString(name)
+}
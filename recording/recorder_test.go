@@ -0,0 +1,195 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+type oggPage struct {
+	flags   byte
+	granule int64
+	seq     uint32
+	packet  []byte
+}
+
+// readPages parses single packet pages and checks their CRC
+func readPages(t *testing.T, data []byte) []oggPage {
+	t.Helper()
+	var pages []oggPage
+	for len(data) > 0 {
+		if len(data) < pageHeaderSize || string(data[:4]) != "OggS" {
+			t.Fatalf("bad page header")
+		}
+		segments := int(data[26])
+		size := 0
+		for _, lace := range data[pageHeaderSize : pageHeaderSize+segments] {
+			size += int(lace)
+		}
+		end := pageHeaderSize + segments + size
+		page := append([]byte(nil), data[:end]...)
+
+		crc := binary.LittleEndian.Uint32(page[22:])
+		binary.LittleEndian.PutUint32(page[22:], 0)
+		if oggCRC(page) != crc {
+			t.Fatalf("crc mismatch on page [%d]", len(pages))
+		}
+
+		pages = append(pages, oggPage{
+			flags:   page[5],
+			granule: int64(binary.LittleEndian.Uint64(page[6:])),
+			seq:     binary.LittleEndian.Uint32(page[18:]),
+			packet:  page[pageHeaderSize+segments:],
+		})
+		data = data[end:]
+	}
+	return pages
+}
+
+func TestOpusPacketSamples(t *testing.T) {
+	tests := []struct {
+		packet  []byte
+		samples int
+	}{
+		{[]byte{1 << 3}, 960},           // SILK 20ms
+		{[]byte{3<<3 | 1}, 2 * 2880},    // SILK 60ms, 2 frames
+		{[]byte{13 << 3}, 960},          // hybrid 20ms
+		{[]byte{16 << 3}, 120},          // CELT 2.5ms
+		{[]byte{31<<3 | 3, 3}, 3 * 960}, // CELT 20ms, 3 frames
+	}
+	for _, test := range tests {
+		samples, err := opusPacketSamples(test.packet)
+		if err != nil || samples != test.samples {
+			t.Fatalf("toc [%x]: got [%d] [%v], expected [%d]", test.packet[0], samples, err, test.samples)
+		}
+	}
+}
+
+func TestRecorderWritesOggOpus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ript-recording")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// not enabled yet
+	frame := []byte{1 << 3, 0xaa, 0xbb}
+	if err := r.Write("tg1", "call1", "alice-1", 0, api.PackFrames([][]byte{frame})); err != nil {
+		t.Fatal(err)
+	}
+	if recordings, _ := r.List(); len(recordings) != 0 {
+		t.Fatalf("unexpected recordings [%v]", recordings)
+	}
+
+	r.SetTrunkGroup("tg1", true)
+	r.SetCall("call2", false)
+	for i := uint64(0); i < 2; i++ {
+		if err := r.Write("tg1", "call1", "alice:1234-1", i, api.PackFrames([][]byte{frame, frame, frame})); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Write("tg1", "call2", "bob-1", i, api.PackFrames([][]byte{frame})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Write("tg1", "call1", "alice:1234-1", 2, []byte{0, 9, 1}); err == nil {
+		t.Fatalf("expected framing error")
+	}
+	r.EndCall("call1")
+
+	recordings, err := r.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recordings) != 1 || recordings[0].CallId != "call1" || recordings[0].Name != "alice_1234-1.opus" {
+		t.Fatalf("unexpected recordings [%+v]", recordings)
+	}
+
+	f, err := r.Open("call1", recordings[0].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages := readPages(t, data)
+	if len(pages) != 8 {
+		t.Fatalf("expected head, tags and 6 audio pages, got [%d]", len(pages))
+	}
+	if pages[0].flags != flagBOS || !bytes.HasPrefix(pages[0].packet, []byte("OpusHead")) {
+		t.Fatalf("bad OpusHead page")
+	}
+	if !bytes.HasPrefix(pages[1].packet, []byte("OpusTags")) {
+		t.Fatalf("bad OpusTags page")
+	}
+	for i, page := range pages[2:] {
+		if page.granule != int64(i+1)*960 || page.seq != uint32(i+2) || !bytes.Equal(page.packet, frame) {
+			t.Fatalf("bad audio page [%d] [%+v]", i, page)
+		}
+	}
+	if pages[7].flags != flagEOS {
+		t.Fatalf("last page not flagged end of stream")
+	}
+
+	if _, err := r.Open("..", "passwd.opus"); !os.IsNotExist(err) {
+		t.Fatalf("expected path traversal to be refused, got [%v]", err)
+	}
+}
+
+func TestRecorderFillsSequenceGaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ript-recording")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetCall("call1", true)
+
+	// two 20ms frames per packet, packets 2 and 3 lost, 1 arrives late
+	frame := []byte{1<<3 | 1, 0xaa, 0xbb}
+	for _, seqNo := range []uint64{0, 1, 4, 1} {
+		if err := r.Write("tg1", "call1", "alice-1", seqNo, api.PackFrames([][]byte{frame})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.EndCall("call1")
+
+	f, err := r.Open("call1", "alice-1.opus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 packets, 4 lost 20ms frames for the gap, then the last packet
+	pages := readPages(t, data)[2:]
+	if len(pages) != 7 {
+		t.Fatalf("expected 7 audio pages, got [%d]", len(pages))
+	}
+	for i, page := range pages[2:6] {
+		if !bytes.Equal(page.packet, []byte{1 << 3}) || page.granule != 2*1920+int64(i+1)*960 {
+			t.Fatalf("bad lost frame page [%d] [%+v]", i, page)
+		}
+	}
+	if last := pages[6]; !bytes.Equal(last.packet, frame) || last.granule != 5*1920 {
+		t.Fatalf("bad last page [%+v]", last)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 
+	"github.com/WhatIETF/goRIPT/api"
 	"github.com/gordonklaus/portaudio"
 	"gopkg.in/hraban/opus.v2"
 )
@@ -18,40 +19,6 @@ const (
 	opusFrameBufferSize = 160
 )
 
-func packFrames(frames [][]byte) []byte {
-	size := 2 * len(frames)
-	for _, frame := range frames {
-		size += len(frame)
-	}
-
-	data := make([]byte, size)
-	offset := 0
-	for _, frame := range frames {
-		size := len(frame)
-		data[offset] = byte(size >> 8)
-		data[offset+1] = byte(size)
-		copy(data[offset+2:], frame)
-		offset += size + 2
-	}
-
-	return data
-}
-
-func unpackFrames(data []byte) ([][]byte, error) {
-	offset := 0
-	frames := [][]byte{}
-	for offset < len(data) {
-		size := (int(data[offset]) << 8) + int(data[offset+1])
-		if size > len(data)-offset-2 {
-			return nil, fmt.Errorf("Unpack error")
-		}
-		frames = append(frames, data[offset+2:offset+2+size])
-		offset += size + 2
-	}
-
-	return frames, nil
-}
-
 func opusCompress(samples []int16) ([]byte, error) {
 	enc, err := opus.NewEncoder(sampleRate, audioChannels, opus.AppVoIP)
 	if err != nil {
@@ -73,11 +40,11 @@ func opusCompress(samples []int16) ([]byte, error) {
 		frames[i] = frames[i][:n]
 	}
 
-	return packFrames(frames), nil
+	return api.PackFrames(frames), nil
 }
 
 func opusDecompress(data []byte) ([]int16, error) {
-	frames, err := unpackFrames(data)
+	frames, err := api.UnpackFrames(data)
 	if err != nil {
 		return nil, err
 	}
@@ -105,12 +72,18 @@ func opusDecompress(data []byte) ([]int16, error) {
 	return samples, nil
 }
 
+// encoded audio along with its level
+type audioContent struct {
+	opus  []byte
+	level uint8
+}
+
 type Microphone struct {
 	stream      *portaudio.Stream
 	errChan     chan error
 	stopChan    chan bool
 	doneChan    chan bool
-	contentChan chan []byte
+	contentChan chan audioContent
 	readBuffer  []int16
 	read        []int16
 }
@@ -133,7 +106,7 @@ func NewMicrophone() (*Microphone, error) {
 	return m, nil
 }
 
-func (m *Microphone) setContentChan(content chan []byte) {
+func (m *Microphone) setContentChan(content chan audioContent) {
 	m.contentChan = content
 }
 
@@ -159,7 +132,10 @@ func (m *Microphone) readStream() {
 				m.errChan <- err
 				return
 			}
-			m.contentChan <- opus
+			m.contentChan <- audioContent{
+				opus:  opus,
+				level: api.AudioLevel(m.readBuffer),
+			}
 			//m.read = append(m.read, m.readBuffer...)
 		}
 	}
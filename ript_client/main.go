@@ -11,6 +11,7 @@ import (
 
 	"github.com/WhatIETF/goRIPT/api"
 	"github.com/WhatIETF/goRIPT/ript_net"
+	"github.com/WhatIETF/goRIPT/sframe"
 	"github.com/google/uuid"
 	"github.com/gordonklaus/portaudio"
 )
@@ -38,6 +39,8 @@ type riptClient struct {
 	handlerInfo  api.HandlerInfo
 	providerInfo *riptProviderInfo
 	callInfo     api.CallResponse
+	// optional end-to-end media encryption (nil when disabled)
+	e2e *sframe.Context
 }
 
 // Register this client's device capability with the provider
@@ -67,14 +70,16 @@ func (c *riptClient) registerHandler() {
 	log.Printf("registerHandler: handlerInfo with uri: [%v]", c.handlerInfo)
 }
 
-// trigger's call creation on the provider for a given destination
-func (c *riptClient) placeCalls() {
+// trigger's call creation on the provider for a given destination, or
+// joins the call at callUri if set
+func (c *riptClient) placeCalls(callUri string) {
 	pkt := api.Packet{
 		Type: api.CallsPacket,
 		Calls: api.CallsMessage{
 			Request: api.CallRequest{
 				HandlerUri:  c.handlerInfo.Uri,
 				Destination: "meeting123@eietf107.ript-dev.com",
+				CallUri:     callUri,
 			},
 		},
 	}
@@ -92,6 +97,7 @@ func (c *riptClient) placeCalls() {
 	}
 	c.providerInfo.activeCallUri = c.callInfo.CallUri
 	log.Printf("placeCalls: callInfo: [%v]", c.callInfo)
+	log.Printf("placeCalls: others join with --join=%s", c.callInfo.CallUri)
 }
 
 // Bootstrap api to retrieve various available trunkGroups on the RIPT server
@@ -127,7 +133,7 @@ func (c *riptClient) recordContent() {
 
 	mic, err := NewMicrophone()
 	chk(err)
-	contentChan := make(chan []byte, 1)
+	contentChan := make(chan audioContent, 1)
 	mic.setContentChan(contentChan)
 	chk(mic.Start())
 	var contentId int32 = 0
@@ -149,12 +155,21 @@ func (c *riptClient) recordContent() {
 				PayloadType: api.PayloadTypeOpus,
 				SourceId:    clientDirective.SourceId,
 				SinkId:      clientDirective.SinkId,
-				Media:       content,
+				Media:       content.opus,
+				AudioLevel:  content.level,
+			}
+
+			if c.e2e != nil {
+				if err := c.e2e.ProtectMedia(&m); err != nil {
+					log.Printf("recordContent: media protect error [%v]", err)
+					continue
+				}
 			}
 
 			pkt := api.Packet{
 				Type:        api.StreamMediaPacket,
 				StreamMedia: m,
+				CallId:      api.CallIdFromUri(c.callInfo.CallUri),
 			}
 			err := c.client.Send(pkt)
 			if err != nil {
@@ -173,6 +188,10 @@ func (c *riptClient) playOutContent() {
 	}()
 
 	c.client.SetReceiveChan(c.recvChan)
+	// ws reads from its socket already, h3 pulls over a long lived stream
+	if h3, ok := c.client.(*QuicClientFace); ok {
+		go h3.Read()
+	}
 	speaker, err := NewSpeaker()
 	chk(err)
 	logCount := 0
@@ -182,6 +201,15 @@ func (c *riptClient) playOutContent() {
 			log.Println("playout stopped")
 			return
 		case evt := <-c.recvChan:
+			if evt.Packet.Type == api.CallEventPacket {
+				event := evt.Packet.CallEvent
+				if event.Type == api.CallEventActiveSpeakers {
+					log.Printf("call event [%s]: active speakers %v", event.Type, event.ActiveSpeakers)
+				} else {
+					log.Printf("call event [%s] from [%s]: %+v", event.Type, event.From, event)
+				}
+				continue
+			}
 			logCount += 1
 			timeInMillis := int64(evt.Packet.StreamMedia.Timestamp)
 			timeInNanos := timeInMillis * 1000000
@@ -193,24 +221,32 @@ func (c *riptClient) playOutContent() {
 				logCount = 0
 			}
 			//	log.Printf("got media evt : [%v]", evt)
-			go speaker.Play(evt.Packet.StreamMedia.Media)
-			continue
-		default:
-			if !c.client.CanStream() {
-				// ask server for the packet
-				pkt := api.Packet{
-					Type: api.StreamMediaRequestPacket,
+			media := evt.Packet.StreamMedia
+			if c.e2e != nil {
+				if err := c.e2e.UnprotectMedia(&media); err != nil {
+					log.Printf("playOutContent: dropping SeqNo [%d], unprotect error [%v]", media.SeqNo, err)
+					continue
 				}
-				c.client.Send(pkt)
 			}
+			go speaker.Play(media.Media)
+			continue
 		}
 	}
 }
 
-// For non streaming clients (H3), trigger's end of call trigger for terminating underlying connection
+// Leaves the call, h3 clients also end their session and media streams
 func (c *riptClient) stop() {
-	if !c.client.CanStream() {
-		c.client.Close(nil)
+	// leave the call before tearing down the transport
+	hangup := api.Packet{
+		Type:   api.CallHangupPacket,
+		CallId: api.CallIdFromUri(c.callInfo.CallUri),
+	}
+	if err := c.client.Send(hangup); err != nil {
+		log.Printf("stop: hangup error [%v]", err)
+	}
+
+	if h3, ok := c.client.(*QuicClientFace); ok {
+		h3.Close(nil)
 	}
 	c.stopChan <- true
 	<-c.doneChan
@@ -251,11 +287,21 @@ func main() {
 	var xport string
 	var mode string
 	var dev bool
+	var caFile string
+	var e2eKey string
+	var e2eKid uint64
+	var qlogDir string
+	var join string
 
 	flag.StringVar(&server, "server", "", "server url as fqdn")
-	flag.StringVar(&xport, "xport", "", "type of transport (h3/ws)")
+	flag.StringVar(&xport, "xport", "", "type of transport (h3/tcp/ws), tcp talks to the h3 routes over HTTP/2 or HTTP/1.1")
 	flag.StringVar(&mode, "mode", "", "push or pull media")
 	flag.BoolVar(&dev, "dev", false, "run client in dev mode with self-signed certs (needed for localhost)")
+	flag.StringVar(&caFile, "cafile", "", "CA cert to trust in dev mode (e.g. from the server's -devpki dir)")
+	flag.StringVar(&e2eKey, "e2ekey", "", "shared secret for end-to-end media encryption (disabled if empty)")
+	flag.Uint64Var(&e2eKid, "e2ekid", 0, "key id for the end-to-end media encryption secret")
+	flag.StringVar(&qlogDir, "qlog-dir", "", "directory for qlog traces of the h3 connections (disabled if empty)")
+	flag.StringVar(&join, "join", "", "uri of the call to join (a new call is placed if empty)")
 	flag.Parse()
 
 	if server == "" {
@@ -269,7 +315,7 @@ func main() {
 	}
 
 	if xport == "" {
-		log.Printf("xport not specified. please specify oneOf(h3/ws)")
+		log.Printf("xport not specified. please specify oneOf(h3/tcp/ws)")
 		return
 	}
 
@@ -280,8 +326,15 @@ func main() {
 	provider := &riptProviderInfo{
 		baseUrl: server,
 	}
-	if xport == "h3" {
-		client = NewQuicClientFace(provider, dev)
+	if xport == "h3" || xport == "tcp" {
+		var qlog *ript_net.Qlogger
+		if qlogDir != "" {
+			qlog, err = ript_net.NewQlogger(ript_net.QlogConfig{Dir: qlogDir, All: true})
+			if err != nil {
+				panic(err)
+			}
+		}
+		client = NewQuicClientFace(provider, dev, caFile, xport == "tcp", qlog)
 	} else if xport == "ws" {
 		client, err = ript_net.NewWebSocketClientFace("ws://localhost:8080/")
 		if err != nil {
@@ -294,6 +347,16 @@ func main() {
 
 	riptClient := NewRIPTClient(client, provider)
 
+	// keys are shared out of band, the relay only sees ciphertext
+	if e2eKey != "" {
+		e2e, err := sframe.NewContext()
+		chk(err)
+		chk(e2e.AddKey(e2eKid, []byte(e2eKey)))
+		chk(e2e.SetSendKey(e2eKid))
+		riptClient.e2e = e2e
+		log.Printf("End-to-end media encryption enabled, kid [%d]", e2eKid)
+	}
+
 	// 1. retrieve trunk groups
 	riptClient.retrieveTrunkGroups()
 
@@ -301,7 +364,7 @@ func main() {
 	riptClient.registerHandler()
 
 	// 3. create calls object
-	riptClient.placeCalls()
+	riptClient.placeCalls(join)
 
 	// 4. deliver/receive media
 	if mode == "push" {
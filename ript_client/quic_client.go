@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -9,30 +10,51 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 	"time"
 
-	"github.com/bifurcation/mint/syntax"
-
 	"github.com/WhatIETF/goRIPT/testData"
 
 	"github.com/WhatIETF/goRIPT/api"
+	"github.com/WhatIETF/goRIPT/ript_net"
 	"github.com/labstack/gommon/log"
 	"github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/http3"
 )
 
 type QuicClientFace struct {
-	client     *http.Client
-	serverInfo *riptProviderInfo
-	name       api.FaceName
-	recvChan   chan api.PacketEvent
-	haveRecv   bool
-	sendChan   chan api.Packet
-	closeChan  chan error
-	haveClosed bool
+	client *http.Client
+	// no timeout, for the long lived media streams
+	streamClient *http.Client
+	serverInfo   *riptProviderInfo
+	name         api.FaceName
+	recvChan     chan api.PacketEvent
+	haveRecv     bool
+	sendChan     chan api.Packet
+	closeChan    chan error
+	haveClosed   bool
+	// request body of the media push stream, nil until the first packet
+	mediaLock   sync.Mutex
+	mediaWriter *io.PipeWriter
+	// ends the media pull stream
+	ctx    context.Context
+	cancel context.CancelFunc
+	// where the next media poll continues
+	pullCursor string
+	// where the next call event poll continues
+	eventCursor string
 }
 
-func NewQuicClientFace(serverInfo *riptProviderInfo, dev bool) *QuicClientFace {
+// poll wait, well within the client's request timeout
+const mediaPollWait = time.Second
+
+// call event polls wait as long as the relay allows, they use the client
+// without timeout
+const eventPollWait = 10 * time.Second
+
+// Talks h3, or HTTP/2 (HTTP/1.1 if need be) over TCP when tcp is set.
+// h3 connections are traced when qlog is set.
+func NewQuicClientFace(serverInfo *riptProviderInfo, dev bool, caFile string, tcp bool, qlog *ript_net.Qlogger) *QuicClientFace {
 
 	pool, err := x509.SystemCertPool()
 	if err != nil {
@@ -41,23 +63,41 @@ func NewQuicClientFace(serverInfo *riptProviderInfo, dev bool) *QuicClientFace {
 	}
 	// add ca-cert when run in dev mode alone
 	if dev {
-		testData.AddRootCA(pool)
+		if caFile != "" {
+			if err := testData.AddRootCAFile(pool, caFile); err != nil {
+				fmt.Printf("ca file error [%v]", err)
+				return nil
+			}
+		} else {
+			testData.AddRootCA(pool)
+		}
 	}
 
 	quicConf := &quic.Config{
 		KeepAlive: true,
 	}
+	if qlog != nil {
+		quicConf.GetLogWriter = qlog.LogWriter("client")
+	}
 
-	roundTripper := &http3.RoundTripper{
-		TLSClientConfig: &tls.Config{
-			RootCAs:            pool,
-			InsecureSkipVerify: false,
-		},
-		QuicConfig: quicConf,
+	tlsConf := &tls.Config{
+		RootCAs:            pool,
+		InsecureSkipVerify: false,
+	}
+	var roundTripper http.RoundTripper = &http3.RoundTripper{
+		TLSClientConfig: tlsConf,
+		QuicConfig:      quicConf,
+	}
+	if tcp {
+		roundTripper = &http.Transport{
+			TLSClientConfig:   tlsConf,
+			ForceAttemptHTTP2: true,
+		}
 	}
 
+	session := &sessionTransport{RoundTripper: roundTripper}
 	client := &http.Client{
-		Transport: roundTripper,
+		Transport: session,
 		Timeout:   2 * time.Second,
 	}
 
@@ -72,15 +112,27 @@ func NewQuicClientFace(serverInfo *riptProviderInfo, dev bool) *QuicClientFace {
 		fmt.Printf("ript_client: register failed. Status code %v", resp.StatusCode)
 		return nil
 	}
+	resp.Body.Close()
+
+	// identifies us on every following request
+	session.token = resp.Header.Get(api.SessionHeader)
+	if session.token == "" {
+		fmt.Printf("ript_client: register failed, no session token")
+		return nil
+	}
 
 	log.Info("ript_client: register success !!!")
 
+	ctx, cancel := context.WithCancel(context.Background())
 	return &QuicClientFace{
-		client:     client,
-		serverInfo: serverInfo,
-		haveRecv:   false,
-		haveClosed: false,
-		closeChan:  make(chan error, 1),
+		client:       client,
+		streamClient: &http.Client{Transport: session},
+		serverInfo:   serverInfo,
+		haveRecv:     false,
+		haveClosed:   false,
+		closeChan:    make(chan error, 1),
+		ctx:          ctx,
+		cancel:       cancel,
 	}
 }
 
@@ -89,96 +141,206 @@ func (c *QuicClientFace) Name() api.FaceName {
 }
 
 func (c *QuicClientFace) CanStream() bool {
-	return false
+	return true
 }
 
+// Read pulls the call's media over a long lived response body, and polls
+// for its events, until the face is closed
 func (c *QuicClientFace) Read() {
-	// ..... //
+	go c.readEvents()
+	for c.ctx.Err() == nil {
+		if err := c.pullMedia(); err != nil && c.ctx.Err() == nil {
+			log.Errorf("ript_client: media pull stream error [%v], reconnecting", err)
+			time.Sleep(time.Second)
+		}
+	}
 }
 
-func (c *QuicClientFace) Send(pkt api.Packet) error {
-	buf := new(bytes.Buffer)
-	var err error
-
-	err = json.NewEncoder(buf).Encode(pkt)
+func (c *QuicClientFace) pullMedia() error {
+	url := c.serverInfo.baseUrl + c.serverInfo.activeCallUri + "/media"
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		log.Errorf("ript_client:send: marshal error")
 		return err
 	}
+	req = req.WithContext(c.ctx)
+	req.Header.Set("Accept", api.MediaStreamContentType)
 
-	// TODO: refactor the cases here.
-	var res *http.Response
-	var responsePacket api.Packet
-	err = nil
-	switch pkt.Type {
-	case api.StreamMediaPacket:
-		url := c.serverInfo.baseUrl + c.serverInfo.getTrunkGroupUri() + "/calls/123/media"
-		log.Printf("ript_client: mediaPush: Url [%s]", url)
+	res, err := c.streamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("ript_client: media pull failed status: [%v]", res.StatusCode)
+	}
 
-		enc, err := syntax.Marshal(pkt.StreamMedia)
+	for {
+		media, err := api.ReadMediaPacket(res.Body)
 		if err != nil {
-			panic(err)
+			return err
 		}
+		c.recvChan <- api.PacketEvent{
+			Packet: api.Packet{
+				Type:        api.StreamMediaPacket,
+				StreamMedia: media,
+			},
+		}
+	}
+}
 
-		req, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(enc))
-		if err != nil {
-			break
+func (c *QuicClientFace) readEvents() {
+	for c.ctx.Err() == nil {
+		if err := c.pollEvents(); err != nil && c.ctx.Err() == nil {
+			log.Errorf("ript_client: call event poll error [%v], retrying", err)
+			time.Sleep(time.Second)
 		}
-		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+}
 
-		res, err = c.client.Do(req)
-		if err != nil || res.StatusCode != 200 {
-			break
+// pollEvents waits for the call events sent since the last poll
+func (c *QuicClientFace) pollEvents() error {
+	url := fmt.Sprintf("%s%s/events?maxWait=%d", c.serverInfo.baseUrl, c.serverInfo.activeCallUri, eventPollWait.Milliseconds())
+	if c.eventCursor != "" {
+		url += "&since=" + c.eventCursor
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.streamClient.Do(req.WithContext(c.ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 && res.StatusCode != 204 {
+		return fmt.Errorf("ript_client: call event poll failed status: [%v]", res.StatusCode)
+	}
+
+	c.eventCursor = res.Header.Get(api.EventCursorHeader)
+	if gap := res.Header.Get(api.EventGapHeader); gap != "" {
+		log.Printf("ript_client: call event poll missed [%s] events", gap)
+	}
+	if res.StatusCode == 204 {
+		return nil
+	}
+
+	var events []api.CallEvent
+	if err := readJSONResponse(res, &events); err != nil {
+		return err
+	}
+	for _, event := range events {
+		c.recvChan <- api.PacketEvent{
+			Packet: api.Packet{
+				Type:      api.CallEventPacket,
+				CallEvent: event,
+			},
 		}
-		//log.Printf("ript_client:send: posted media fragment Id [%d], len [%d]", pkt.StreamMedia.SeqNo,
-		//	len(pkt.StreamMedia.Media))
+	}
+	return nil
+}
 
-	case api.StreamMediaRequestPacket:
-		url := c.serverInfo.baseUrl + c.serverInfo.getTrunkGroupUri() + "/calls/123/media"
-		//log.Printf("ript_client: mediaPull: Url [%s]", url)
-		res, err = c.client.Get(url)
-		if err != nil || res.StatusCode != 200 {
+// pollMedia fetches the media that arrived since the last poll, waiting
+// a little for some when there is none yet
+func (c *QuicClientFace) pollMedia() error {
+	url := fmt.Sprintf("%s%s/media?maxWait=%d", c.serverInfo.baseUrl, c.serverInfo.activeCallUri, mediaPollWait.Milliseconds())
+	if c.pullCursor != "" {
+		url += "&since=" + c.pullCursor
+	}
+	res, err := c.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 && res.StatusCode != 204 {
+		return fmt.Errorf("ript_client: media poll failed status: [%v]", res.StatusCode)
+	}
+
+	c.pullCursor = res.Header.Get(api.MediaCursorHeader)
+	if gap := res.Header.Get(api.MediaGapHeader); gap != "" {
+		log.Printf("ript_client: media poll missed [%s] packets", gap)
+	}
+
+	for res.StatusCode == 200 {
+		media, err := api.ReadMediaPacket(res.Body)
+		if err == io.EOF {
 			break
 		}
-
-		// extract the binary encoded media payload
-		body := &bytes.Buffer{}
-		_, err := io.Copy(body, res.Body)
 		if err != nil {
-			log.Errorf("ript_client: error retrieving the body: [%v]", err)
-			break
+			return err
 		}
+		c.recvChan <- api.PacketEvent{
+			Packet: api.Packet{
+				Type:        api.StreamMediaPacket,
+				StreamMedia: media,
+			},
+		}
+	}
+	return nil
+}
 
-		var media api.StreamContentMedia
-		_, err = syntax.Unmarshal(body.Bytes(), &media)
+// pushMedia writes the packet to the media push stream, opening it on
+// first use
+func (c *QuicClientFace) pushMedia(m api.StreamContentMedia) error {
+	c.mediaLock.Lock()
+	defer c.mediaLock.Unlock()
+
+	if c.mediaWriter == nil {
+		url := c.serverInfo.baseUrl + c.serverInfo.activeCallUri + "/media"
+		log.Printf("ript_client: media push stream: Url [%s]", url)
+		reader, writer := io.Pipe()
+		req, err := http.NewRequest(http.MethodPut, url, reader)
 		if err != nil {
-			log.Errorf("ript_client: media payload unmarshal error [%v]", err)
-			break
+			return err
 		}
+		req.Header.Set("Content-Type", api.MediaStreamContentType)
+
+		// the response only comes once the stream ends
+		go func() {
+			res, err := c.streamClient.Do(req)
+			if err == nil {
+				res.Body.Close()
+				if res.StatusCode != 200 {
+					err = fmt.Errorf("status [%v]", res.StatusCode)
+				}
+			}
+			if err != nil {
+				log.Errorf("ript_client: media push stream failed [%v]", err)
+			}
+			reader.CloseWithError(err)
+		}()
+		c.mediaWriter = writer
+	}
 
-		// construct pkt to forward it to the app layyer
-		responsePacket := api.Packet{
-			Type:        api.StreamMediaPacket,
-			StreamMedia: media,
-		}
+	if err := api.WriteMediaPacket(c.mediaWriter, m); err != nil {
+		// reopened on the next packet
+		c.mediaWriter = nil
+		return err
+	}
+	return nil
+}
 
-		//log.Printf("ript_client:mediapull: received content Id [%d], len [%d] bytes",
-		//	responsePacket.StreamMedia.SeqNo, len(responsePacket.StreamMedia.Media))
+func (c *QuicClientFace) Send(pkt api.Packet) error {
+	// TODO: refactor the cases here.
+	var res *http.Response
+	var err error
+	status := 200
+	switch pkt.Type {
+	case api.StreamMediaPacket:
+		return c.pushMedia(pkt.StreamMedia)
 
-		// forward the packet for further processing
-		c.recvChan <- api.PacketEvent{
-			Packet: responsePacket,
-		}
+	case api.StreamMediaRequestPacket:
+		return c.pollMedia()
 
 	case api.RegisterHandlerPacket:
 		url := c.serverInfo.baseUrl + c.serverInfo.getTrunkGroupUri() + "/handlers"
-		res, err = c.client.Post(url, "application/json; charset=utf-8", buf)
-		if err != nil || res.StatusCode != 200 {
+		status = 201
+		res, err = c.postJSON(url, pkt.RegisterHandler.HandlerRequest)
+		if err != nil || res.StatusCode != status {
 			break
 		}
 
-		responsePacket, err = httpResponseToRiptPacket(res)
-		if err != nil {
+		var handlerRes api.HandlerResponse
+		if err = readJSONResponse(res, &handlerRes); err != nil {
 			break
 		}
 
@@ -186,18 +348,22 @@ func (c *QuicClientFace) Send(pkt api.Packet) error {
 
 		// forward the packet for further processing
 		c.recvChan <- api.PacketEvent{
-			Packet: responsePacket,
+			Packet: api.Packet{
+				Type:            api.RegisterHandlerPacket,
+				RegisterHandler: api.RegisterHandlerMessage{HandlerResponse: handlerRes},
+			},
 		}
 
 	case api.CallsPacket:
 		url := c.serverInfo.baseUrl + c.serverInfo.getTrunkGroupUri() + "/calls"
-		res, err = c.client.Post(url, "application/json; charset=utf-8", buf)
-		if err != nil || res.StatusCode != 200 {
+		status = 201
+		res, err = c.postJSON(url, pkt.Calls.Request)
+		if err != nil || res.StatusCode != status {
 			break
 		}
 
-		responsePacket, err = httpResponseToRiptPacket(res)
-		if err != nil {
+		var callRes api.CallResponse
+		if err = readJSONResponse(res, &callRes); err != nil {
 			break
 		}
 
@@ -205,19 +371,45 @@ func (c *QuicClientFace) Send(pkt api.Packet) error {
 
 		// forward the packet for further processing
 		c.recvChan <- api.PacketEvent{
-			Packet: responsePacket,
+			Packet: api.Packet{
+				Type:  api.CallsPacket,
+				Calls: api.CallsMessage{Response: callRes},
+			},
+		}
+
+	case api.CallHangupPacket:
+		url := c.serverInfo.baseUrl + c.serverInfo.activeCallUri
+		status = 204
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodDelete, url, nil)
+		if err != nil {
+			break
+		}
+		res, err = c.client.Do(req)
+		if err != nil || res.StatusCode != status {
+			break
 		}
+		log.Printf("ript_client: Hangup response [%v]", res)
+
+	case api.CallEventPacket:
+		url := c.serverInfo.baseUrl + c.serverInfo.activeCallUri + "/events"
+		status = 202
+		res, err = c.postJSON(url, pkt.CallEvent)
+		if err != nil || res.StatusCode != status {
+			break
+		}
+		log.Printf("ript_client: call event [%s] sent", pkt.CallEvent.Type)
 
 	case api.TrunkGroupDiscoveryPacket:
 		trunkDiscoveryUrl := c.serverInfo.baseUrl + "/.well-known/ript/v1/providertgs"
 		fmt.Printf("ript_client: trunkDiscovery url [%s]", trunkDiscoveryUrl)
 		res, err = c.client.Get(trunkDiscoveryUrl)
-		if err != nil || res.StatusCode != 200 {
+		if err != nil || res.StatusCode != status {
 			break
 		}
 
-		responsePacket, err = httpResponseToRiptPacket(res)
-		if err != nil {
+		var tgs api.TrunkGroupsInfoMessage
+		if err = readJSONResponse(res, &tgs); err != nil {
 			break
 		}
 
@@ -225,15 +417,21 @@ func (c *QuicClientFace) Send(pkt api.Packet) error {
 
 		// forward the packet for further processing
 		c.recvChan <- api.PacketEvent{
-			Packet: responsePacket,
+			Packet: api.Packet{
+				Type:            api.TrunkGroupDiscoveryPacket,
+				TrunkGroupsInfo: tgs,
+			},
 		}
+
+	default:
+		return fmt.Errorf("ript_client:send: packet type [%v] not supported", pkt.Type)
 	}
 
 	if err != nil {
 		return err
 	}
 
-	if res.StatusCode != 200 {
+	if res.StatusCode != status {
 		return fmt.Errorf("ript_client:send: failed status: [%v]", res.StatusCode)
 	}
 
@@ -249,6 +447,15 @@ func (c *QuicClientFace) SetReceiveChan(recv chan api.PacketEvent) {
 func (c *QuicClientFace) Close(err error) {
 	fmt.Printf("Close called on QuicFace with err %v\n", err)
 
+	// end the media streams
+	c.cancel()
+	c.mediaLock.Lock()
+	if c.mediaWriter != nil {
+		c.mediaWriter.Close()
+		c.mediaWriter = nil
+	}
+	c.mediaLock.Unlock()
+
 	leaveUrl := c.serverInfo.baseUrl + "/media/leave"
 	log.Info("ript_client: Unregistering from the server...")
 	resp, err := c.client.Get(leaveUrl)
@@ -269,24 +476,39 @@ func (c *QuicClientFace) OnClose() chan error {
 //// helpers
 ///////
 
-func httpResponseToRiptPacket(response *http.Response) (api.Packet, error) {
-	if response == nil {
-		return api.Packet{}, errors.New("ript_client: invalid response object")
+// presents the session token issued on join
+type sessionTransport struct {
+	http.RoundTripper
+	token string
+}
+
+func (t *sessionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.token != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(api.SessionHeader, t.token)
 	}
+	return t.RoundTripper.RoundTrip(req)
+}
 
-	body := &bytes.Buffer{}
-	_, err := io.Copy(body, response.Body)
-	if err != nil {
-		log.Errorf("ript_client: error retrieving the body: [%v]", err)
-		return api.Packet{}, err
+func (c *QuicClientFace) postJSON(url string, v interface{}) (*http.Response, error) {
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		log.Errorf("ript_client:send: marshal error")
+		return nil, err
 	}
+	return c.client.Post(url, "application/json; charset=utf-8", buf)
+}
 
-	var packet api.Packet
-	err = json.Unmarshal(body.Bytes(), &packet)
+func readJSONResponse(response *http.Response, v interface{}) error {
+	if response == nil {
+		return errors.New("ript_client: invalid response object")
+	}
+
+	err := json.NewDecoder(response.Body).Decode(v)
 	if err != nil {
 		log.Errorf("ript_client: content unmarshal [%v]", err)
-		return api.Packet{}, err
+		return err
 	}
 
-	return packet, nil
+	return nil
 }
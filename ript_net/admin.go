@@ -0,0 +1,35 @@
+package ript_net
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Operator facing http API of the relay. It has no authentication,
+// keep it on a private address.
+type AdminServer struct {
+	*http.Server
+	Router *mux.Router
+}
+
+func NewAdminServer(addr string) *AdminServer {
+	router := mux.NewRouter()
+	return &AdminServer{
+		Server: &http.Server{
+			Addr:    addr,
+			Handler: router,
+		},
+		Router: router,
+	}
+}
+
+func (a *AdminServer) Start() {
+	log.Printf("Admin API on [%s]", a.Addr)
+	go func() {
+		if err := a.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("admin server error [%v]", err)
+		}
+	}()
+}
@@ -0,0 +1,138 @@
+package ript_net
+
+import (
+	"encoding/hex"
+	"io"
+	"net"
+	"sync"
+)
+
+// QUIC connections of the h3 server, watched so that faces close with the
+// connection they were last used over. quic-go v0.15 has no close hook,
+// but asks for a qlog writer per connection and closes it when the
+// connection closes. The watcher hands out those writers, learning each
+// connection's client address from its Initial packet, and passes the
+// trace on to the qlogger if that traces the connection.
+//
+// quic-go keeps a connection's qlog events in memory until the connection
+// closes, watching every connection has that cost.
+
+type connWatch struct {
+	// optional, traces connections as well
+	qlog *Qlogger
+	// called with the client address once a connection closes
+	onClose func(addr string)
+	lock    sync.Mutex
+	// client address by the connection id of its Initial packets
+	conns map[string]string
+}
+
+func newConnWatch(qlog *Qlogger, onClose func(addr string)) *connWatch {
+	return &connWatch{
+		qlog:    qlog,
+		onClose: onClose,
+		conns:   map[string]string{},
+	}
+}
+
+// initialConnID returns the destination connection id of an Initial
+// packet, parsing only the version independent long header
+func initialConnID(packet []byte) (string, bool) {
+	// long header, Initial type
+	if len(packet) < 6 || packet[0]&0x80 == 0 || packet[0]&0x30 != 0 {
+		return "", false
+	}
+	idLen := int(packet[5])
+	if len(packet) < 6+idLen {
+		return "", false
+	}
+	return hex.EncodeToString(packet[6 : 6+idLen]), true
+}
+
+func (w *connWatch) observe(packet []byte, addr net.Addr) {
+	if w.qlog != nil {
+		w.qlog.observe(packet, addr)
+	}
+	id, ok := initialConnID(packet)
+	if !ok {
+		return
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.conns[id]; ok {
+		return
+	}
+	if len(w.conns) >= maxPendingQlogConns {
+		w.conns = map[string]string{}
+	}
+	w.conns[id] = addr.String()
+}
+
+// LogWriter returns the quic.Config GetLogWriter hook
+func (w *connWatch) LogWriter(perspective string) func(connID []byte) io.WriteCloser {
+	var trace func(connID []byte) io.WriteCloser
+	if w.qlog != nil {
+		trace = w.qlog.LogWriter(perspective)
+	}
+	return func(connID []byte) io.WriteCloser {
+		var traced io.WriteCloser
+		if trace != nil {
+			traced = trace(connID)
+		}
+
+		id := hex.EncodeToString(connID)
+		w.lock.Lock()
+		addr, known := w.conns[id]
+		delete(w.conns, id)
+		w.lock.Unlock()
+		if !known {
+			return traced
+		}
+		return &watchedConn{
+			trace:  traced,
+			closed: func() { w.onClose(addr) },
+		}
+	}
+}
+
+// watchedConn is a connection's qlog writer, the trace is dropped unless
+// the connection is traced
+type watchedConn struct {
+	trace  io.WriteCloser
+	closed func()
+}
+
+func (c *watchedConn) Write(p []byte) (int, error) {
+	if c.trace == nil {
+		return len(p), nil
+	}
+	return c.trace.Write(p)
+}
+
+func (c *watchedConn) Close() error {
+	c.closed()
+	if c.trace == nil {
+		return nil
+	}
+	return c.trace.Close()
+}
+
+type watchedPacketConn struct {
+	net.PacketConn
+	watch *connWatch
+}
+
+func (c *watchedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil {
+		c.watch.observe(p[:n], addr)
+	}
+	return n, addr, err
+}
+
+// PacketConn has the server's connections observed, to learn which client
+// each connection is from
+func (w *connWatch) PacketConn(conn net.PacketConn) net.PacketConn {
+	return &watchedPacketConn{PacketConn: conn, watch: w}
+}
@@ -0,0 +1,66 @@
+package ript_net
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConnWatchReportsClosedConnections(t *testing.T) {
+	var closed []string
+	w := newConnWatch(nil, func(addr string) { closed = append(closed, addr) })
+	logWriter := w.LogWriter("server")
+	alice := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000}
+
+	w.observe(initialPacket([]byte{1, 2, 3, 4}), alice)
+	conn := logWriter([]byte{1, 2, 3, 4})
+	if conn == nil {
+		t.Fatalf("connection not watched")
+	}
+	if n, err := conn.Write([]byte("trace")); n != 5 || err != nil {
+		t.Fatalf("untraced write [%d] [%v]", n, err)
+	}
+	if len(closed) != 0 {
+		t.Fatalf("closed before the connection closed")
+	}
+	conn.Close()
+	if len(closed) != 1 || closed[0] != alice.String() {
+		t.Fatalf("unexpected closed connections %v", closed)
+	}
+
+	// connections never seen aren't watched
+	if conn := logWriter([]byte{5, 6, 7, 8}); conn != nil {
+		t.Fatalf("unknown connection watched")
+	}
+}
+
+func TestConnWatchTracesWithQlog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := NewQlogger(QlogConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var closed []string
+	w := newConnWatch(q, func(addr string) { closed = append(closed, addr) })
+	logWriter := w.LogWriter("server")
+	q.TraceClient("10.0.0.1", true)
+	w.observe(initialPacket([]byte{1, 2, 3, 4}), &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000})
+
+	conn := logWriter([]byte{1, 2, 3, 4})
+	conn.Write([]byte("trace"))
+	conn.Close()
+	trace, err := ioutil.ReadFile(filepath.Join(dir, "server_01020304.qlog"))
+	if err != nil || string(trace) != "trace" {
+		t.Fatalf("unexpected trace [%s] [%v]", trace, err)
+	}
+	if len(closed) != 1 {
+		t.Fatalf("unexpected closed connections %v", closed)
+	}
+}
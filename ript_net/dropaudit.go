@@ -0,0 +1,84 @@
+package ript_net
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+// Dropped media is audited per face, call and reason instead of per
+// packet. The first drop is recorded right away, later ones are counted
+// and folded into a single record per interval.
+
+const mediaDropAuditInterval = 10 * time.Second
+
+type mediaDropKey struct {
+	face   api.FaceName
+	uri    string
+	reason DropReason
+}
+
+type mediaDropWindow struct {
+	start time.Time
+	// drops since the last record
+	dropped uint64
+}
+
+type mediaDropAudit struct {
+	interval time.Duration
+	lock     sync.Mutex
+	windows  map[mediaDropKey]*mediaDropWindow
+}
+
+func newMediaDropAudit(interval time.Duration) *mediaDropAudit {
+	return &mediaDropAudit{
+		interval: interval,
+		windows:  map[mediaDropKey]*mediaDropWindow{},
+	}
+}
+
+// drop counts a dropped packet, returning whether a record is due and how
+// many packets it covers
+func (a *mediaDropAudit) drop(key mediaDropKey, now time.Time) (uint64, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	w, ok := a.windows[key]
+	if ok && now.Sub(w.start) < a.interval {
+		w.dropped++
+		return 0, false
+	}
+	n := uint64(1)
+	if ok {
+		n += w.dropped
+	}
+	a.windows[key] = &mediaDropWindow{start: now}
+	return n, true
+}
+
+// forget removes the face's windows, returning the drops not recorded yet
+func (a *mediaDropAudit) forget(face api.FaceName) map[mediaDropKey]uint64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	pending := map[mediaDropKey]uint64{}
+	for key, w := range a.windows {
+		if key.face != face {
+			continue
+		}
+		if w.dropped > 0 {
+			pending[key] = w.dropped
+		}
+		delete(a.windows, key)
+	}
+	return pending
+}
+
+func mediaDropDetail(reason DropReason, n uint64) string {
+	if n == 1 {
+		return string(reason)
+	}
+	return fmt.Sprintf("%s (%d packets)", reason, n)
+}
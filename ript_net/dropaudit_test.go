@@ -0,0 +1,39 @@
+package ript_net
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMediaDropAuditAggregates(t *testing.T) {
+	a := newMediaDropAudit(time.Second)
+	now := time.Now()
+	key := mediaDropKey{"mallory", "/calls/1/media", DropNotParticipant}
+
+	if n, due := a.drop(key, now); !due || n != 1 {
+		t.Fatalf("expected the first drop to be recorded, got [%d] [%v]", n, due)
+	}
+	for i := 0; i < 99; i++ {
+		if _, due := a.drop(key, now.Add(time.Millisecond)); due {
+			t.Fatalf("drop [%d] recorded within the interval", i)
+		}
+	}
+	// other reasons are counted on their own
+	other := mediaDropKey{"mallory", "/calls/1/media", DropNotNegotiated}
+	if _, due := a.drop(other, now); !due {
+		t.Fatalf("expected the first drop of another reason to be recorded")
+	}
+
+	if n, due := a.drop(key, now.Add(time.Second)); !due || n != 100 {
+		t.Fatalf("expected a record covering 100 drops, got [%d] [%v]", n, due)
+	}
+	a.drop(key, now.Add(time.Second+time.Millisecond))
+
+	pending := a.forget("mallory")
+	if len(pending) != 1 || pending[key] != 1 {
+		t.Fatalf("unexpected pending drops %v", pending)
+	}
+	if len(a.windows) != 0 {
+		t.Fatalf("windows left after forget %v", a.windows)
+	}
+}
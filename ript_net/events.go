@@ -0,0 +1,118 @@
+package ript_net
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+// In-call signaling between the participants of a call: hangup, mute,
+// DTMF and transfer. The relay stamps the sender and forwards the event
+// to the other participants, whatever transport they use, and to the
+// peer relays sharing the call.
+
+const dtmfDigits = "0123456789*#ABCD"
+
+// validateCallEvent accepts the events participants may send, the others
+// are the relay's own
+func validateCallEvent(e api.CallEvent) error {
+	switch e.Type {
+	case api.CallEventHangup, api.CallEventMute:
+	case api.CallEventDTMF:
+		if e.Digits == "" {
+			return errors.New("ript_net: dtmf event without digits")
+		}
+		for _, d := range e.Digits {
+			if !strings.ContainsRune(dtmfDigits, d) {
+				return fmt.Errorf("ript_net: bad dtmf digit [%c]", d)
+			}
+		}
+	case api.CallEventTransfer:
+		if e.Target == "" {
+			return errors.New("ript_net: transfer event without target")
+		}
+	default:
+		return fmt.Errorf("ript_net: unsupported call event [%s]", e.Type)
+	}
+	return nil
+}
+
+// eventTargets checks that the sender is in the call and returns the
+// local call with who to forward its events to. A non empty DropReason
+// means the event must not be forwarded.
+func (s *RIPTService) eventTargets(callId string, sender api.FaceName) (*Call, []api.FaceName, DropReason) {
+	s.callLock.RLock()
+	defer s.callLock.RUnlock()
+
+	// events from a peer relay only go to our own participants
+	if call, ok := s.peerCall(sender, callId); ok {
+		var targets []api.FaceName
+		for face := range call.participants {
+			targets = append(targets, face)
+		}
+		return call, targets, ""
+	}
+
+	call, ok := s.calls[callId]
+	if !ok {
+		return nil, nil, DropUnknownCall
+	}
+	if _, ok := call.participants[sender]; !ok {
+		return nil, nil, DropNotParticipant
+	}
+	var targets []api.FaceName
+	for face := range call.participants {
+		if face != sender {
+			targets = append(targets, face)
+		}
+	}
+	for peer := range call.peers {
+		targets = append(targets, peer)
+	}
+	return call, targets, ""
+}
+
+// relayCallEvent forwards a participant's event within the call. A
+// participant hanging up leaves the call once the others are told.
+// Returns why the event was dropped when the sender isn't in the call.
+func (r *Router) relayCallEvent(evt api.PacketEvent) DropReason {
+	event := evt.Packet.CallEvent
+	if err := validateCallEvent(event); err != nil {
+		log.Printf("[%s] dropping call event from [%s]: %v", r.name, evt.Sender, err)
+		return ""
+	}
+
+	call, targets, reason := r.service.eventTargets(evt.CallId, evt.Sender)
+	if reason != "" {
+		log.Printf("[%s] dropping call event [%s] from [%s] for call [%s]: %s",
+			r.name, event.Type, evt.Sender, evt.CallId, reason)
+		r.countDrop(reason)
+		return reason
+	}
+
+	// peers relay their participants' events with the sender already set
+	if event.From == "" || !r.isPeer(evt.Sender) {
+		event.From = ""
+		if ids := r.service.participantIds(call.id, []api.FaceName{evt.Sender}); len(ids) == 1 {
+			event.From = ids[0]
+		}
+	}
+	log.Printf("[%s] call event [%s] from [%s] in call [%s]", r.name, event.Type, event.From, call.id)
+	for _, name := range targets {
+		r.send(name, api.Packet{
+			Type:      api.CallEventPacket,
+			CallId:    call.id,
+			CallEvent: event,
+		})
+	}
+
+	if event.Type == api.CallEventHangup && !r.isPeer(evt.Sender) {
+		if err := r.service.leaveCall(call.id, evt.Sender); err != nil {
+			log.Printf("[%s] hangup from [%s] failed: %v", r.name, evt.Sender, err)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package ript_net
+
+import (
+	"testing"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+func sendEvent(face *testFace, callId string, event api.CallEvent) {
+	face.recvChan <- api.PacketEvent{
+		Sender: face.name,
+		CallId: callId,
+		Packet: api.Packet{
+			Type:      api.CallEventPacket,
+			CallEvent: event,
+		},
+	}
+}
+
+func TestValidateCallEvent(t *testing.T) {
+	valid := []api.CallEvent{
+		{Type: api.CallEventHangup},
+		{Type: api.CallEventMute, Muted: true},
+		{Type: api.CallEventDTMF, Digits: "12*#A"},
+		{Type: api.CallEventTransfer, Target: "/.well-known/ript/v1/providertgs/trunkAbc/calls/2"},
+	}
+	for _, e := range valid {
+		if err := validateCallEvent(e); err != nil {
+			t.Fatalf("[%s] rejected: %v", e.Type, err)
+		}
+	}
+
+	invalid := []api.CallEvent{
+		{Type: api.CallEventActiveSpeakers},
+		{Type: api.CallEventDTMF},
+		{Type: api.CallEventDTMF, Digits: "1x"},
+		{Type: api.CallEventTransfer},
+		{Type: "unknown"},
+	}
+	for _, e := range invalid {
+		if err := validateCallEvent(e); err == nil {
+			t.Fatalf("[%s] accepted %+v", e.Type, e)
+		}
+	}
+}
+
+func TestRouterRelaysCallEvents(t *testing.T) {
+	r := NewRouter("test", NewRIPTService())
+
+	alice := newTestFace("alice")
+	bob := newTestFace("bob")
+	mallory := newTestFace("mallory")
+	r.AddFace(alice)
+	r.AddFace(bob)
+	r.AddFace(mallory)
+
+	call := joinCall(t, alice, "")
+	bobCall := joinCall(t, bob, call.CallUri)
+	callId := api.CallIdFromUri(call.CallUri)
+
+	sendEvent(alice, callId, api.CallEvent{Type: api.CallEventDTMF, Digits: "42", From: "someone"})
+	pkt := awaitPacket(t, bob, api.CallEventPacket)
+	if pkt.CallId != callId || pkt.CallEvent.Digits != "42" || pkt.CallEvent.From != call.ParticipantId {
+		t.Fatalf("unexpected event %+v", pkt)
+	}
+	expectNoPacket(t, alice)
+
+	// not in the call
+	sendEvent(mallory, callId, api.CallEvent{Type: api.CallEventMute, Muted: true})
+	expectNoPacket(t, alice)
+	expectNoPacket(t, bob)
+	if r.Drops()[DropNotParticipant] != 1 {
+		t.Fatalf("expected the event to be dropped, drops %v", r.Drops())
+	}
+
+	// hangups asking for the outcome learn why they were refused
+	hangup := func(face *testFace, callId string) api.Packet {
+		face.recvChan <- api.PacketEvent{
+			Sender: face.name,
+			CallId: callId,
+			Packet: api.Packet{Type: api.CallHangupPacket, RequestId: "hangup"},
+		}
+		pkt := awaitPacket(t, face, api.CallHangupPacket)
+		if pkt.RequestId != "hangup" {
+			t.Fatalf("unexpected reply %+v", pkt)
+		}
+		return pkt
+	}
+	if pkt := hangup(mallory, "no-such-call"); pkt.Error != string(DropUnknownCall) {
+		t.Fatalf("unexpected reply %+v", pkt)
+	}
+	if pkt := hangup(mallory, callId); pkt.Error != string(DropNotParticipant) {
+		t.Fatalf("unexpected reply %+v", pkt)
+	}
+	expectNoPacket(t, alice)
+
+	// hanging up tells the others and leaves the call
+	if pkt := hangup(bob, callId); pkt.Error != "" {
+		t.Fatalf("unexpected reply %+v", pkt)
+	}
+	pkt = awaitPacket(t, alice, api.CallEventPacket)
+	if pkt.CallEvent.Type != api.CallEventHangup || pkt.CallEvent.From != bobCall.ParticipantId {
+		t.Fatalf("unexpected event %+v", pkt.CallEvent)
+	}
+	awaitMembers(t, r, callId, 1)
+}
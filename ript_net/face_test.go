@@ -0,0 +1,104 @@
+package ript_net
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+// forceInboundPrompt opens a listener up front so the OS firewall
+// prompt (if any) shows before the test servers start.
+func forceInboundPrompt() {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err == nil {
+		ln.Close()
+	}
+}
+
+func expectPacket(t *testing.T, recv chan api.PacketEvent, expected api.Packet) {
+	t.Helper()
+	select {
+	case evt := <-recv:
+		if !reflect.DeepEqual(evt.Packet, expected) {
+			t.Fatalf("packet mismatch [%+v] != [%+v]", evt.Packet, expected)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for packet [%v]", expected.Type)
+	}
+}
+
+// faceTest checks that packets sent on one end of a face pair
+// are received on the other one, in both directions.
+func faceTest(t *testing.T, a, b Face) {
+	recvA := make(chan api.PacketEvent, 1)
+	recvB := make(chan api.PacketEvent, 1)
+	a.SetReceiveChan(recvA)
+	b.SetReceiveChan(recvB)
+
+	pkt := api.Packet{
+		Type: api.TrunkGroupDiscoveryPacket,
+		TrunkGroupsInfo: api.TrunkGroupsInfoMessage{
+			TrunkGroups: []api.TrunkGroupInfo{{Uri: baseTrunkGroupsUrl + "/" + defaultTrunkGroupId}},
+		},
+	}
+
+	if err := a.Send(pkt); err != nil {
+		t.Fatalf("send error [%v]", err)
+	}
+	expectPacket(t, recvB, pkt)
+
+	if err := b.Send(pkt); err != nil {
+		t.Fatalf("send error [%v]", err)
+	}
+	expectPacket(t, recvA, pkt)
+}
+
+// In-memory face for router tests
+type testFace struct {
+	name      api.FaceName
+	recvChan  chan api.PacketEvent
+	sent      chan api.Packet
+	closeChan chan error
+	closed    chan error
+}
+
+func newTestFace(name string) *testFace {
+	return &testFace{
+		name:      api.FaceName(name),
+		sent:      make(chan api.Packet, 100),
+		closeChan: make(chan error, 1),
+		closed:    make(chan error, 1),
+	}
+}
+
+func (f *testFace) Name() api.FaceName { return f.name }
+func (f *testFace) Read()              {}
+func (f *testFace) CanStream() bool    { return true }
+
+func (f *testFace) Send(pkt api.Packet) error {
+	f.sent <- pkt
+	return nil
+}
+
+func (f *testFace) SetReceiveChan(recv chan api.PacketEvent) {
+	f.recvChan = recv
+}
+
+func (f *testFace) Close(err error) {
+	f.closed <- err
+}
+
+func (f *testFace) OnClose() chan error {
+	return f.closeChan
+}
+
+// inject a packet as if it was received over the wire
+func (f *testFace) receive(pkt api.Packet) {
+	f.recvChan <- api.PacketEvent{
+		Sender: f.name,
+		Packet: pkt,
+	}
+}
@@ -0,0 +1,112 @@
+package ript_net
+
+import (
+	"sync"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+// Media, or call events, waiting to be pulled by a request/response face.
+// Every call of the face has its own buffer and cursors, each packet gets
+// the call's next cursor and pulls ask for what came after the cursor they
+// last saw. A call keeps its newest packets only, a pull that fell further
+// behind learns how many of the call's packets it missed.
+
+const mediaBufferSize = 50
+
+type bufferedMedia struct {
+	cursor uint64
+	pkt    api.Packet
+}
+
+type callMedia struct {
+	packets []bufferedMedia
+	// cursor of the newest packet, 0 before the first
+	latest uint64
+	// closed and replaced on every push
+	notify chan struct{}
+}
+
+type mediaBuffer struct {
+	lock  sync.Mutex
+	calls map[string]*callMedia
+	// closed and replaced whenever a call gets its buffer, wakes the
+	// pulls of calls that had none yet
+	created chan struct{}
+}
+
+func newMediaBuffer() *mediaBuffer {
+	return &mediaBuffer{
+		calls:   map[string]*callMedia{},
+		created: make(chan struct{}),
+	}
+}
+
+// push never blocks, the call's oldest packet makes room when full. Calls
+// get their buffer with their first packet, pulls don't create any.
+func (b *mediaBuffer) push(pkt api.Packet) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c, ok := b.calls[pkt.CallId]
+	if !ok {
+		c = &callMedia{notify: make(chan struct{})}
+		b.calls[pkt.CallId] = c
+		close(b.created)
+		b.created = make(chan struct{})
+	}
+	c.latest++
+	if len(c.packets) == mediaBufferSize {
+		c.packets = c.packets[1:]
+	}
+	c.packets = append(c.packets, bufferedMedia{cursor: c.latest, pkt: pkt})
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+// since returns the call's packets after the cursor, the cursor to pull
+// from next and the number of the call's packets dropped before they were
+// pulled. The channel is closed once newer packets of the call arrive,
+// calls without packets yet return nothing.
+func (b *mediaBuffer) since(cursor uint64, callId string) ([]api.Packet, uint64, uint64, <-chan struct{}) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c, ok := b.calls[callId]
+	if !ok {
+		return nil, 0, 0, b.created
+	}
+
+	// a cursor from before a relay restart
+	if cursor > c.latest {
+		cursor = c.latest
+	}
+
+	var gap uint64
+	if len(c.packets) > 0 && c.packets[0].cursor > cursor+1 {
+		gap = c.packets[0].cursor - cursor - 1
+	}
+
+	var pkts []api.Packet
+	for _, m := range c.packets {
+		if m.cursor > cursor {
+			pkts = append(pkts, m.pkt)
+		}
+	}
+	return pkts, c.latest, gap, c.notify
+}
+
+// cursor of the call's newest packet
+func (b *mediaBuffer) cursor(callId string) uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if c, ok := b.calls[callId]; ok {
+		return c.latest
+	}
+	return 0
+}
+
+// forget drops the call's buffer once the face left it
+func (b *mediaBuffer) forget(callId string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.calls, callId)
+}
@@ -0,0 +1,102 @@
+package ript_net
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+func mediaPacket(callId string, seqNo uint64) api.Packet {
+	return api.Packet{
+		Type:        api.StreamMediaPacket,
+		CallId:      callId,
+		StreamMedia: api.StreamContentMedia{SeqNo: seqNo},
+	}
+}
+
+func TestMediaBufferSince(t *testing.T) {
+	b := newMediaBuffer()
+	_, cursor, _, more := b.since(0, "call")
+	if cursor != 0 {
+		t.Fatalf("unexpected cursor [%d]", cursor)
+	}
+
+	b.push(mediaPacket("call", 1))
+	b.push(mediaPacket("other", 1))
+	b.push(mediaPacket("call", 2))
+	select {
+	case <-more:
+	default:
+		t.Fatalf("waiters not notified")
+	}
+
+	pkts, cursor, gap, _ := b.since(0, "call")
+	if len(pkts) != 2 || pkts[0].StreamMedia.SeqNo != 1 || pkts[1].StreamMedia.SeqNo != 2 || cursor != 2 || gap != 0 {
+		t.Fatalf("unexpected pull [%v] cursor [%d] gap [%d]", pkts, cursor, gap)
+	}
+	if pkts, _, _, _ := b.since(cursor, "call"); len(pkts) != 0 {
+		t.Fatalf("pulled [%d] packets twice", len(pkts))
+	}
+}
+
+func TestMediaBufferReportsGap(t *testing.T) {
+	b := newMediaBuffer()
+	for i := 1; i <= mediaBufferSize+5; i++ {
+		b.push(mediaPacket("call", uint64(i)))
+	}
+
+	pkts, cursor, gap, _ := b.since(2, "call")
+	if gap != 3 || len(pkts) != mediaBufferSize || pkts[0].StreamMedia.SeqNo != 6 || cursor != mediaBufferSize+5 {
+		t.Fatalf("unexpected pull of [%d] cursor [%d] gap [%d]", len(pkts), cursor, gap)
+	}
+
+	// cursors from before a restart start over at the newest packet
+	if pkts, cursor, gap, _ := b.since(1000, "call"); len(pkts) != 0 || cursor != mediaBufferSize+5 || gap != 0 {
+		t.Fatalf("unexpected pull of [%d] cursor [%d] gap [%d]", len(pkts), cursor, gap)
+	}
+}
+
+func TestMediaBufferGapsArePerCall(t *testing.T) {
+	b := newMediaBuffer()
+	b.push(mediaPacket("call", 1))
+	_, cursor, _, _ := b.since(0, "call")
+	for i := 1; i <= mediaBufferSize+5; i++ {
+		b.push(mediaPacket("other", uint64(i)))
+	}
+	b.push(mediaPacket("call", 2))
+
+	pkts, next, gap, _ := b.since(cursor, "call")
+	if len(pkts) != 1 || pkts[0].StreamMedia.SeqNo != 2 || next != 2 || gap != 0 {
+		t.Fatalf("unexpected pull of [%d] cursor [%d] gap [%d]", len(pkts), next, gap)
+	}
+	if _, _, gap, _ := b.since(2, "other"); gap != 3 {
+		t.Fatalf("unexpected gap [%d] for the other call", gap)
+	}
+}
+
+func TestMediaBufferPullsDontCreateCalls(t *testing.T) {
+	b := newMediaBuffer()
+	for i := 0; i < 10; i++ {
+		callId := "unknown-" + strconv.Itoa(i)
+		if pkts, cursor, _, _ := b.since(0, callId); len(pkts) != 0 || cursor != 0 {
+			t.Fatalf("unexpected pull [%v] cursor [%d]", pkts, cursor)
+		}
+		b.cursor(callId)
+	}
+	if len(b.calls) != 0 {
+		t.Fatalf("pulls created [%d] call buffers", len(b.calls))
+	}
+
+	b.forget("call")
+	_, _, _, more := b.since(0, "call")
+	b.push(mediaPacket("call", 1))
+	select {
+	case <-more:
+	default:
+		t.Fatalf("waiters not notified of the call's first packet")
+	}
+	if pkts, cursor, _, _ := b.since(0, "call"); len(pkts) != 1 || cursor != 1 {
+		t.Fatalf("unexpected pull [%v] cursor [%d]", pkts, cursor)
+	}
+}
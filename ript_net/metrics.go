@@ -0,0 +1,122 @@
+package ript_net
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/WhatIETF/goRIPT/api"
+	"github.com/WhatIETF/goRIPT/metrics"
+)
+
+// Relay metrics for the admin API's /metrics endpoint. Counts the router
+// already keeps are collected when scraped, forwarded packets are counted
+// as they are queued.
+
+// faces tell the transport they run on, for the per transport face count
+type transportFace interface {
+	Transport() string
+}
+
+func faceTransport(face Face) string {
+	if t, ok := face.(transportFace); ok {
+		return t.Transport()
+	}
+	return "other"
+}
+
+var packetTypeNames = map[api.PacketType]string{
+	api.TrunkGroupDiscoveryPacket: "trunk_group_discovery",
+	api.RegisterHandlerPacket:     "register_handler",
+	api.CallsPacket:               "calls",
+	api.StreamMediaPacket:         "stream_media",
+	api.StreamMediaAckPacket:      "stream_media_ack",
+	api.StreamMediaRequestPacket:  "stream_media_request",
+	api.CallHangupPacket:          "call_hangup",
+	api.PeerCallPacket:            "peer_call",
+	api.CallEventPacket:           "call_event",
+}
+
+func packetTypeName(t api.PacketType) string {
+	if name, ok := packetTypeNames[t]; ok {
+		return name
+	}
+	return strconv.Itoa(int(t))
+}
+
+type routerMetrics struct {
+	forwardedPackets *metrics.Counter
+	forwardedBytes   *metrics.Counter
+}
+
+func (r *Router) registerMetrics(reg *metrics.Registry) {
+	r.metrics.forwardedPackets = reg.NewCounter("ript_forwarded_packets_total",
+		"Packets queued for delivery to faces.", "type")
+	r.metrics.forwardedBytes = reg.NewCounter("ript_forwarded_bytes_total",
+		"Approximate bytes queued for delivery to faces.", "type")
+
+	reg.NewGaugeFunc("ript_faces", "Connected faces.", func() []metrics.Sample {
+		r.faceLock.RLock()
+		counts := map[string]int{}
+		for _, face := range r.faces {
+			counts[faceTransport(face)]++
+		}
+		r.faceLock.RUnlock()
+
+		var samples []metrics.Sample
+		for transport, n := range counts {
+			samples = append(samples, metrics.Sample{LabelValues: []string{transport}, Value: float64(n)})
+		}
+		return samples
+	}, "transport")
+
+	reg.NewGaugeFunc("ript_calls", "Active calls.", func() []metrics.Sample {
+		calls, _ := r.service.counts()
+		return []metrics.Sample{{Value: float64(calls)}}
+	})
+
+	reg.NewGaugeFunc("ript_handlers", "Registered handlers.", func() []metrics.Sample {
+		_, handlers := r.service.counts()
+		return []metrics.Sample{{Value: float64(handlers)}}
+	})
+
+	reg.NewCounterFunc("ript_dropped_packets_total", "Packets dropped instead of forwarded.", func() []metrics.Sample {
+		var samples []metrics.Sample
+		for reason, n := range r.Drops() {
+			samples = append(samples, metrics.Sample{LabelValues: []string{string(reason)}, Value: float64(n)})
+		}
+		return samples
+	}, "reason")
+
+	// summed over the faces, a label per face would grow without bound
+	reg.NewGaugeFunc("ript_send_queue_depth", "Packets waiting in the face send queues.", func() []metrics.Sample {
+		var signaling, media int
+		for _, depth := range r.QueueDepths() {
+			signaling += depth.Signaling
+			media += depth.Media
+		}
+		return []metrics.Sample{
+			{LabelValues: []string{"signaling"}, Value: float64(signaling)},
+			{LabelValues: []string{"media"}, Value: float64(media)},
+		}
+	}, "lane")
+}
+
+func (r *Router) countForwarded(pkt api.Packet) {
+	name := packetTypeName(pkt.Type)
+	r.metrics.forwardedPackets.Inc(name)
+	r.metrics.forwardedBytes.Add(float64(packetSize(pkt)), name)
+}
+
+// instrumentHandler records the latency of the requests served by h under
+// the route label
+func instrumentHandler(h http.HandlerFunc, latency *metrics.Histogram, route string) http.HandlerFunc {
+	if latency == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		h(w, req)
+		latency.Observe(time.Since(start).Seconds(), route, req.Method)
+	}
+}
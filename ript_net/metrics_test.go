@@ -0,0 +1,54 @@
+package ript_net
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/WhatIETF/goRIPT/metrics"
+)
+
+func TestRouterMetrics(t *testing.T) {
+	reg := metrics.NewRegistry()
+	r := NewRouterWithConfig("test", NewRIPTService(), RouterConfig{Metrics: reg})
+
+	alice := newTestFace("alice")
+	r.AddFace(alice)
+	joinCall(t, alice, "")
+
+	var buf bytes.Buffer
+	if err := reg.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`ript_faces{transport="other"} 1`,
+		`ript_calls 1`,
+		`ript_handlers 1`,
+		`ript_forwarded_packets_total{type="register_handler"} 1`,
+		`ript_forwarded_packets_total{type="calls"} 1`,
+		`ript_send_queue_depth{lane="media"} 0`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatalf("missing [%s] in:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestInstrumentHandlerLabelsRoute(t *testing.T) {
+	reg := metrics.NewRegistry()
+	latency := reg.NewHistogram("latency", "Request latency.", metrics.DefaultBuckets, "route", "method")
+	h := instrumentHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+	}, latency, "calls")
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/calls", nil))
+
+	var buf bytes.Buffer
+	if err := reg.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `latency_count{route="calls",method="POST"} 1`+"\n") {
+		t.Fatalf("missing route latency in:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,152 @@
+package ript_net
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/WhatIETF/goRIPT/api"
+	"github.com/WhatIETF/goRIPT/mixer"
+	"github.com/gorilla/mux"
+)
+
+// MCU mode: participants of a mixing call send their media to the relay's
+// mixer and receive one mixed stream back. Peer relays keep getting the
+// individual streams, and media relayed by peers is forwarded unmixed.
+// Participants that negotiated G.711 are mixed in and get the mix in it.
+
+const (
+	// rate the clients encode opus at
+	OpusSampleRate = 16000
+	// 20ms frames, 100ms per packet, as sent by the clients
+	mixFrameSamples    = OpusSampleRate / 50
+	mixFramesPerPacket = 5
+	mixInterval        = 100 * time.Millisecond
+)
+
+// mix hands the payload to the call's mixer, returns false if the
+// call can't be mixed
+func (r *Router) mix(call *Call, sender api.FaceName, payload []byte) bool {
+	if r.config.OpusCodec == nil {
+		return false
+	}
+
+	r.mixLock.Lock()
+	m, ok := r.mixers[call.id]
+	if !ok {
+		var err error
+		m, err = r.newMixer(call.id)
+		if err != nil {
+			r.mixLock.Unlock()
+			log.Printf("[%s] can't mix call [%s]: %v", r.name, call.id, err)
+			return false
+		}
+		r.mixers[call.id] = m
+		go m.Run(mixInterval)
+	}
+	r.mixLock.Unlock()
+
+	if err := m.Push(string(sender), payload); err != nil {
+		log.Printf("[%s] mixer error on call [%s] from [%s]: %v", r.name, call.id, sender, err)
+	}
+	return true
+}
+
+func (r *Router) newMixer(callId string) (*mixer.Mixer, error) {
+	// only touched from the mixer's tick
+	seqNos := map[string]uint64{}
+
+	return mixer.New(mixer.Config{
+		Codec:           *r.config.OpusCodec,
+		FrameSamples:    mixFrameSamples,
+		FramesPerPacket: mixFramesPerPacket,
+		MemberCodec: func(name string) (mixer.Codec, bool) {
+			directive, ok := r.service.participantDirective(callId, api.FaceName(name))
+			if !ok {
+				return mixer.Codec{}, false
+			}
+			c, ok := r.mediaCodec(directive.Codec.Codec)
+			if !ok || directive.Codec.Codec == "opus" {
+				return mixer.Codec{}, false
+			}
+			return resamplingCodec(c, OpusSampleRate), true
+		},
+		Members: func() []string {
+			var members []string
+			for _, face := range r.service.callMembers(callId) {
+				members = append(members, string(face))
+			}
+			return members
+		},
+		Emit: func(receiver string, payload []byte) {
+			directive, ok := r.service.participantDirective(callId, api.FaceName(receiver))
+			if !ok {
+				return
+			}
+			payloadType, ok := api.CodecPayloadType(directive.Codec.Codec)
+			if !ok {
+				payloadType = api.PayloadTypeOpus
+			}
+			seqNos[receiver]++
+			r.send(api.FaceName(receiver), api.Packet{
+				Type:   api.StreamMediaPacket,
+				CallId: callId,
+				StreamMedia: api.StreamContentMedia{
+					Type:        api.StreamContentTypeMedia,
+					SeqNo:       seqNos[receiver],
+					Timestamp:   uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+					PayloadType: payloadType,
+					SourceId:    directive.SourceId,
+					SinkId:      directive.SinkId,
+					Media:       payload,
+				},
+			})
+		},
+	})
+}
+
+// callEnded releases the resources held for the call
+func (r *Router) callEnded(callId string) {
+	r.config.Recorder.EndCall(callId)
+
+	r.mixLock.Lock()
+	if m, ok := r.mixers[callId]; ok {
+		m.Stop()
+		delete(r.mixers, callId)
+	}
+	r.mixLock.Unlock()
+
+	r.transcodeLock.Lock()
+	delete(r.transcoders, callId)
+	r.transcodeLock.Unlock()
+}
+
+// AdminRoutes registers the call control endpoints
+//
+//	POST|DELETE /mixing/trunkGroups/{trunkGroupId}  mix new calls on the trunk group
+//	POST|DELETE /mixing/calls/{callId}              mix an ongoing call
+func (r *Router) AdminRoutes(router *mux.Router) {
+	router.HandleFunc("/mixing/trunkGroups/{trunkGroupId}", func(w http.ResponseWriter, req *http.Request) {
+		tgId := mux.Vars(req)["trunkGroupId"]
+		mixing := req.Method == http.MethodPost
+		if err := r.service.SetTrunkGroupMixing(tgId, mixing); err != nil {
+			log.Printf("[%s] admin: %v", r.name, err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("[%s] admin: trunk group [%s] mixing [%v]", r.name, tgId, mixing)
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodPost, http.MethodDelete)
+
+	router.HandleFunc("/mixing/calls/{callId}", func(w http.ResponseWriter, req *http.Request) {
+		callId := mux.Vars(req)["callId"]
+		mixing := req.Method == http.MethodPost
+		if err := r.service.SetCallMixing(callId, mixing); err != nil {
+			log.Printf("[%s] admin: %v", r.name, err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("[%s] admin: call [%s] mixing [%v]", r.name, callId, mixing)
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodPost, http.MethodDelete)
+}
@@ -0,0 +1,183 @@
+package ript_net
+
+import (
+	"testing"
+
+	"github.com/WhatIETF/goRIPT/api"
+	"github.com/WhatIETF/goRIPT/g711"
+	"github.com/WhatIETF/goRIPT/mixer"
+)
+
+// one sample per byte, enough to see what got mixed
+type byteCodec struct{}
+
+func (byteCodec) Decode(frame []byte, pcm []int16) (int, error) {
+	for i, b := range frame {
+		pcm[i] = int16(b)
+	}
+	return len(frame), nil
+}
+
+func (byteCodec) Encode(pcm []int16, frame []byte) (int, error) {
+	for i, v := range pcm {
+		frame[i] = byte(v)
+	}
+	return len(pcm), nil
+}
+
+func TestRouterMixesCall(t *testing.T) {
+	service := NewRIPTService()
+	r := NewRouterWithConfig("test", service, RouterConfig{
+		OpusCodec: &mixer.Codec{
+			NewDecoder: func() (mixer.Decoder, error) { return byteCodec{}, nil },
+			NewEncoder: func() (mixer.Encoder, error) { return byteCodec{}, nil },
+		},
+	})
+
+	alice := newTestFace("alice")
+	bob := newTestFace("bob")
+	r.AddFace(alice)
+	r.AddFace(bob)
+
+	call := joinCall(t, alice, "")
+	bobCall := joinCall(t, bob, call.CallUri)
+	callId := api.CallIdFromUri(call.CallUri)
+	if err := service.SetCallMixing(callId, true); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := make([]byte, mixFrameSamples)
+	for i := range frame {
+		frame[i] = 7
+	}
+	frames := make([][]byte, mixFramesPerPacket)
+	for i := range frames {
+		frames[i] = frame
+	}
+	directive, err := call.ClientDirective.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMedia(alice, callId, api.StreamContentMedia{
+		SeqNo:    42,
+		SourceId: directive.SourceId,
+		SinkId:   directive.SinkId,
+		Media:    api.PackFrames(frames),
+	})
+
+	// bob gets the mixer's stream rather than alice's packet
+	pkt := awaitPacket(t, bob, api.StreamMediaPacket)
+	bobDirective, err := bobCall.ServerDirective.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.CallId != callId || pkt.StreamMedia.SeqNo != 1 || pkt.StreamMedia.SinkId != bobDirective.SinkId {
+		t.Fatalf("unexpected mixed packet [%+v]", pkt.StreamMedia)
+	}
+	if string(pkt.StreamMedia.Media) != string(api.PackFrames(frames)) {
+		t.Fatalf("unexpected mix")
+	}
+	expectNoPacket(t, alice)
+}
+
+func TestRouterMixesCallForG711Receivers(t *testing.T) {
+	service := NewRIPTService()
+	r := NewRouterWithConfig("test", service, RouterConfig{
+		OpusCodec: &mixer.Codec{
+			NewDecoder: func() (mixer.Decoder, error) { return byteCodec{}, nil },
+			NewEncoder: func() (mixer.Encoder, error) { return byteCodec{}, nil },
+		},
+	})
+
+	alice := newTestFace("alice")
+	bob := newTestFace("bob")
+	r.AddFace(alice)
+	r.AddFace(bob)
+
+	call := joinCall(t, alice, "")
+	joinCallWith(t, bob, call.CallUri, "1 in: PCMU;\n2 out: PCMU;\n")
+	callId := api.CallIdFromUri(call.CallUri)
+	if err := service.SetCallMixing(callId, true); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := make([]byte, mixFrameSamples)
+	for i := range frame {
+		frame[i] = 100
+	}
+	frames := make([][]byte, mixFramesPerPacket)
+	for i := range frames {
+		frames[i] = frame
+	}
+	directive, err := call.ClientDirective.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMedia(alice, callId, api.StreamContentMedia{
+		PayloadType: api.PayloadTypeOpus,
+		SourceId:    directive.SourceId,
+		SinkId:      directive.SinkId,
+		Media:       api.PackFrames(frames),
+	})
+
+	// bob negotiated μ-law, so that's what the mix comes in
+	pkt := awaitPacket(t, bob, api.StreamMediaPacket)
+	if pkt.StreamMedia.PayloadType != api.PayloadTypePCMU {
+		t.Fatalf("unexpected payload type [%d]", pkt.StreamMedia.PayloadType)
+	}
+	mixed, err := api.UnpackFrames(pkt.StreamMedia.Media)
+	if err != nil || len(mixed) != mixFramesPerPacket {
+		t.Fatalf("bad payload [%v]", err)
+	}
+	pcm := make([]int16, g711.SampleRate/50)
+	for _, f := range mixed {
+		if n, _ := (g711.Codec{Law: g711.Ulaw}).Decode(f, pcm); n != g711.SampleRate/50 {
+			t.Fatalf("unexpected frame size [%d]", n)
+		}
+		if pcm[0] < 90 || pcm[0] > 110 {
+			t.Fatalf("unexpected mix [%d]", pcm[0])
+		}
+	}
+}
+
+func TestRouterForwardsProtectedMediaUnmixed(t *testing.T) {
+	service := NewRIPTService()
+	r := NewRouterWithConfig("test", service, RouterConfig{
+		OpusCodec: &mixer.Codec{
+			NewDecoder: func() (mixer.Decoder, error) { return byteCodec{}, nil },
+			NewEncoder: func() (mixer.Encoder, error) { return byteCodec{}, nil },
+		},
+	})
+
+	alice := newTestFace("alice")
+	bob := newTestFace("bob")
+	r.AddFace(alice)
+	r.AddFace(bob)
+
+	call := joinCall(t, alice, "")
+	joinCall(t, bob, call.CallUri)
+	callId := api.CallIdFromUri(call.CallUri)
+	if err := service.SetCallMixing(callId, true); err != nil {
+		t.Fatal(err)
+	}
+
+	directive, err := call.ClientDirective.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := api.StreamContentMedia{
+		SeqNo:    42,
+		SourceId: directive.SourceId,
+		SinkId:   directive.SinkId,
+		Media:    []byte("ciphertext"),
+		Flags:    api.MediaFlagProtected,
+	}
+	sendMedia(alice, callId, m)
+
+	// the relay can't decode it, bob gets alice's packet as sent
+	pkt := awaitPacket(t, bob, api.StreamMediaPacket)
+	if pkt.StreamMedia.SeqNo != 42 || string(pkt.StreamMedia.Media) != "ciphertext" || !pkt.StreamMedia.Protected() {
+		t.Fatalf("unexpected packet [%+v]", pkt.StreamMedia)
+	}
+	expectNoPacket(t, alice)
+}
@@ -0,0 +1,284 @@
+package ript_net
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/WhatIETF/goRIPT/api"
+	"github.com/WhatIETF/goRIPT/audit"
+	"github.com/gorilla/websocket"
+)
+
+// Relay cascading. Relays are linked by peer faces and announce the calls
+// they have local participants in. A relay receiving an announcement joins
+// the peer into its own call of the same id, created if need be, which its
+// participants can then join by the call's uri. Media flows between
+// participants on different relays, media received from a peer is only
+// forwarded to local participants (full mesh).
+//
+// Peers are trusted with every call they announce, so links are only
+// accepted over TLS (wss) from relays presenting the shared peer secret.
+
+const (
+	// ws path on which relays accept peer links
+	PeerPath = "/peer"
+	// header carrying the shared secret when dialing a peer
+	PeerSecretHeader   = "Ript-Peer-Secret"
+	peerRedialInterval = 5 * time.Second
+)
+
+// Faces linking to another relay
+type PeerFace interface {
+	Face
+	// url the link was dialed to, empty for inbound links
+	PeerUrl() string
+}
+
+type peerCallKey struct {
+	peer   api.FaceName
+	callId string
+}
+
+/////
+// Service
+/////
+
+// peerCall maps a peer's call id onto the local call. Needs callLock held.
+func (s *RIPTService) peerCall(peer api.FaceName, peerCallId string) (*Call, bool) {
+	call, ok := s.peerCalls[peerCallKey{peer, peerCallId}]
+	return call, ok
+}
+
+// handlePeerCall processes a peer's call announcement
+func (s *RIPTService) handlePeerCall(peer api.FaceName, msg api.PeerCallMessage) error {
+	s.callLock.Lock()
+	defer s.callLock.Unlock()
+
+	if !msg.Active {
+		call, ok := s.peerCall(peer, msg.CallId)
+		if !ok {
+			return fmt.Errorf("ript_net: unknown peer call [%s] from [%s]", msg.CallId, peer)
+		}
+		s.removePeerFromCall(call, peer)
+		return nil
+	}
+
+	if _, ok := s.trunkGroups[msg.TgId]; !ok {
+		return fmt.Errorf("ript_net: unknown trunkGroupId [%s] from peer [%s]", msg.TgId, peer)
+	}
+
+	call, ok := s.calls[msg.CallId]
+	if !ok {
+		var err error
+		if call, err = s.createCall(peer, msg.TgId, msg.Destination, msg.CallId); err != nil {
+			return err
+		}
+	} else if call.tgId != msg.TgId {
+		return fmt.Errorf("ript_net: peer [%s] call [%s] on another trunk group", peer, msg.CallId)
+	}
+
+	call.peers[peer] = msg.CallId
+	s.peerCalls[peerCallKey{peer, msg.CallId}] = call
+	log.Printf("service: peer relay [%s] (%s) joined call [%s]", msg.Relay, peer, call.id)
+	s.audit.Log(audit.Record{
+		Event:  audit.EventCallJoined,
+		Face:   string(peer),
+		Uri:    call.uri,
+		Detail: "peer relay " + msg.Relay,
+	})
+	return nil
+}
+
+// Needs callLock held.
+func (s *RIPTService) removePeerFromCall(call *Call, peer api.FaceName) {
+	delete(s.peerCalls, peerCallKey{peer, call.peers[peer]})
+	delete(call.peers, peer)
+	log.Printf("service: peer [%s] left call [%s]", peer, call.id)
+	s.audit.Log(audit.Record{
+		Event: audit.EventCallLeft,
+		Face:  string(peer),
+		Uri:   call.uri,
+	})
+	s.endCallIfEmpty(call)
+}
+
+// notifyLocalCall queues the announcement for the router, which sends it
+// once the lock is released. Needs callLock held.
+func (s *RIPTService) notifyLocalCall(call *Call, active bool) {
+	if s.announceReady == nil {
+		return
+	}
+	s.announcements = append(s.announcements, api.PeerCallMessage{
+		TgId:        call.tgId,
+		Destination: call.destination,
+		CallId:      call.id,
+		Active:      active,
+	})
+	select {
+	case s.announceReady <- struct{}{}:
+	default:
+		// already signaled, the router picks up all queued at once
+	}
+}
+
+// takeAnnouncements hands over the queued announcements, in order
+func (s *RIPTService) takeAnnouncements() []api.PeerCallMessage {
+	s.callLock.Lock()
+	defer s.callLock.Unlock()
+
+	msgs := s.announcements
+	s.announcements = nil
+	return msgs
+}
+
+// localCalls lists the calls with local participants, for announcing
+// them to newly linked peers
+func (s *RIPTService) localCalls() []api.PeerCallMessage {
+	s.callLock.RLock()
+	defer s.callLock.RUnlock()
+
+	var calls []api.PeerCallMessage
+	for _, call := range s.calls {
+		if len(call.participants) == 0 {
+			continue
+		}
+		calls = append(calls, api.PeerCallMessage{
+			TgId:        call.tgId,
+			Destination: call.destination,
+			CallId:      call.id,
+			Active:      true,
+		})
+	}
+	return calls
+}
+
+/////
+// Router
+/////
+
+// AddPeer links this relay to the relay at url (wss://host:port/peer).
+// The link is redialed whenever it goes down.
+func (r *Router) AddPeer(url string) error {
+	if err := checkPeerUrl(url); err != nil {
+		return err
+	}
+	go r.dialPeer(url, 0)
+	return nil
+}
+
+func (r *Router) dialPeer(url string, delay time.Duration) {
+	time.Sleep(delay)
+	for {
+		face, err := NewWebSocketPeerClientFace(url, r.config.PeerSecret, r.config.PeerTLS)
+		if err == nil {
+			r.AddFace(face)
+			return
+		}
+		log.Printf("[%s] peer [%s] dial error [%v], retrying", r.name, url, err)
+		time.Sleep(peerRedialInterval)
+	}
+}
+
+func (r *Router) isPeer(name api.FaceName) bool {
+	r.faceLock.RLock()
+	defer r.faceLock.RUnlock()
+	_, ok := r.peers[name]
+	return ok
+}
+
+// announce local call changes to all peers, in order
+func (r *Router) announceToPeers() {
+	for range r.service.announceReady {
+		for _, msg := range r.service.takeAnnouncements() {
+			msg.Relay = r.name
+			r.faceLock.RLock()
+			peers := make([]api.FaceName, 0, len(r.peers))
+			for name := range r.peers {
+				peers = append(peers, name)
+			}
+			r.faceLock.RUnlock()
+
+			for _, peer := range peers {
+				r.sendPeerCall(peer, msg)
+			}
+		}
+	}
+}
+
+func (r *Router) sendPeerCall(peer api.FaceName, msg api.PeerCallMessage) {
+	log.Printf("[%s] announcing call [%s] active [%v] to peer [%s]", r.name, msg.CallId, msg.Active, peer)
+	r.send(peer, api.Packet{
+		Type:     api.PeerCallPacket,
+		PeerCall: msg,
+	})
+}
+
+/////
+// WebSocket peer link
+/////
+
+type WebSocketPeerFace struct {
+	*WebSocketFace
+	url string
+}
+
+func NewWebSocketPeerFace(conn *websocket.Conn, url string) *WebSocketPeerFace {
+	return &WebSocketPeerFace{
+		WebSocketFace: NewWebSocketFace(conn),
+		url:           url,
+	}
+}
+
+var errPeerNotTLS = errors.New("ript_net: peer links need wss, the peer secret would travel in the clear")
+
+// checkPeerUrl refuses peer urls the secret can't be sent to safely
+func checkPeerUrl(url string) error {
+	if !strings.HasPrefix(url, "wss://") {
+		return errPeerNotTLS
+	}
+	return nil
+}
+
+// NewWebSocketPeerClientFace dials the peer relay at the wss url, tlsConfig
+// may be nil to trust the system roots
+func NewWebSocketPeerClientFace(url, secret string, tlsConfig *tls.Config) (*WebSocketPeerFace, error) {
+	if err := checkPeerUrl(url); err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	header.Set(PeerSecretHeader, secret)
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	conn, _, err := dialer.Dial(url, header)
+	if err != nil {
+		return nil, err
+	}
+	return NewWebSocketPeerFace(conn, url), nil
+}
+
+func (p *WebSocketPeerFace) PeerUrl() string {
+	return p.url
+}
+
+func (p *WebSocketPeerFace) Transport() string {
+	return "peer"
+}
+
+// authorizePeer checks the peer secret of an inbound link, no secret
+// configured refuses all peers
+func authorizePeer(r *http.Request, secret string) bool {
+	if secret == "" {
+		return false
+	}
+	// hashed so the comparison doesn't leak the length either
+	got := sha256.Sum256([]byte(r.Header.Get(PeerSecretHeader)))
+	want := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(got[:], want[:]) == 1
+}
@@ -0,0 +1,179 @@
+package ript_net
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/WhatIETF/goRIPT/api"
+	"github.com/WhatIETF/goRIPT/audit"
+)
+
+// In-memory link between two relays, packets sent on one end are
+// received on the other one.
+type linkFace struct {
+	*testFace
+	remote *linkFace
+}
+
+func newLink(a, b string) (*linkFace, *linkFace) {
+	fa := &linkFace{testFace: newTestFace(a)}
+	fb := &linkFace{testFace: newTestFace(b)}
+	fa.remote, fb.remote = fb, fa
+	return fa, fb
+}
+
+func (f *linkFace) PeerUrl() string { return "" }
+
+func (f *linkFace) Send(pkt api.Packet) error {
+	f.testFace.Send(pkt)
+	f.remote.recvChan <- api.PacketEvent{
+		Sender: f.remote.name,
+		CallId: pkt.CallId,
+		Packet: pkt,
+	}
+	return nil
+}
+
+func awaitPeers(t *testing.T, s *RIPTService, callId string, peers int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		s.callLock.RLock()
+		call, ok := s.calls[callId]
+		n := 0
+		if ok {
+			n = len(call.peers)
+		}
+		s.callLock.RUnlock()
+		if n == peers {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("call [%s] did not reach [%d] peers", callId, peers)
+}
+
+func TestRouterCascadesCallAcrossPeers(t *testing.T) {
+	serviceA, serviceB := NewRIPTService(), NewRIPTService()
+	relayA := NewRouter("relay-a", serviceA)
+	relayB := NewRouter("relay-b", serviceB)
+
+	toB, toA := newLink("to-b", "to-a")
+	relayA.AddFace(toB)
+	relayB.AddFace(toA)
+
+	alice := newTestFace("alice")
+	bob := newTestFace("bob")
+	relayA.AddFace(alice)
+	relayB.AddFace(bob)
+
+	// relay b learns of the call from relay a, bob joins it by its uri
+	aliceCall := joinCall(t, alice, "")
+	callA := api.CallIdFromUri(aliceCall.CallUri)
+	awaitPeers(t, serviceB, callA, 1)
+	bobCall := joinCall(t, bob, aliceCall.CallUri)
+	callB := api.CallIdFromUri(bobCall.CallUri)
+	if callB != callA {
+		t.Fatalf("expected the relays to share the call id [%s] != [%s]", callB, callA)
+	}
+	awaitPeers(t, serviceA, callA, 1)
+
+	directive, err := aliceCall.ClientDirective.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMedia(alice, callA, api.StreamContentMedia{
+		SeqNo:    1,
+		SourceId: directive.SourceId,
+		SinkId:   directive.SinkId,
+	})
+	if pkt := awaitPacket(t, bob, api.StreamMediaPacket); pkt.CallId != callB || pkt.StreamMedia.SeqNo != 1 {
+		t.Fatalf("unexpected media [%+v]", pkt)
+	}
+
+	// peers only relay sources negotiated on the trunk group
+	sendMedia(toA.testFace, callA, api.StreamContentMedia{SeqNo: 2, SourceId: 200})
+	expectNoPacket(t, bob)
+	if relayB.Drops()[DropNotNegotiated] != 1 {
+		t.Fatalf("expected the peer's media to be dropped, drops %v", relayB.Drops())
+	}
+
+	// relay b must not send alice's media back over the link
+	time.Sleep(100 * time.Millisecond)
+	for len(toA.sent) > 0 {
+		if pkt := <-toA.sent; pkt.Type == api.StreamMediaPacket {
+			t.Fatalf("media echoed back to the peer")
+		}
+	}
+
+	// once alice hangs up, relay b drops the peer from its call
+	alice.recvChan <- api.PacketEvent{
+		Sender: alice.name,
+		CallId: callA,
+		Packet: api.Packet{Type: api.CallHangupPacket},
+	}
+	awaitPeers(t, serviceB, callB, 0)
+}
+
+func TestAuthorizePeer(t *testing.T) {
+	req := httptest.NewRequest("GET", PeerPath, nil)
+	if authorizePeer(req, "") {
+		t.Fatalf("peer authorized without a secret configured")
+	}
+	if authorizePeer(req, "secret") {
+		t.Fatalf("peer authorized without presenting the secret")
+	}
+	req.Header.Set(PeerSecretHeader, "guess")
+	if authorizePeer(req, "secret") {
+		t.Fatalf("peer authorized with the wrong secret")
+	}
+	req.Header.Set(PeerSecretHeader, "secret")
+	if !authorizePeer(req, "secret") {
+		t.Fatalf("peer refused with the right secret")
+	}
+}
+
+func TestPeerLinksNeedTLS(t *testing.T) {
+	if _, err := NewWebSocketPeerClientFace("ws://localhost:8080/peer", "secret", nil); err != errPeerNotTLS {
+		t.Fatalf("dialed a peer without TLS [%v]", err)
+	}
+	r := NewRouter("test", NewRIPTService())
+	if err := r.AddPeer("ws://localhost:8080/peer"); err != errPeerNotTLS {
+		t.Fatalf("added a peer without TLS [%v]", err)
+	}
+
+	dir, err := ioutil.TempDir("", "ript-peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	auditPath := path.Join(dir, "audit.jsonl")
+	auditLog, err := audit.NewLogger(audit.Config{Path: auditPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wss := &WebSocketFaceServer{config: WebSocketServerConfig{PeerSecret: "secret", Audit: auditLog}}
+	req := httptest.NewRequest("GET", PeerPath, nil)
+	req.Header.Set(PeerSecretHeader, "secret")
+	rec := httptest.NewRecorder()
+	wss.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("peer link accepted without TLS [%d]", rec.Code)
+	}
+
+	auditLog.Close()
+	data, err := ioutil.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"event":"auth_failure"`) || !strings.Contains(string(data), "no tls") {
+		t.Fatalf("refused peer link not audited [%s]", data)
+	}
+}
@@ -0,0 +1,51 @@
+package ript_net
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+// Requests of request/response transports waiting for the router's reply,
+// matched by the correlation id the router echoes back. Concurrent
+// requests on a face get their own reply, a late reply goes nowhere.
+
+type pendingRequests struct {
+	lock    sync.Mutex
+	next    uint64
+	replies map[string]chan api.Packet
+}
+
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{replies: map[string]chan api.Packet{}}
+}
+
+// add returns the new request's id and where its reply will arrive
+func (p *pendingRequests) add() (string, chan api.Packet) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.next++
+	id := strconv.FormatUint(p.next, 10)
+	reply := make(chan api.Packet, 1)
+	p.replies[id] = reply
+	return id, reply
+}
+
+func (p *pendingRequests) remove(id string) {
+	p.lock.Lock()
+	delete(p.replies, id)
+	p.lock.Unlock()
+}
+
+// resolve hands the reply to its request, false if nobody waits for it
+func (p *pendingRequests) resolve(pkt api.Packet) bool {
+	p.lock.Lock()
+	reply, ok := p.replies[pkt.RequestId]
+	delete(p.replies, pkt.RequestId)
+	p.lock.Unlock()
+	if ok {
+		reply <- pkt
+	}
+	return ok
+}
@@ -0,0 +1,48 @@
+package ript_net
+
+import (
+	"testing"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+func TestPendingRequests(t *testing.T) {
+	pending := newPendingRequests()
+	first, firstReply := pending.add()
+	second, secondReply := pending.add()
+	if first == second {
+		t.Fatalf("requests share id [%s]", first)
+	}
+
+	// replies reach their own request, whatever the order
+	if !pending.resolve(api.Packet{Type: api.CallsPacket, RequestId: second}) {
+		t.Fatalf("second request not found")
+	}
+	if !pending.resolve(api.Packet{Type: api.CallsPacket, RequestId: first}) {
+		t.Fatalf("first request not found")
+	}
+	if pkt := <-firstReply; pkt.RequestId != first {
+		t.Fatalf("first request got reply to [%s]", pkt.RequestId)
+	}
+	if pkt := <-secondReply; pkt.RequestId != second {
+		t.Fatalf("second request got reply to [%s]", pkt.RequestId)
+	}
+
+	// late replies are dropped
+	third, _ := pending.add()
+	pending.remove(third)
+	if pending.resolve(api.Packet{Type: api.CallsPacket, RequestId: third}) {
+		t.Fatalf("resolved a request that timed out")
+	}
+}
+
+func TestRouterEchoesRequestId(t *testing.T) {
+	r := NewRouter("test", NewRIPTService())
+	alice := newTestFace("alice")
+	r.AddFace(alice)
+
+	alice.receive(api.Packet{Type: api.TrunkGroupDiscoveryPacket, RequestId: "42"})
+	if pkt := awaitPacket(t, alice, api.TrunkGroupDiscoveryPacket); pkt.RequestId != "42" {
+		t.Fatalf("unexpected request id [%s]", pkt.RequestId)
+	}
+}
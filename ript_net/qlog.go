@@ -0,0 +1,174 @@
+package ript_net
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// qlog traces of QUIC connections, for every connection or only those of
+// the clients picked through the admin API. quic-go asks for a trace
+// writer by the connection id the client chose, so the client's address
+// is learned from its Initial packet. Files are named
+// <perspective>_<connection id>.qlog and deleted after the retention.
+
+const (
+	// connections whose trace decision is still pending
+	maxPendingQlogConns = 10000
+	qlogCleanupInterval = time.Minute
+)
+
+type QlogConfig struct {
+	Dir string
+	// trace every connection, otherwise only the selected clients
+	All bool
+	// traces older than this are deleted, 0 keeps them
+	Retention time.Duration
+}
+
+type Qlogger struct {
+	config QlogConfig
+	lock   sync.Mutex
+	all    bool
+	// client hosts to trace
+	clients map[string]bool
+	// client host by the connection id of its Initial packets
+	conns map[string]string
+}
+
+func NewQlogger(config QlogConfig) (*Qlogger, error) {
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+	q := &Qlogger{
+		config:  config,
+		all:     config.All,
+		clients: map[string]bool{},
+		conns:   map[string]string{},
+	}
+	if config.Retention > 0 {
+		go q.cleanup()
+	}
+	return q, nil
+}
+
+// SetAll switches tracing of every connection
+func (q *Qlogger) SetAll(all bool) {
+	q.lock.Lock()
+	q.all = all
+	q.lock.Unlock()
+}
+
+// TraceClient switches tracing of the connections from host
+func (q *Qlogger) TraceClient(host string, trace bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if trace {
+		q.clients[host] = true
+	} else {
+		delete(q.clients, host)
+	}
+}
+
+// LogWriter returns the quic.Config GetLogWriter hook
+func (q *Qlogger) LogWriter(perspective string) func(connID []byte) io.WriteCloser {
+	return func(connID []byte) io.WriteCloser {
+		id := hex.EncodeToString(connID)
+		q.lock.Lock()
+		host, known := q.conns[id]
+		delete(q.conns, id)
+		trace := q.all || (known && q.clients[host])
+		q.lock.Unlock()
+		if !trace {
+			return nil
+		}
+
+		path := filepath.Join(q.config.Dir, fmt.Sprintf("%s_%s.qlog", perspective, id))
+		f, err := os.Create(path)
+		if err != nil {
+			log.Printf("qlog: can't create [%s]: %v", path, err)
+			return nil
+		}
+		log.Printf("qlog: tracing connection [%s] from [%s] to [%s]", id, host, path)
+		return f
+	}
+}
+
+// observe learns the client of the connection from an incoming Initial
+// packet
+func (q *Qlogger) observe(packet []byte, addr net.Addr) {
+	id, ok := initialConnID(packet)
+	if !ok {
+		return
+	}
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.conns[id]; ok {
+		return
+	}
+	if len(q.conns) >= maxPendingQlogConns {
+		q.conns = map[string]string{}
+	}
+	q.conns[id] = host
+}
+
+func (q *Qlogger) cleanup() {
+	ticker := time.NewTicker(qlogCleanupInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		q.removeExpired(now)
+	}
+}
+
+func (q *Qlogger) removeExpired(now time.Time) {
+	files, err := ioutil.ReadDir(q.config.Dir)
+	if err != nil {
+		log.Printf("qlog: %v", err)
+		return
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".qlog") || now.Sub(file.ModTime()) <= q.config.Retention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(q.config.Dir, file.Name())); err != nil {
+			log.Printf("qlog: %v", err)
+		}
+	}
+}
+
+// AdminRoutes registers the trace control endpoints
+//
+//	POST|DELETE /qlog                 trace every connection
+//	POST|DELETE /qlog/clients/{host}  trace the connections of a client
+func (q *Qlogger) AdminRoutes(router *mux.Router) {
+	router.HandleFunc("/qlog", func(w http.ResponseWriter, req *http.Request) {
+		all := req.Method == http.MethodPost
+		q.SetAll(all)
+		log.Printf("admin: qlog of all connections [%v]", all)
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodPost, http.MethodDelete)
+
+	router.HandleFunc("/qlog/clients/{host}", func(w http.ResponseWriter, req *http.Request) {
+		host := mux.Vars(req)["host"]
+		trace := req.Method == http.MethodPost
+		q.TraceClient(host, trace)
+		log.Printf("admin: qlog of client [%s] [%v]", host, trace)
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodPost, http.MethodDelete)
+}
@@ -0,0 +1,87 @@
+package ript_net
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// long header Initial packet with the given destination connection id
+func initialPacket(connID []byte) []byte {
+	pkt := []byte{0xc0, 0xff, 0, 0, 27, byte(len(connID))}
+	pkt = append(pkt, connID...)
+	return append(pkt, 0, 0, 0, 0)
+}
+
+func TestQlogPerClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := NewQlogger(QlogConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logWriter := q.LogWriter("server")
+	alice := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000}
+	bob := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 4000}
+
+	q.TraceClient("10.0.0.1", true)
+	q.observe(initialPacket([]byte{1, 2, 3, 4}), alice)
+	q.observe(initialPacket([]byte{5, 6, 7, 8}), bob)
+	// short header packets carry no usable connection id
+	q.observe([]byte{0x40, 9, 9, 9, 9, 9, 9}, bob)
+
+	w := logWriter([]byte{1, 2, 3, 4})
+	if w == nil {
+		t.Fatalf("traced client not logged")
+	}
+	w.Close()
+	if _, err := os.Stat(filepath.Join(dir, "server_01020304.qlog")); err != nil {
+		t.Fatal(err)
+	}
+	if w := logWriter([]byte{5, 6, 7, 8}); w != nil {
+		t.Fatalf("untraced client logged")
+	}
+
+	q.SetAll(true)
+	w = logWriter([]byte{9, 9, 9, 9})
+	if w == nil {
+		t.Fatalf("connection not logged with all traced")
+	}
+	w.Close()
+}
+
+func TestQlogRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := &Qlogger{config: QlogConfig{Dir: dir, Retention: time.Hour}}
+	for _, name := range []string{"old.qlog", "new.qlog", "other.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(filepath.Join(dir, "old.qlog"), old, old)
+	os.Chtimes(filepath.Join(dir, "other.txt"), old, old)
+
+	q.removeExpired(time.Now())
+
+	files, _ := ioutil.ReadDir(dir)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if len(names) != 2 || names[0] != "new.qlog" || names[1] != "other.txt" {
+		t.Fatalf("unexpected files %v", names)
+	}
+}
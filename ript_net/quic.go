@@ -2,18 +2,23 @@ package ript_net
 
 import (
 	"bytes"
+	"context"
 	"strconv"
+	"sync"
+	"sync/atomic"
 
 	"github.com/bifurcation/mint/syntax"
 
-	//"crypto/tls"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"fmt"
 
 	"github.com/WhatIETF/goRIPT/api"
+	"github.com/WhatIETF/goRIPT/audit"
+	"github.com/WhatIETF/goRIPT/metrics"
 	//"github.com/caddyserver/certmagic"
 	"io"
+	"net"
 	"net/http"
 	"time"
 
@@ -25,27 +30,44 @@ import (
 
 // quic/h3 based transport
 
+const (
+	// faces unused for this long are closed, as are idle QUIC connections
+	sessionIdleTimeout = 30 * time.Second
+	// how long requests wait for the router's reply by default
+	defaultRequestTimeout = 2 * time.Second
+	// how long media pulls wait for media by default, and at most
+	defaultPullWait = 2 * time.Second
+	maxPullWait     = 10 * time.Second
+)
+
 type QuicFace struct {
+	// guards haveRecv and recvChan, the router sets them while requests
+	// may already come in
+	recvLock sync.Mutex
 	haveRecv bool
 	// inbound face to router for processing
 	recvChan chan api.PacketEvent
-	// channel for trunk discovery
-	tgDiscChan chan api.Packet
-	// channel for /handlers
-	handlerRegChan chan api.Packet
-	// channel for /calls
-	callsChan chan api.Packet
+	// requests waiting for the router's reply
+	pending *pendingRequests
+	// how long requests wait for the reply
+	requestTimeout time.Duration
 	// channel for media push
 	mediaFwdChan chan api.Packet
-	// mediaReverse
-	mediaRevChan chan api.Packet
-	closeChan    chan error
-	closed       bool
-	name         string
+	// media and call events waiting to be pulled
+	media     *mediaBuffer
+	events    *mediaBuffer
+	closeChan chan error
+	// closed on Close, unblocks senders and ends the media streams
+	done      chan struct{}
+	closeOnce sync.Once
+	name      string
+	// h3, or h2 and http1 over the TCP fallback
+	transport string
+	activity  sessionActivity
 }
 
 func (f *QuicFace) handleClose(code int, text string) error {
-	// todo implement
+	f.Close(fmt.Errorf("h3 session closed [%d] [%s]", code, text))
 	return nil
 }
 
@@ -59,35 +81,114 @@ func (f *QuicFace) Name() api.FaceName {
 
 func (f *QuicFace) Send(pkt api.Packet) error {
 	switch pkt.Type {
-	case api.TrunkGroupDiscoveryPacket:
-		log.Printf("send: passing on the content to trunk discovery chan, face [%s]", f.name)
-		f.tgDiscChan <- pkt
-	case api.RegisterHandlerPacket:
-		log.Printf("send: passing on the content to handler reg chan, face [%s]", f.name)
-		f.handlerRegChan <- pkt
-	case api.CallsPacket:
-		log.Printf("send: passing on the content to calls chan, face [%s]", f.name)
-		f.callsChan <- pkt
+	case api.TrunkGroupDiscoveryPacket, api.RegisterHandlerPacket, api.CallsPacket, api.CallHangupPacket:
+		if !f.pending.resolve(pkt) {
+			log.Printf("send: dropping reply [%v] to request [%s] nobody waits for, face [%s]",
+				pkt.Type, pkt.RequestId, f.name)
+		}
 	case api.StreamMediaAckPacket:
 		log.Printf("send: passing on the media ack packet to  mediaFwdchan, face [%s]", f.name)
-		f.mediaFwdChan <- pkt
+		return f.deliver(f.mediaFwdChan, pkt)
 	case api.StreamMediaPacket:
-		log.Printf("send: passing on the media  packet to  mediaRevchan, face [%s]", f.name)
-		f.mediaRevChan <- pkt
+		f.media.push(pkt)
+	case api.CallEventPacket:
+		f.events.push(pkt)
 	default:
 		log.Errorf("send: packet type [%v] unknown", pkt.Type)
 	}
 	return nil
 }
 
+// deliverEvent hands a client's packet to the router, fails once the face
+// is closed, the request is gone or the router doesn't take it within the
+// request timeout
+func (f *QuicFace) deliverEvent(ctx context.Context, evt api.PacketEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, f.requestTimeout)
+	defer cancel()
+	// nil until the router took the face, blocks until then
+	f.recvLock.Lock()
+	recvChan := f.recvChan
+	f.recvLock.Unlock()
+
+	select {
+	case recvChan <- evt:
+		return nil
+	case <-f.done:
+		return errFaceClosed
+	case <-ctx.Done():
+		return contextError(ctx)
+	}
+}
+
+// contextError maps an expired request timeout to errRequestTimeout
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return errRequestTimeout
+	}
+	return ctx.Err()
+}
+
+// deliver hands the packet to the request waiting for it, fails once the
+// face is closed rather than blocking the sender for good
+func (f *QuicFace) deliver(ch chan api.Packet, pkt api.Packet) error {
+	select {
+	case ch <- pkt:
+		return nil
+	case <-f.done:
+		return fmt.Errorf("face [%s] is closed", f.name)
+	}
+}
+
+// request passes the packet to the router and awaits the reply to it, the
+// request timeout covering both
+func (f *QuicFace) request(ctx context.Context, evt api.PacketEvent) (api.Packet, error) {
+	id, reply := f.pending.add()
+	defer f.pending.remove(id)
+	evt.Packet.RequestId = id
+
+	ctx, cancel := context.WithTimeout(ctx, f.requestTimeout)
+	defer cancel()
+	if err := f.deliverEvent(ctx, evt); err != nil {
+		return api.Packet{}, err
+	}
+
+	select {
+	case pkt := <-reply:
+		return pkt, nil
+	case <-ctx.Done():
+		err := contextError(ctx)
+		if err == errRequestTimeout {
+			log.Printf("[%s] no reply to [%v] within %v", f.name, evt.Packet.Type, f.requestTimeout)
+		}
+		return api.Packet{}, err
+	case <-f.done:
+		return api.Packet{}, errFaceClosed
+	}
+}
+
 func (f *QuicFace) SetReceiveChan(recv chan api.PacketEvent) {
+	f.recvLock.Lock()
+	defer f.recvLock.Unlock()
 	f.haveRecv = true
 	f.recvChan = recv
 }
 
+// Close ends the face's media streams and has the router remove it
 func (f *QuicFace) Close(err error) {
-	// todo: implement this
-	fmt.Printf("Close called on QuicFace with err %v\n", err)
+	f.closeOnce.Do(func() {
+		log.Printf("[%s] Closing [%v]", f.name, err)
+		close(f.done)
+		f.closeChan <- err
+	})
+}
+
+func (f *QuicFace) isClosed() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
 }
 
 func (f *QuicFace) OnClose() chan error {
@@ -95,21 +196,27 @@ func (f *QuicFace) OnClose() chan error {
 }
 
 func (f *QuicFace) CanStream() bool {
-	return false
+	return true
+}
+
+func (f *QuicFace) Transport() string {
+	return f.transport
 }
 
 func NewQuicFace(name string) *QuicFace {
 	q := &QuicFace{
 		haveRecv:       false,
 		closeChan:      make(chan error, 1),
-		tgDiscChan:     make(chan api.Packet, 1),
-		handlerRegChan: make(chan api.Packet, 1),
-		callsChan:      make(chan api.Packet, 1),
+		done:           make(chan struct{}),
+		pending:        newPendingRequests(),
+		requestTimeout: defaultRequestTimeout,
 		mediaFwdChan:   make(chan api.Packet, 20),
-		mediaRevChan:   make(chan api.Packet, 20),
-		closed:         false,
+		media:          newMediaBuffer(),
+		events:         newMediaBuffer(),
 		name:           name,
+		transport:      "h3",
 	}
+	q.activity.touch()
 	fmt.Printf("NewQuicFace %s created\n", name)
 	return q
 }
@@ -120,15 +227,34 @@ func NewQuicFace(name string) *QuicFace {
 
 type QuicFaceServer struct {
 	*http3.Server
+	config   QuicServerConfig
 	feedChan chan Face
-	// this is needed until we figure out a way to get triggered
-	// by the connection creation (see todo)
-	faceMap map[string]*QuicFace
+	// faces by the session token issued on join
+	sessions *faceSessions
+	joins    uint64
+	// closes faces with their QUIC connection
+	watch *connWatch
+	// request latencies by route, nil without metrics
+	latency *metrics.Histogram
+}
+
+type QuicServerConfig struct {
+	// how long requests wait for the router's reply, 0 for the default
+	RequestTimeout time.Duration
+	// optional, request latencies are recorded when set
+	Metrics *metrics.Registry
+	// optional, connections are traced when set
+	Qlog *Qlogger
+	// serves the same routes over TLS on TCP when set, for clients that
+	// can't reach the h3 port
+	TCPPort int
+	// optional, requests without a valid session are recorded when set
+	Audit *audit.Logger
 }
 
 // Client Handler Registration
 func HandlerRegistration(face *QuicFace, writer http.ResponseWriter, request *http.Request) {
-	log.Printf("Handler registration from [%v]", request)
+	log.Printf("Handler registration from [%s]", face.Name())
 	// extract trunkGroupId
 	params := mux.Vars(request)
 	tgId := params["trunkGroupId"]
@@ -139,63 +265,55 @@ func HandlerRegistration(face *QuicFace, writer http.ResponseWriter, request *ht
 	}
 
 	// extract handler info from the body
-	pkt, err := httpRequestBodyToRiptPacket(request)
-	if err != nil {
-		log.Error(err)
-		writer.WriteHeader(400)
+	var handlerReq api.HandlerRequest
+	if status, err := readJSON(request, &handlerReq); err != nil {
+		log.Errorf("handlerRegistration: %v", err)
+		writer.WriteHeader(status)
 		return
 	}
 
-	log.Printf("HandlerRegistration: trunk [%s], Request [%v]", tgId, pkt)
+	log.Printf("HandlerRegistration: trunk [%s], Request [%v]", tgId, handlerReq)
 
-	// pass the packet to router
-	face.recvChan <- api.PacketEvent{
+	// pass the packet to router and await the response
+	resPkt, err := face.request(request.Context(), api.PacketEvent{
 		Sender: face.Name(),
 		TgId:   tgId,
-		Packet: pkt,
+		Packet: api.Packet{
+			Type:            api.RegisterHandlerPacket,
+			RegisterHandler: api.RegisterHandlerMessage{HandlerRequest: handlerReq},
+		},
+	})
+	if err != nil {
+		log.Errorf("handlerRegistration: %v", err)
+		writer.WriteHeader(requestErrorStatus(err))
+		return
 	}
+	log.Printf("handlerRegistration [%s] got content [%v]", face.Name(), resPkt)
 
-	// await response or timeout
-	select {
-	case <-time.After(2 * time.Second):
-		log.Errorf("handlerRegistration: no content received .. ")
-		writer.WriteHeader(404)
+	if resPkt.Error != "" {
+		log.Errorf("handlerRegistration: refused [%s]", resPkt.Error)
+		writer.WriteHeader(refusalStatus(resPkt.Error))
 		return
-	case resPkt := <-face.handlerRegChan:
-		log.Printf("handlerRegistration [%s] got content [%v]", face.Name(), resPkt)
-		enc, err := json.Marshal(resPkt)
-		if err != nil {
-			writer.WriteHeader(400)
-			return
-		}
-		writer.Write(enc)
 	}
+	handlerRes := resPkt.RegisterHandler.HandlerResponse
+	writeCreated(writer, handlerRes.Uri, handlerRes)
 }
 
 func HandleTgDiscovery(face *QuicFace, writer http.ResponseWriter, request *http.Request) {
 	// query service for list of trunk groups available
-	face.recvChan <- api.PacketEvent{
+	resPkt, err := face.request(request.Context(), api.PacketEvent{
 		Sender: face.Name(),
 		Packet: api.Packet{
 			Type: api.TrunkGroupDiscoveryPacket,
 		},
-	}
-
-	// await response or timeout
-	select {
-	case <-time.After(2 * time.Second):
-		log.Errorf("HandleTgDiscovery: no content received .. ")
-		writer.WriteHeader(404)
+	})
+	if err != nil {
+		log.Errorf("HandleTgDiscovery: %v", err)
+		writer.WriteHeader(requestErrorStatus(err))
 		return
-	case resPkt := <-face.tgDiscChan:
-		log.Printf("HandleTgDiscovery [%s] got content [%v]", face.Name(), resPkt)
-		enc, err := json.Marshal(resPkt)
-		if err != nil {
-			writer.WriteHeader(400)
-			return
-		}
-		writer.Write(enc)
 	}
+	log.Printf("HandleTgDiscovery [%s] got content [%v]", face.Name(), resPkt)
+	writeJSON(writer, 200, resPkt.TrunkGroupsInfo)
 }
 
 func HandleCalls(face *QuicFace, writer http.ResponseWriter, request *http.Request) {
@@ -209,38 +327,135 @@ func HandleCalls(face *QuicFace, writer http.ResponseWriter, request *http.Reque
 		return
 	}
 
-	// extract handler info from the body
-	pkt, err := httpRequestBodyToRiptPacket(request)
+	// extract call info from the body
+	var callReq api.CallRequest
+	if status, err := readJSON(request, &callReq); err != nil {
+		log.Errorf("HandleCalls: %v", err)
+		writer.WriteHeader(status)
+		return
+	}
+
+	log.Printf("HandlerCalls: trunk [%s], Request [%v]", tgId, callReq)
+
+	// pass the packet to router and await the response
+	resPkt, err := face.request(request.Context(), api.PacketEvent{
+		Sender: face.Name(),
+		TgId:   tgId,
+		Packet: api.Packet{
+			Type:  api.CallsPacket,
+			Calls: api.CallsMessage{Request: callReq},
+		},
+	})
 	if err != nil {
-		log.Error(err)
-		writer.WriteHeader(400)
+		log.Errorf("HandleCalls: %v", err)
+		writer.WriteHeader(requestErrorStatus(err))
 		return
 	}
+	log.Printf("HandleCalls [%s] got content [%v]", face.Name(), resPkt)
 
-	log.Printf("HandlerCalls: trunk [%s], Request [%v]", tgId, pkt)
+	if resPkt.Error != "" {
+		log.Errorf("HandleCalls: refused [%s]", resPkt.Error)
+		writer.WriteHeader(refusalStatus(resPkt.Error))
+		return
+	}
+	callRes := resPkt.Calls.Response
+	writeCreated(writer, callRes.CallUri, callRes)
+}
 
-	// pass the packet to router
-	face.recvChan <- api.PacketEvent{
+// Hangup, the face leaves the call's media forwarding
+func HandleHangup(face *QuicFace, writer http.ResponseWriter, request *http.Request) {
+	params := mux.Vars(request)
+	tgId := params["trunkGroupId"]
+	callId := params["callId"]
+	if len(tgId) == 0 || len(callId) == 0 {
+		log.Errorf("hangup: missing trunkGroupId or callId")
+		writer.WriteHeader(400)
+		return
+	}
+
+	resPkt, err := face.request(request.Context(), api.PacketEvent{
 		Sender: face.Name(),
 		TgId:   tgId,
-		Packet: pkt,
+		CallId: callId,
+		Packet: api.Packet{
+			Type: api.CallHangupPacket,
+		},
+	})
+	if err != nil {
+		log.Errorf("hangup: %v", err)
+		writer.WriteHeader(requestErrorStatus(err))
+		return
 	}
+	switch DropReason(resPkt.Error) {
+	case "":
+	case DropUnknownCall:
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	case DropNotParticipant:
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	default:
+		log.Errorf("hangup: refused [%s]", resPkt.Error)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	face.media.forget(callId)
+	face.events.forget(callId)
+	writer.WriteHeader(http.StatusNoContent)
+}
 
-	// await response or timeout
-	select {
-	case <-time.After(2 * time.Second):
-		log.Errorf("HandleCalls: no content received .. ")
-		writer.WriteHeader(404)
+// Signaling byway, POST sends an event to the others in the call, GET
+// long polls for theirs like media pulls do
+func HandleEvents(face *QuicFace, writer http.ResponseWriter, request *http.Request) {
+	params := mux.Vars(request)
+	tgId := params["trunkGroupId"]
+	callId := params["callId"]
+	if len(tgId) == 0 || len(callId) == 0 {
+		log.Errorf("events: missing trunkGroupId or callId")
+		writer.WriteHeader(400)
 		return
-	case resPkt := <-face.callsChan:
-		log.Printf("HandleCalls [%s] got content [%v]", face.Name(), resPkt)
-		enc, err := json.Marshal(resPkt)
-		if err != nil {
-			writer.WriteHeader(400)
+	}
+
+	if request.Method == http.MethodGet {
+		pkts, ok := pullPackets(face, face.events, callId, api.EventCursorHeader, api.EventGapHeader, writer, request)
+		if !ok {
 			return
 		}
-		writer.Write(enc)
+		events := make([]api.CallEvent, len(pkts))
+		for i, pkt := range pkts {
+			events[i] = pkt.CallEvent
+		}
+		writeJSON(writer, 200, events)
+		return
+	}
+
+	var event api.CallEvent
+	if status, err := readJSON(request, &event); err != nil {
+		log.Errorf("events: %v", err)
+		writer.WriteHeader(status)
+		return
+	}
+	if err := validateCallEvent(event); err != nil {
+		log.Errorf("events: %v", err)
+		writer.WriteHeader(400)
+		return
 	}
+
+	err := face.deliverEvent(request.Context(), api.PacketEvent{
+		Sender: face.Name(),
+		TgId:   tgId,
+		CallId: callId,
+		Packet: api.Packet{
+			Type:      api.CallEventPacket,
+			CallEvent: event,
+		},
+	})
+	if err != nil {
+		writer.WriteHeader(http.StatusGone)
+		return
+	}
+	// relayed once the router gets to it
+	writer.WriteHeader(http.StatusAccepted)
 }
 
 func HandleMedia(face *QuicFace, writer http.ResponseWriter, request *http.Request) {
@@ -260,6 +475,16 @@ func HandleMedia(face *QuicFace, writer http.ResponseWriter, request *http.Reque
 		return
 	}
 
+	// long lived streams, one per direction, instead of a request per packet
+	if request.Method == http.MethodPut && request.Header.Get("Content-Type") == api.MediaStreamContentType {
+		handleMediaPushStream(face, tgId, callId, writer, request)
+		return
+	}
+	if request.Method == http.MethodGet && request.Header.Get("Accept") == api.MediaStreamContentType {
+		handleMediaPullStream(face, callId, writer, request)
+		return
+	}
+
 	// extract the body
 	body := &bytes.Buffer{}
 	_, err := io.Copy(body, request.Body)
@@ -277,10 +502,11 @@ func HandleMedia(face *QuicFace, writer http.ResponseWriter, request *http.Reque
 		if err != nil {
 			log.Errorf("media: unmarshal error [%v]", err)
 			writer.WriteHeader(400)
+			return
 		}
 
 		// pass the packet to router
-		face.recvChan <- api.PacketEvent{
+		err = face.deliverEvent(request.Context(), api.PacketEvent{
 			Sender: face.Name(),
 			TgId:   tgId,
 			CallId: callId,
@@ -288,169 +514,414 @@ func HandleMedia(face *QuicFace, writer http.ResponseWriter, request *http.Reque
 				Type:        api.StreamMediaPacket,
 				StreamMedia: media,
 			},
+		})
+		if err != nil {
+			writer.WriteHeader(requestErrorStatus(err))
+			return
 		}
 
 		// TODO: send a 200 Ok (until Ack is implemented)
 		writer.WriteHeader(200)
 		return
-	} else if request.Method == http.MethodGet {
-		// handle media pull
-		// do nothing for now
 	}
 
-	// await response or timeout
-	select {
-	case <-time.After(2 * time.Second):
-		log.Errorf("HandleMedia: no content received .. ")
-		writer.WriteHeader(404)
+	handleMediaPull(face, callId, writer, request)
+}
+
+// Long poll for the call's media after the since cursor, waiting up to
+// maxWait (ms) for some to arrive. All of it is returned in one framed
+// body along with the cursor to pull from next, and the number of packets
+// lost to buffer overflow when the client fell behind.
+func handleMediaPull(face *QuicFace, callId string, writer http.ResponseWriter, request *http.Request) {
+	pkts, ok := pullPackets(face, face.media, callId, api.MediaCursorHeader, api.MediaGapHeader, writer, request)
+	if !ok {
 		return
-	case resPkt := <-face.mediaRevChan:
-		log.Printf("HandlMediaRev [%s] got content [%v]", face.Name(), resPkt)
-		// binary encode stream media payload
-		enc, err := syntax.Marshal(resPkt.StreamMedia)
+	}
+
+	body := &bytes.Buffer{}
+	for _, pkt := range pkts {
+		if err := api.WriteMediaPacket(body, pkt.StreamMedia); err != nil {
+			writer.WriteHeader(500)
+			return
+		}
+	}
+	writer.Header().Set("Content-Type", api.MediaStreamContentType)
+	writer.Write(body.Bytes())
+}
+
+// pullPackets long polls the buffer for the call's packets after the
+// cursor in the since query parameter, waiting up to maxWait ms. The
+// cursor to pull from next and the packets missed go in the given
+// headers. Nothing is left to write unless packets are returned.
+func pullPackets(face *QuicFace, buffer *mediaBuffer, callId, cursorHeader, gapHeader string,
+	writer http.ResponseWriter, request *http.Request) ([]api.Packet, bool) {
+	query := request.URL.Query()
+	var since uint64
+	if value := query.Get("since"); value != "" {
+		var err error
+		if since, err = strconv.ParseUint(value, 10, 64); err != nil {
+			log.Errorf("pull: bad since [%s]", value)
+			writer.WriteHeader(400)
+			return nil, false
+		}
+	}
+	maxWait := defaultPullWait
+	if value := query.Get("maxWait"); value != "" {
+		ms, err := strconv.ParseUint(value, 10, 32)
 		if err != nil {
+			log.Errorf("pull: bad maxWait [%s]", value)
+			writer.WriteHeader(400)
+			return nil, false
+		}
+		maxWait = time.Duration(ms) * time.Millisecond
+		if maxWait > maxPullWait {
+			maxWait = maxPullWait
+		}
+	}
+
+	deadline := time.After(maxWait)
+	pkts, cursor, gap, more := buffer.since(since, callId)
+wait:
+	for len(pkts) == 0 {
+		select {
+		case <-more:
+			pkts, cursor, gap, more = buffer.since(since, callId)
+		case <-deadline:
+			break wait
+		case <-face.done:
+			writer.WriteHeader(http.StatusGone)
+			return nil, false
+		case <-request.Context().Done():
+			return nil, false
+		}
+	}
+	// a first pull has nothing to have missed
+	if query.Get("since") == "" {
+		gap = 0
+	}
+
+	writer.Header().Set(cursorHeader, strconv.FormatUint(cursor, 10))
+	if gap > 0 {
+		log.Printf("pull: [%s] missed [%d] packets", face.Name(), gap)
+		writer.Header().Set(gapHeader, strconv.FormatUint(gap, 10))
+	}
+	if len(pkts) == 0 {
+		writer.WriteHeader(http.StatusNoContent)
+		return nil, false
+	}
+	return pkts, true
+}
+
+// media pushed over the request body until the client ends it
+func handleMediaPushStream(face *QuicFace, tgId, callId string, writer http.ResponseWriter, request *http.Request) {
+	log.Printf("media push stream from [%s] for call [%s]", face.Name(), callId)
+	face.activity.streamStarted()
+	defer face.activity.streamEnded()
+	for {
+		media, err := api.ReadMediaPacket(request.Body)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Errorf("media push stream from [%s]: %v", face.Name(), err)
 			writer.WriteHeader(400)
 			return
 		}
-		writer.Write(enc)
-		return
+
+		err = face.deliverEvent(request.Context(), api.PacketEvent{
+			Sender: face.Name(),
+			TgId:   tgId,
+			CallId: callId,
+			Packet: api.Packet{
+				Type:        api.StreamMediaPacket,
+				StreamMedia: media,
+			},
+		})
+		if err != nil {
+			log.Errorf("media push stream from [%s]: %v", face.Name(), err)
+			writer.WriteHeader(requestErrorStatus(err))
+			return
+		}
+	}
+	writer.WriteHeader(200)
+}
+
+// media for the face written to the response body as it arrives, until
+// the client goes away
+func handleMediaPullStream(face *QuicFace, callId string, writer http.ResponseWriter, request *http.Request) {
+	log.Printf("media pull stream to [%s]", face.Name())
+	face.activity.streamStarted()
+	defer face.activity.streamEnded()
+	writer.Header().Set("Content-Type", api.MediaStreamContentType)
+	writer.WriteHeader(200)
+	// over TCP the headers are held back until flushed
+	flusher, _ := writer.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
 	}
 
+	cursor := face.media.cursor(callId)
+	for {
+		pkts, next, gap, more := face.media.since(cursor, callId)
+		if gap > 0 {
+			log.Printf("media pull stream: [%s] missed [%d] packets", face.Name(), gap)
+		}
+		cursor = next
+		for _, pkt := range pkts {
+			if err := api.WriteMediaPacket(writer, pkt.StreamMedia); err != nil {
+				log.Errorf("media pull stream to [%s]: %v", face.Name(), err)
+				return
+			}
+		}
+		if len(pkts) > 0 && flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-more:
+		case <-request.Context().Done():
+			log.Printf("media pull stream to [%s] ended", face.Name())
+			return
+		case <-face.done:
+			return
+		}
+	}
 }
 
 // Mux handler for routing various h3 endpoints
 func setupHandler(server *QuicFaceServer) http.Handler {
 	router := mux.NewRouter()
 
-	// trigger's face creation as well
+	// trigger's face creation as well, the response carries the token
+	// identifying the face on the following requests
 	joinFn := func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Join from  [%v]", r.RemoteAddr)
-		face := NewQuicFace(r.RemoteAddr)
+		name := fmt.Sprintf("%s#%d", r.RemoteAddr, atomic.AddUint64(&server.joins, 1))
+		face := NewQuicFace(name)
+		face.transport = requestTransport(r)
+		if face.transport == "h3" {
+			face.activity.usedConn(r.RemoteAddr)
+		}
+		if server.config.RequestTimeout > 0 {
+			face.requestTimeout = server.config.RequestTimeout
+		}
+		token, err := server.sessions.add(face)
+		if err != nil {
+			log.Errorf("join: can't create session [%v]", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 		server.feedChan <- face
-		server.faceMap[r.RemoteAddr] = face
+		w.Header().Set(api.SessionHeader, token)
 		w.WriteHeader(200)
 	}
 
 	leaveFn := func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Leave from [%v]", r.RemoteAddr)
 		//  get the face
-		face := server.faceMap[r.RemoteAddr]
+		token, face := server.sessions.lookup(r)
 		if face != nil {
-			face.closeChan <- errors.New("client leave")
-			delete(server.faceMap, r.RemoteAddr)
+			server.sessions.remove(token)
+			face.(*QuicFace).Close(errors.New("client leave"))
 		}
 		w.WriteHeader(200)
 	}
 
-	regHandlerFn := func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("register handler from [%v]", r.RemoteAddr)
-		//  get the face
-		face := server.faceMap[r.RemoteAddr]
-		HandlerRegistration(face, w, r)
+	// requests without a known session are rejected
+	withFace := func(handle func(*QuicFace, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			_, face := server.sessions.lookup(r)
+			if face == nil || face.(*QuicFace).isClosed() {
+				log.Errorf("no session for request [%s] from [%v]", r.URL.Path, r.RemoteAddr)
+				server.config.Audit.Log(audit.Record{
+					Event:  audit.EventAuthFailure,
+					Face:   r.RemoteAddr,
+					Uri:    r.URL.Path,
+					Detail: "no session",
+				})
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			quicFace := face.(*QuicFace)
+			quicFace.activity.touch()
+			if requestTransport(r) == "h3" {
+				quicFace.activity.usedConn(r.RemoteAddr)
+			}
+			handle(quicFace, w, r)
+		}
 	}
 
-	tgDiscFn := func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("trunk group discovery from [%v]", r.RemoteAddr)
-		//  get the face
-		face := server.faceMap[r.RemoteAddr]
+	regHandlerFn := withFace(func(face *QuicFace, w http.ResponseWriter, r *http.Request) {
+		log.Printf("register handler from [%s]", face.Name())
+		HandlerRegistration(face, w, r)
+	})
+
+	tgDiscFn := withFace(func(face *QuicFace, w http.ResponseWriter, r *http.Request) {
+		log.Printf("trunk group discovery from [%s]", face.Name())
 		HandleTgDiscovery(face, w, r)
-	}
+	})
 
-	callsFn := func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("calls from  [%v]", r.RemoteAddr)
-		//  get the face
-		face := server.faceMap[r.RemoteAddr]
+	callsFn := withFace(func(face *QuicFace, w http.ResponseWriter, r *http.Request) {
+		log.Printf("calls from  [%s]", face.Name())
 		HandleCalls(face, w, r)
-	}
+	})
 
-	mediaFn := func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("mediaByWay from [%v]", r.RemoteAddr)
-		//  get the face
-		face := server.faceMap[r.RemoteAddr]
+	hangupFn := withFace(func(face *QuicFace, w http.ResponseWriter, r *http.Request) {
+		log.Printf("hangup from  [%s]", face.Name())
+		HandleHangup(face, w, r)
+	})
+
+	eventsFn := withFace(func(face *QuicFace, w http.ResponseWriter, r *http.Request) {
+		log.Printf("signalingByWay from [%s]", face.Name())
+		HandleEvents(face, w, r)
+	})
+
+	mediaFn := withFace(func(face *QuicFace, w http.ResponseWriter, r *http.Request) {
+		log.Printf("mediaByWay from [%s]", face.Name())
 		HandleMedia(face, w, r)
+	})
+
+	// latencies are recorded for the short requests only, the long polls
+	// and media streams would swamp them
+	timed := func(route string, h http.HandlerFunc) http.HandlerFunc {
+		return instrumentHandler(h, server.latency, route)
 	}
 
 	// TgDiscovery
-	router.HandleFunc(baseUrl+"/providertgs", tgDiscFn).Methods(http.MethodGet)
+	router.HandleFunc(baseUrl+"/providertgs", timed("providertgs", tgDiscFn)).Methods(http.MethodGet)
 
 	// Handler registrations
 	router.HandleFunc("/.well-known/ript/v1/providertgs/{trunkGroupId}/handlers",
-		regHandlerFn).Methods(http.MethodPost)
+		timed("handlers", regHandlerFn)).Methods(http.MethodPost)
 
 	// Misc ones (revisit)
-	router.HandleFunc("/media/join", joinFn)
-	router.HandleFunc("/media/leave", leaveFn)
+	router.HandleFunc("/media/join", timed("join", joinFn))
+	router.HandleFunc("/media/leave", timed("leave", leaveFn))
 
 	//Calls
-	router.HandleFunc("/.well-known/ript/v1/providertgs/{trunkGroupId}/calls", callsFn).Methods(http.MethodPost)
+	router.HandleFunc("/.well-known/ript/v1/providertgs/{trunkGroupId}/calls",
+		timed("calls", callsFn)).Methods(http.MethodPost)
 
-	// signaling byways
-	// TODO
+	router.HandleFunc("/.well-known/ript/v1/providertgs/{trunkGroupId}/calls/{callId}",
+		timed("hangup", hangupFn)).Methods(http.MethodDelete)
+
+	// signaling byways - POST forward, GET reverse
+	router.HandleFunc("/.well-known/ript/v1/providertgs/{trunkGroupId}/calls/{callId}/events",
+		timed("events", eventsFn)).Methods(http.MethodPost)
+	router.HandleFunc("/.well-known/ript/v1/providertgs/{trunkGroupId}/calls/{callId}/events",
+		eventsFn).Methods(http.MethodGet)
 
 	// MediaBywats - PUT forward, GET reverse
 	router.HandleFunc("/.well-known/ript/v1/providertgs/{trunkGroupId}/calls/{callId}/media",
-		mediaFn).Methods(http.MethodPut, http.MethodGet)
+		mediaFn).Methods(http.MethodPut).Headers("Content-Type", api.MediaStreamContentType)
+	router.HandleFunc("/.well-known/ript/v1/providertgs/{trunkGroupId}/calls/{callId}/media",
+		timed("media", mediaFn)).Methods(http.MethodPut)
+	router.HandleFunc("/.well-known/ript/v1/providertgs/{trunkGroupId}/calls/{callId}/media",
+		mediaFn).Methods(http.MethodGet)
 
 	return router
 }
 
-func NewQuicFaceServer(port int, host, certFile, keyFile string) *QuicFaceServer {
+func NewQuicFaceServer(port int, host, certFile, keyFile string, config QuicServerConfig) *QuicFaceServer {
 	url := host + ":" + strconv.Itoa(port)
 	log.Printf("Server Url [%s]", url)
 
+	// dead clients stop keeping the connection alive
 	quicConf := &quic.Config{
-		KeepAlive: true,
+		KeepAlive:      true,
+		MaxIdleTimeout: sessionIdleTimeout,
 	}
 
-	/*
-		quicConf.GetLogWriter = func(connID []byte) io.WriteCloser {
-			filename := fmt.Sprintf("server_%x.qlog", connID)
-			f, err := os.Create(filename)
-			if err != nil {
-				log.Fatal(err)
-			}
-			log.Printf("Creating qlog file %s.\n", filename)
-			return f
-		}*/
-
 	quicServer := &QuicFaceServer{
 		Server: &http3.Server{
 			Server:     &http.Server{Handler: nil, Addr: url},
 			QuicConfig: quicConf,
 		},
+		config:   config,
 		feedChan: make(chan Face, 10),
-		faceMap:  map[string]*QuicFace{},
+		sessions: newFaceSessions(),
 	}
-	handler := setupHandler(quicServer)
-	quicServer.Handler = handler
+	quicServer.watch = newConnWatch(config.Qlog, quicServer.connClosed)
+	quicConf.GetLogWriter = quicServer.watch.LogWriter("server")
+	quicServer.latency = config.Metrics.NewHistogram("ript_h3_request_duration_seconds",
+		"Latency of the h3 requests, long polls and media streams excluded.",
+		metrics.DefaultBuckets, "route", "method")
+	quicServer.Handler = setupHandler(quicServer)
 
 	log.Printf("Starting Server certFile [%s], keyFile [%s]", certFile, keyFile)
 
-	go quicServer.ListenAndServeTLS(certFile, keyFile)
+	go quicServer.serve(certFile, keyFile)
+	if config.TCPPort > 0 {
+		go quicServer.serveTCP(host, certFile, keyFile)
+	}
+	go quicServer.reapSessions()
 	log.Info("New QUIC-H3 Server created.\n")
 	return quicServer
 }
 
-func (server *QuicFaceServer) Feed() chan Face {
-	return server.feedChan
+func (server *QuicFaceServer) serve(certFile, keyFile string) {
+	if err := server.serveWatched(certFile, keyFile); err != nil {
+		log.Errorf("h3 server stopped: %v", err)
+	}
 }
 
-/////
-/// Utilities
-////
-
-func httpRequestBodyToRiptPacket(request *http.Request) (api.Packet, error) {
-	body := &bytes.Buffer{}
-	_, err := io.Copy(body, request.Body)
+// serveWatched serves on a connection the watcher observes, to learn which
+// client each QUIC connection is from
+func (server *QuicFaceServer) serveWatched(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
-		return api.Packet{}, fmt.Errorf("error retrieving the body: [%v]", err)
+		return err
 	}
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
 
-	var pkt api.Packet
-	err = json.Unmarshal(body.Bytes(), &pkt)
+	conn, err := net.ListenPacket("udp", server.Addr)
 	if err != nil {
-		return api.Packet{}, fmt.Errorf("error unmarshal [%v]", err)
+		return err
+	}
+	defer conn.Close()
+	return server.Serve(server.watch.PacketConn(conn))
+}
+
+// serveTCP serves HTTP/2 and HTTP/1.1, advertising h3 on every response
+func (server *QuicFaceServer) serveTCP(host, certFile, keyFile string) {
+	tcpServer := &http.Server{
+		Addr:    host + ":" + strconv.Itoa(server.config.TCPPort),
+		Handler: altSvcHandler(server.Handler, server.SetQuicHeaders),
 	}
+	log.Printf("TCP fallback Url [%s]", tcpServer.Addr)
+	if err := tcpServer.ListenAndServeTLS(certFile, keyFile); err != nil {
+		log.Errorf("tcp server stopped: %v", err)
+	}
+}
 
-	return pkt, nil
+func (server *QuicFaceServer) Feed() chan Face {
+	return server.feedChan
+}
+
+// reapSessions closes the faces of clients that went away without leaving
+// and weren't caught by their connection closing, like those on the TCP
+// fallback
+// connClosed closes the faces last used over the QUIC connection of the
+// client at addr. Faces whose client moved on to another connection stay.
+func (server *QuicFaceServer) connClosed(addr string) {
+	closed := server.sessions.removeIf(func(face Face) bool {
+		return face.(*QuicFace).activity.lastConn() == addr
+	})
+	for _, face := range closed {
+		face.(*QuicFace).Close(fmt.Errorf("quic connection from [%s] closed", addr))
+	}
+}
+
+func (server *QuicFaceServer) reapSessions() {
+	ticker := time.NewTicker(sessionIdleTimeout / 3)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		reaped := server.sessions.removeIf(func(face Face) bool {
+			f := face.(*QuicFace)
+			return f.isClosed() || f.activity.idle(now) > sessionIdleTimeout
+		})
+		for _, face := range reaped {
+			face.(*QuicFace).handleClose(http.StatusRequestTimeout, "idle timeout")
+		}
+	}
 }
@@ -0,0 +1,148 @@
+package ript_net
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+// Per-face admission control. Each face gets token buckets for signaling
+// and media (packets and bytes per second) that are checked before the
+// packet reaches the router's signaling or media queue.
+
+const (
+	// approximate wire overhead of a media packet header
+	mediaHeaderSize = 24
+	// inbound queue per face in front of the limiter
+	faceIntakeSize = 20
+)
+
+// RateLimit of zero means unlimited for the respective dimension.
+type RateLimit struct {
+	PacketsPerSec float64
+	BytesPerSec   float64
+}
+
+type RateLimitConfig struct {
+	Signaling RateLimit
+	Media     RateLimit
+	// Number of limit hits within ViolationWindow after which
+	// the face gets disconnected (0 never disconnects)
+	MaxViolations   int
+	ViolationWindow time.Duration
+}
+
+// classic token bucket holding up to one second worth of tokens
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   rate,
+		tokens: rate,
+		last:   now,
+	}
+}
+
+// nil bucket admits everything
+func (b *tokenBucket) allow(n float64, now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+type faceLimiter struct {
+	config      RateLimitConfig
+	sigPkts     *tokenBucket
+	sigBytes    *tokenBucket
+	mediaPkts   *tokenBucket
+	mediaBytes  *tokenBucket
+	violations  int
+	windowStart time.Time
+}
+
+func newFaceLimiter(config RateLimitConfig, now time.Time) *faceLimiter {
+	return &faceLimiter{
+		config:      config,
+		sigPkts:     newTokenBucket(config.Signaling.PacketsPerSec, now),
+		sigBytes:    newTokenBucket(config.Signaling.BytesPerSec, now),
+		mediaPkts:   newTokenBucket(config.Media.PacketsPerSec, now),
+		mediaBytes:  newTokenBucket(config.Media.BytesPerSec, now),
+		windowStart: now,
+	}
+}
+
+// admit returns a nil error if the packet is within limits. Otherwise the
+// error describes the limit hit; disconnect is set once the face exceeded
+// MaxViolations within the violation window.
+func (l *faceLimiter) admit(pkt api.Packet, now time.Time) (disconnect bool, err error) {
+	size := float64(packetSize(pkt))
+
+	if isMediaPacket(pkt.Type) {
+		if !l.mediaPkts.allow(1, now) {
+			err = fmt.Errorf("media packet rate exceeded [%v pps]", l.config.Media.PacketsPerSec)
+		} else if !l.mediaBytes.allow(size, now) {
+			err = fmt.Errorf("media byte rate exceeded [%v Bps]", l.config.Media.BytesPerSec)
+		}
+	} else {
+		if !l.sigPkts.allow(1, now) {
+			err = fmt.Errorf("signaling packet rate exceeded [%v pps]", l.config.Signaling.PacketsPerSec)
+		} else if !l.sigBytes.allow(size, now) {
+			err = fmt.Errorf("signaling byte rate exceeded [%v Bps]", l.config.Signaling.BytesPerSec)
+		}
+	}
+
+	if err == nil {
+		return false, nil
+	}
+
+	if l.config.ViolationWindow > 0 && now.Sub(l.windowStart) > l.config.ViolationWindow {
+		l.windowStart = now
+		l.violations = 0
+	}
+	l.violations++
+	disconnect = l.config.MaxViolations > 0 && l.violations >= l.config.MaxViolations
+	return disconnect, err
+}
+
+func isMediaPacket(t api.PacketType) bool {
+	switch t {
+	case api.StreamMediaPacket, api.StreamMediaAckPacket, api.StreamMediaRequestPacket:
+		return true
+	}
+	return false
+}
+
+// rough size estimate, good enough for accounting purposes
+func packetSize(pkt api.Packet) int {
+	switch pkt.Type {
+	case api.StreamMediaPacket:
+		return mediaHeaderSize + len(pkt.StreamMedia.Media)
+	case api.RegisterHandlerPacket:
+		req := pkt.RegisterHandler.HandlerRequest
+		return len(req.HandlerId) + len(req.Advertisement)
+	case api.CallsPacket:
+		req := pkt.Calls.Request
+		return len(req.HandlerUri) + len(req.Destination) + len(req.CallUri)
+	}
+	return 1
+}
@@ -0,0 +1,106 @@
+package ript_net
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, now)
+
+	if !b.allow(1, now) || !b.allow(1, now) {
+		t.Fatalf("expected burst of 2 to pass")
+	}
+	if b.allow(1, now) {
+		t.Fatalf("expected bucket to be empty")
+	}
+	if !b.allow(1, now.Add(500*time.Millisecond)) {
+		t.Fatalf("expected refill after 500ms")
+	}
+
+	var unlimited *tokenBucket
+	if !unlimited.allow(1e9, now) {
+		t.Fatalf("nil bucket must not limit")
+	}
+}
+
+func TestFaceLimiterDisconnect(t *testing.T) {
+	now := time.Now()
+	l := newFaceLimiter(RateLimitConfig{
+		Media:           RateLimit{PacketsPerSec: 1},
+		MaxViolations:   2,
+		ViolationWindow: time.Second,
+	}, now)
+
+	media := api.Packet{Type: api.StreamMediaPacket}
+	signaling := api.Packet{Type: api.TrunkGroupDiscoveryPacket}
+
+	if _, err := l.admit(media, now); err != nil {
+		t.Fatalf("unexpected limit hit [%v]", err)
+	}
+	// signaling has its own (unlimited) budget
+	if _, err := l.admit(signaling, now); err != nil {
+		t.Fatalf("unexpected limit hit [%v]", err)
+	}
+
+	disconnect, err := l.admit(media, now)
+	if err == nil || disconnect {
+		t.Fatalf("expected first violation without disconnect")
+	}
+	disconnect, err = l.admit(media, now)
+	if err == nil || !disconnect {
+		t.Fatalf("expected disconnect after second violation")
+	}
+}
+
+func TestRouterRateLimitsFace(t *testing.T) {
+	r := NewRouterWithConfig("test", NewRIPTService(), RouterConfig{
+		RateLimits: RateLimitConfig{
+			Signaling:     RateLimit{PacketsPerSec: 1},
+			MaxViolations: 1,
+		},
+	})
+
+	flooder := newTestFace("flooder")
+	r.AddFace(flooder)
+
+	discovery := api.Packet{Type: api.TrunkGroupDiscoveryPacket}
+	flooder.receive(discovery)
+	flooder.receive(discovery)
+
+	select {
+	case err := <-flooder.closed:
+		if err == nil {
+			t.Fatalf("expected disconnect reason")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("flooding face was not disconnected")
+	}
+}
+
+func TestRouterRateLimitsPeersSeparately(t *testing.T) {
+	r := NewRouterWithConfig("test", NewRIPTService(), RouterConfig{
+		RateLimits: RateLimitConfig{
+			Signaling:     RateLimit{PacketsPerSec: 1},
+			MaxViolations: 1,
+		},
+	})
+
+	toB, fromA := newLink("a", "b")
+	fromA.recvChan = make(chan api.PacketEvent, 10)
+	r.AddFace(toB)
+
+	discovery := api.Packet{Type: api.TrunkGroupDiscoveryPacket}
+	toB.receive(discovery)
+	toB.receive(discovery)
+	awaitPacket(t, toB.testFace, api.TrunkGroupDiscoveryPacket)
+	awaitPacket(t, toB.testFace, api.TrunkGroupDiscoveryPacket)
+	select {
+	case err := <-toB.closed:
+		t.Fatalf("peer disconnected [%v]", err)
+	default:
+	}
+}
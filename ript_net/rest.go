@@ -0,0 +1,76 @@
+package ript_net
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+)
+
+// Bodies and status codes of the RIPT REST surface. Requests and
+// responses carry the api's JSON shapes (HandlerRequest, CallResponse, ...)
+// rather than the Packet envelope the router passes around.
+
+const jsonContentType = "application/json"
+
+var (
+	errRequestTimeout = errors.New("ript_net: no reply from the router in time")
+	errFaceClosed     = errors.New("ript_net: face is closed")
+)
+
+// readJSON decodes the request body into v, returning the status to fail
+// the request with if it can't
+func readJSON(request *http.Request, v interface{}) (int, error) {
+	if ct := request.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil || mediaType != jsonContentType {
+			return http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type [%s]", ct)
+		}
+	}
+	if err := json.NewDecoder(request.Body).Decode(v); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("bad body [%v]", err)
+	}
+	return 0, nil
+}
+
+func writeJSON(writer http.ResponseWriter, status int, v interface{}) {
+	enc, err := json.Marshal(v)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", jsonContentType)
+	writer.WriteHeader(status)
+	writer.Write(enc)
+}
+
+// writeCreated answers a request creating the resource at uri
+func writeCreated(writer http.ResponseWriter, uri string, v interface{}) {
+	writer.Header().Set("Location", uri)
+	writeJSON(writer, http.StatusCreated, v)
+}
+
+// status for a request the router didn't answer
+func requestErrorStatus(err error) int {
+	switch err {
+	case errRequestTimeout:
+		return http.StatusGatewayTimeout
+	case errFaceClosed:
+		return http.StatusGone
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// status for a request the service refused, by the Error of its reply
+func refusalStatus(reason string) int {
+	switch reason {
+	case errUnknownTrunkGroup.Error(), errUnknownHandler.Error(), errUnknownCallToJoin.Error():
+		return http.StatusNotFound
+	case errBadAdvertisement.Error(), errNoMatchingCaps.Error():
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,77 @@
+package ript_net
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+func TestReadJSON(t *testing.T) {
+	body := `{"handler-id":"h1","advertisement":"1 in: opus;"}`
+	req := httptest.NewRequest("POST", "/handlers", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	var handlerReq api.HandlerRequest
+	if status, err := readJSON(req, &handlerReq); err != nil {
+		t.Fatalf("unexpected error [%d] %v", status, err)
+	}
+	if handlerReq.HandlerId != "h1" || handlerReq.Advertisement != "1 in: opus;" {
+		t.Fatalf("unexpected request %v", handlerReq)
+	}
+
+	req = httptest.NewRequest("POST", "/handlers", strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/plain")
+	if status, _ := readJSON(req, &handlerReq); status != 415 {
+		t.Fatalf("expected 415, got %d", status)
+	}
+
+	req = httptest.NewRequest("POST", "/handlers", strings.NewReader("{"))
+	if status, _ := readJSON(req, &handlerReq); status != 400 {
+		t.Fatalf("expected 400, got %d", status)
+	}
+}
+
+func TestWriteCreated(t *testing.T) {
+	rec := httptest.NewRecorder()
+	uri := "/.well-known/ript/v1/providertgs/trunkAbc/calls/1"
+	writeCreated(rec, uri, api.CallResponse{CallUri: uri})
+
+	if rec.Code != 201 || rec.Header().Get("Location") != uri {
+		t.Fatalf("unexpected response [%d] [%s]", rec.Code, rec.Header().Get("Location"))
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != jsonContentType {
+		t.Fatalf("unexpected content type [%s]", ct)
+	}
+	if !strings.HasPrefix(rec.Body.String(), `{"uri":"`+uri+`"`) {
+		t.Fatalf("unexpected body %s", rec.Body.String())
+	}
+}
+
+func TestRequestErrorStatus(t *testing.T) {
+	if requestErrorStatus(errRequestTimeout) != 504 {
+		t.Fatalf("timeouts should be 504")
+	}
+	if requestErrorStatus(errFaceClosed) != 410 {
+		t.Fatalf("closed faces should be 410")
+	}
+	if requestErrorStatus(errors.New("other")) != 500 {
+		t.Fatalf("other errors should be 500")
+	}
+}
+
+func TestRefusalStatus(t *testing.T) {
+	for reason, status := range map[string]int{
+		errUnknownTrunkGroup.Error(): 404,
+		errUnknownHandler.Error():    404,
+		errUnknownCallToJoin.Error(): 404,
+		errBadAdvertisement.Error():  400,
+		errNoMatchingCaps.Error():    400,
+		"other":                      500,
+	} {
+		if got := refusalStatus(reason); got != status {
+			t.Fatalf("[%s] should be %d, got %d", reason, status, got)
+		}
+	}
+}
@@ -1,36 +1,137 @@
 package ript_net
 
 import (
+	"crypto/tls"
+	"fmt"
+	"hash/fnv"
 	"log"
+	"runtime"
 	"sync"
+	"time"
 
 	"github.com/WhatIETF/goRIPT/api"
+	"github.com/WhatIETF/goRIPT/audit"
+	"github.com/WhatIETF/goRIPT/metrics"
+	"github.com/WhatIETF/goRIPT/mixer"
+	"github.com/WhatIETF/goRIPT/recording"
 )
 
 /////
 
+// Reasons for the router to drop a packet instead of forwarding it
+type DropReason string
+
+const (
+	DropRateLimited    DropReason = "rate_limited"
+	DropUnknownCall    DropReason = "unknown_call"
+	DropNotParticipant DropReason = "not_participant"
+	DropNotNegotiated  DropReason = "not_negotiated"
+	DropQueueFull      DropReason = "queue_full"
+	DropProtected      DropReason = "protected"
+)
+
+const (
+	signalingQueueSize = 200
+	// per media shard
+	mediaQueueSize = 200
+)
+
+type RouterConfig struct {
+	RateLimits RateLimitConfig
+	// limits of peer relay links, which carry the media of many
+	// participants, zero values don't limit
+	PeerRateLimits RateLimitConfig
+	SendQueue      SendQueueConfig
+	// number of media shards, 0 runs one per core
+	MediaWorkers int
+	// optional, face and authorization events are recorded when set
+	Audit *audit.Logger
+	// optional, media of calls enabled for recording is tapped when set
+	Recorder *recording.Recorder
+	// relay side opus for mixing and transcoding, both are unavailable without
+	OpusCodec *mixer.Codec
+	// forward only the N loudest sources to each participant, 0 forwards all
+	ActiveSpeakers int
+	// optional, relay metrics are registered on it when set
+	Metrics *metrics.Registry
+	// presented when dialing peer relays
+	PeerSecret string
+	// optional, verifies the peer relays' certs instead of the system roots
+	PeerTLS *tls.Config
+}
+
 type Router struct {
 	name     string
-	faceLock sync.Mutex
+	config   RouterConfig
+	faceLock sync.RWMutex
 	faces    map[api.FaceName]Face
-	recvChan chan api.PacketEvent
-	service  *RIPTService
+	// per face admission, closed on face removal
+	intakes map[api.FaceName]chan struct{}
+	queues  map[api.FaceName]*sendQueue
+	// control and media plane are processed independently, so that
+	// media load can't delay call setup. Media is sharded by call id,
+	// keeping each call's packets in order on a single worker.
+	signalingChan chan api.PacketEvent
+	mediaShards   []chan api.PacketEvent
+	// links to other relays
+	peers   map[api.FaceName]PeerFace
+	service *RIPTService
+	// mixers of the calls in MCU mode
+	mixLock sync.Mutex
+	mixers  map[string]*mixer.Mixer
+	// codec state of the calls with transcoded media
+	transcodeLock sync.Mutex
+	transcoders   map[string]*transcoder
+	dropLock      sync.Mutex
+	drops         map[DropReason]uint64
+	metrics       routerMetrics
+	// audit records of dropped media, aggregated per face and call
+	dropAudit *mediaDropAudit
 }
 
 func NewRouter(name string, service *RIPTService) *Router {
+	return NewRouterWithConfig(name, service, RouterConfig{})
+}
+
+func NewRouterWithConfig(name string, service *RIPTService, config RouterConfig) *Router {
+	if config.SendQueue == (SendQueueConfig{}) {
+		config.SendQueue = DefaultSendQueueConfig()
+	}
+	if config.MediaWorkers <= 0 {
+		config.MediaWorkers = runtime.NumCPU()
+	}
 	r := &Router{
-		name:     name,
-		faces:    map[api.FaceName]Face{},
-		recvChan: make(chan api.PacketEvent, 200),
-		service:  service,
+		name:          name,
+		config:        config,
+		faces:         map[api.FaceName]Face{},
+		intakes:       map[api.FaceName]chan struct{}{},
+		queues:        map[api.FaceName]*sendQueue{},
+		signalingChan: make(chan api.PacketEvent, signalingQueueSize),
+		mediaShards:   make([]chan api.PacketEvent, config.MediaWorkers),
+		peers:         map[api.FaceName]PeerFace{},
+		service:       service,
+		mixers:        map[string]*mixer.Mixer{},
+		transcoders:   map[string]*transcoder{},
+		drops:         map[DropReason]uint64{},
+		dropAudit:     newMediaDropAudit(mediaDropAuditInterval),
+	}
+	service.announceReady = make(chan struct{}, 1)
+	service.onCallEnded = r.callEnded
+	if config.Metrics != nil {
+		r.registerMetrics(config.Metrics)
+	}
+	go r.announceToPeers()
+	go r.routeSignaling()
+	for i := range r.mediaShards {
+		r.mediaShards[i] = make(chan api.PacketEvent, mediaQueueSize)
+		go r.routeMedia(r.mediaShards[i])
 	}
-	go r.route()
 	return r
 }
 
 //TODO: Handle Error reporting
-func (r *Router) route() {
-	for evt := range r.recvChan {
+func (r *Router) routeSignaling() {
+	for evt := range r.signalingChan {
 		log.Printf("[%s] received from [%s], packet %v", r.name, evt.Sender, evt.Packet.Type)
 
 		switch evt.Packet.Type {
@@ -40,83 +141,361 @@ func (r *Router) route() {
 			packet := api.Packet{
 				Type:            api.TrunkGroupDiscoveryPacket,
 				TrunkGroupsInfo: response,
+				RequestId:       evt.Packet.RequestId,
 			}
 
-			err := r.faces[evt.Sender].Send(packet)
-			if err != nil {
-				r.RemoveFace(r.faces[evt.Sender], err)
-			}
+			r.send(evt.Sender, packet)
 			continue
 
 		case api.RegisterHandlerPacket:
 			// handler registration
 			log.Printf("ript_net: handle /handlerRegistration.")
-			response, _ := r.service.registerHandler(evt.Packet.RegisterHandler)
+			response, err := r.service.registerHandler(evt.Sender, evt.TgId, evt.Packet.RegisterHandler)
 			packet := api.Packet{
 				Type:            api.RegisterHandlerPacket,
 				RegisterHandler: response,
+				RequestId:       evt.Packet.RequestId,
 			}
-
-			err := r.faces[evt.Sender].Send(packet)
 			if err != nil {
-				r.RemoveFace(r.faces[evt.Sender], err)
+				packet.Error = err.Error()
 			}
+
+			r.send(evt.Sender, packet)
 			continue
 
 		case api.CallsPacket:
 			log.Printf("ript_net: handle /calls.")
-			response, _ := r.service.processCalls(evt.TgId, evt.Packet.Calls)
+			response, err := r.service.processCalls(evt.Sender, evt.TgId, evt.Packet.Calls)
 			packet := api.Packet{
-				Type:  api.CallsPacket,
-				Calls: response,
+				Type:      api.CallsPacket,
+				Calls:     response,
+				RequestId: evt.Packet.RequestId,
 			}
-
-			err := r.faces[evt.Sender].Send(packet)
 			if err != nil {
-				r.RemoveFace(r.faces[evt.Sender], err)
+				packet.Error = err.Error()
+			}
+
+			r.send(evt.Sender, packet)
+			continue
+
+		case api.CallHangupPacket:
+			log.Printf("ript_net: handle /calls hangup. call [%s]", evt.CallId)
+			// the others in the call learn of it
+			evt.Packet.CallEvent = api.CallEvent{Type: api.CallEventHangup}
+			reason := r.relayCallEvent(evt)
+			// request/response faces await the outcome
+			if evt.Packet.RequestId != "" {
+				r.send(evt.Sender, api.Packet{
+					Type:      api.CallHangupPacket,
+					CallId:    evt.CallId,
+					RequestId: evt.Packet.RequestId,
+					Error:     string(reason),
+				})
+			}
+			continue
+
+		case api.CallEventPacket:
+			r.relayCallEvent(evt)
+			continue
+
+		case api.PeerCallPacket:
+			if !r.isPeer(evt.Sender) {
+				log.Printf("[%s] ignoring peer call announcement from non peer [%s]", r.name, evt.Sender)
+				continue
+			}
+			if err := r.service.handlePeerCall(evt.Sender, evt.Packet.PeerCall); err != nil {
+				log.Printf("[%s] peer call from [%s] failed: %v", r.name, evt.Sender, err)
 			}
 			continue
 
+		default:
+			log.Fatalf("unknown packet type [%v]", evt.Packet.Type)
+		}
+	}
+}
+
+func (r *Router) routeMedia(shard chan api.PacketEvent) {
+	for evt := range shard {
+		switch evt.Packet.Type {
 		case api.StreamMediaPacket:
+			// no logging per packet here, media drops and forwards are
+			// counted instead
 			m := evt.Packet.StreamMedia
-			log.Printf("ript_net: handle /mediaForward. SourceId [%v], SinkId [%v], SeqNo [%v]",
-				m.SourceId, m.SinkId, m.SeqNo)
 
-			for name, face := range r.faces {
-				if name == evt.Sender {
-					continue
+			route, reason := r.service.mediaTargets(evt.CallId, evt.Sender, m)
+			if reason != "" {
+				r.countDrop(reason)
+				r.auditMediaDrop(mediaDropKey{evt.Sender, callUri(evt.TgId, evt.CallId) + "/media", reason})
+				continue
+			}
+			call := route.call
+			// peers map the call by our call id
+			evt.Packet.CallId = call.id
+
+			// end-to-end encrypted payloads are forwarded as they are,
+			// the relay can't record, mix or transcode them
+			protected := m.Protected()
+
+			// each relay records its own participants, media relayed
+			// by a peer doesn't tell them apart
+			var conversion *mediaConversion
+			if r.config.Recorder != nil && !route.fromPeer && !protected {
+				if m.PayloadType != api.PayloadTypeOpus {
+					conversion = newMediaConversion(evt.Packet)
 				}
-				log.Printf("[%s] forwarding Content [%d] on [%s]", r.name, m.SeqNo, name)
-				err := face.Send(evt.Packet)
-				if err != nil {
-					r.RemoveFace(face, err)
+				r.record(call, evt.Sender, m, conversion)
+			}
+
+			// participants get the mix, peers still get the source streams
+			participants := route.participants
+			if route.mixing && !route.fromPeer && !protected && r.mix(call, evt.Sender, m.Media) {
+				participants = nil
+			} else if r.config.ActiveSpeakers > 0 {
+				participants = r.selectSpeakers(call, evt.Sender, m.AudioLevel, participants)
+			}
+			targets := append(participants, route.peers...)
+
+			// forward only within the call, in the codec negotiated
+			// for the receiver
+			for _, name := range targets {
+				pkt := evt.Packet
+				if codec, ok := route.codecs[name]; ok {
+					if protected {
+						r.countDrop(DropProtected)
+						continue
+					}
+					if conversion == nil {
+						conversion = newMediaConversion(evt.Packet)
+					}
+					var err error
+					pkt, err = r.convertMedia(call, evt.Sender, conversion, codec)
+					if err != nil {
+						log.Printf("[%s] can't transcode for [%s] in call [%s]: %v", r.name, name, call.id, err)
+						continue
+					}
 				}
+				r.send(name, pkt)
 			}
 			continue
 
 		default:
-			log.Fatalf("unknown packet type [%s]", evt.Packet.Type)
+			log.Printf("[%s] unhandled media plane packet [%v] from [%s]", r.name, evt.Packet.Type, evt.Sender)
 		}
 	}
 }
 
+// record writes the media to the call's recording. Recordings are Ogg
+// Opus, other codecs are transcoded and left out when the relay has no
+// opus codec.
+func (r *Router) record(call *Call, sender api.FaceName, m api.StreamContentMedia, conversion *mediaConversion) {
+	payload := m.Media
+	if m.PayloadType != api.PayloadTypeOpus {
+		if _, ok := r.mediaCodec("opus"); !ok {
+			return
+		}
+		pkt, err := r.convertMedia(call, sender, conversion, "opus")
+		if err != nil {
+			log.Printf("[%s] can't transcode for recording call [%s]: %v", r.name, call.id, err)
+			return
+		}
+		payload = pkt.StreamMedia.Media
+	}
+
+	source := fmt.Sprintf("%s-%d", sender, m.SourceId)
+	if err := r.config.Recorder.Write(call.tgId, call.id, source, m.SeqNo, payload); err != nil {
+		log.Printf("[%s] recording error on call [%s]: %v", r.name, call.id, err)
+	}
+}
+
+// auditMediaDrop records the first dropped packet and then one record
+// per interval, so a misbehaving face can't flood the audit log
+func (r *Router) auditMediaDrop(key mediaDropKey) {
+	n, due := r.dropAudit.drop(key, time.Now())
+	if !due {
+		return
+	}
+	log.Printf("[%s] dropping media from [%s] for [%s]: %s", r.name, key.face, key.uri, mediaDropDetail(key.reason, n))
+	r.config.Audit.Log(audit.Record{
+		Event:  audit.EventAuthFailure,
+		Face:   string(key.face),
+		Uri:    key.uri,
+		Detail: mediaDropDetail(key.reason, n),
+	})
+}
+
+func (r *Router) mediaShard(callId string) chan api.PacketEvent {
+	h := fnv.New32a()
+	h.Write([]byte(callId))
+	return r.mediaShards[h.Sum32()%uint32(len(r.mediaShards))]
+}
+
+// queue a packet for the face, if it is still around
+func (r *Router) send(name api.FaceName, packet api.Packet) {
+	r.faceLock.RLock()
+	queue, ok := r.queues[name]
+	r.faceLock.RUnlock()
+	if !ok {
+		log.Printf("[%s] dropping packet [%v], face [%s] is gone", r.name, packet.Type, name)
+		return
+	}
+
+	if !queue.enqueue(packet) {
+		// media drops are only counted, a log line each would add to
+		// the overload
+		if !isMediaPacket(packet.Type) {
+			log.Printf("[%s] send queue full on face [%s], dropped [%v]", r.name, name, packet.Type)
+		}
+		return
+	}
+	r.countForwarded(packet)
+}
+
+// QueueDepths returns the current send queue depths per face
+func (r *Router) QueueDepths() map[api.FaceName]QueueDepth {
+	r.faceLock.RLock()
+	defer r.faceLock.RUnlock()
+	depths := make(map[api.FaceName]QueueDepth, len(r.queues))
+	for name, queue := range r.queues {
+		depths[name] = queue.depth()
+	}
+	return depths
+}
+
+func (r *Router) countDrop(reason DropReason) {
+	r.dropLock.Lock()
+	r.drops[reason]++
+	r.dropLock.Unlock()
+}
+
+// Drops returns the number of dropped packets by reason
+func (r *Router) Drops() map[DropReason]uint64 {
+	r.dropLock.Lock()
+	defer r.dropLock.Unlock()
+	drops := make(map[DropReason]uint64, len(r.drops))
+	for reason, count := range r.drops {
+		drops[reason] = count
+	}
+	return drops
+}
+
 func (r *Router) RemoveFace(face Face, err error) {
 	r.faceLock.Lock()
+	if _, ok := r.faces[face.Name()]; !ok {
+		r.faceLock.Unlock()
+		return
+	}
 	log.Printf("[%s] Removing face [%s] [%v]", r.name, face.Name(), err)
 	delete(r.faces, face.Name())
+	if done, ok := r.intakes[face.Name()]; ok {
+		close(done)
+		delete(r.intakes, face.Name())
+	}
+	if queue, ok := r.queues[face.Name()]; ok {
+		queue.close()
+		delete(r.queues, face.Name())
+	}
+	delete(r.peers, face.Name())
 	r.faceLock.Unlock()
+
+	if peer, ok := face.(PeerFace); ok && peer.PeerUrl() != "" {
+		go r.dialPeer(peer.PeerUrl(), peerRedialInterval)
+	}
+
+	detail := ""
+	if err != nil {
+		detail = err.Error()
+	}
+	for key, n := range r.dropAudit.forget(face.Name()) {
+		r.config.Audit.Log(audit.Record{
+			Event:  audit.EventAuthFailure,
+			Face:   string(key.face),
+			Uri:    key.uri,
+			Detail: mediaDropDetail(key.reason, n),
+		})
+	}
+	r.config.Audit.Log(audit.Record{
+		Event:  audit.EventFaceLeft,
+		Face:   string(face.Name()),
+		Detail: detail,
+	})
+
+	r.service.removeParticipant(face.Name())
 }
 
 func (r *Router) AddFace(face Face) {
 	r.faceLock.Lock()
 	log.Printf("[%s] Adding face [%s]\n", r.name, face.Name())
-	face.SetReceiveChan(r.recvChan)
+	intake := make(chan api.PacketEvent, faceIntakeSize)
+	done := make(chan struct{})
+	r.intakes[face.Name()] = done
+	face.SetReceiveChan(intake)
+	go r.admit(face, intake, done)
 	r.faces[face.Name()] = face
+	r.queues[face.Name()] = newSendQueue(face, r.config.SendQueue, r.RemoveFace, func() {
+		r.countDrop(DropQueueFull)
+	})
+	peer, isPeer := face.(PeerFace)
+	if isPeer {
+		r.peers[face.Name()] = peer
+	}
 	r.faceLock.Unlock()
 
+	// bring the new peer up to date
+	if isPeer {
+		for _, msg := range r.service.localCalls() {
+			msg.Relay = r.name
+			r.sendPeerCall(face.Name(), msg)
+		}
+	}
+
+	r.config.Audit.Log(audit.Record{
+		Event: audit.EventFaceJoined,
+		Face:  string(face.Name()),
+	})
+
 	go r.awaitFaceClose(face)
 }
 
+// admit applies the face's rate limits (if any) and hands packets to the
+// signaling or media plane. A flooding face only fills its own intake queue.
+func (r *Router) admit(face Face, intake chan api.PacketEvent, done chan struct{}) {
+	limits := r.config.RateLimits
+	if _, isPeer := face.(PeerFace); isPeer {
+		limits = r.config.PeerRateLimits
+	}
+	limiter := newFaceLimiter(limits, time.Now())
+	for {
+		select {
+		case <-done:
+			return
+		case evt := <-intake:
+			disconnect, err := limiter.admit(evt.Packet, time.Now())
+			if err == nil {
+				plane := r.signalingChan
+				if isMediaPacket(evt.Packet.Type) {
+					plane = r.mediaShard(evt.CallId)
+				}
+				select {
+				case plane <- evt:
+				case <-done:
+					return
+				}
+				continue
+			}
+
+			log.Printf("[%s] rate limit hit on face [%s], dropping packet [%v]: %v",
+				r.name, face.Name(), evt.Packet.Type, err)
+			r.countDrop(DropRateLimited)
+			if disconnect {
+				err = fmt.Errorf("rate limit violations exceeded [%d]: %v", limiter.violations, err)
+				face.Close(err)
+				r.RemoveFace(face, err)
+				return
+			}
+		}
+	}
+}
+
 func (r *Router) awaitFaceClose(face Face) {
 	err := <-face.OnClose()
 	r.RemoveFace(face, err)
@@ -0,0 +1,86 @@
+package ript_net
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+// face that counts the media it is sent
+type countingFace struct {
+	*testFace
+	count *int64
+}
+
+func (f *countingFace) Send(pkt api.Packet) error {
+	if pkt.Type != api.StreamMediaPacket {
+		return f.testFace.Send(pkt)
+	}
+	atomic.AddInt64(f.count, 1)
+	return nil
+}
+
+// benchRouterMedia pushes media through calls of two participants each,
+// with one sender goroutine per call. Logging is left as in production,
+// so that per packet logging shows up in the numbers.
+func benchRouterMedia(b *testing.B, workers, calls int) {
+	r := NewRouterWithConfig("bench", NewRIPTService(), RouterConfig{
+		MediaWorkers: workers,
+		SendQueue:    SendQueueConfig{Size: 1000, SignalingPolicy: NeverDrop},
+	})
+	var delivered int64
+
+	senders := make([]*testFace, calls)
+	callIds := make([]string, calls)
+	var media api.StreamContentMedia
+	for i := 0; i < calls; i++ {
+		sender := newTestFace(fmt.Sprintf("sender%d", i))
+		receiver := newTestFace(fmt.Sprintf("receiver%d", i))
+		r.AddFace(sender)
+		r.AddFace(&countingFace{testFace: receiver, count: &delivered})
+		call := joinCall(b, sender, "")
+		joinCall(b, receiver, call.CallUri)
+
+		directive, err := call.ClientDirective.Parse()
+		if err != nil {
+			b.Fatal(err)
+		}
+		media = api.StreamContentMedia{
+			SourceId: directive.SourceId,
+			SinkId:   directive.SinkId,
+			Media:    make([]byte, 160),
+		}
+		senders[i] = sender
+		callIds[i] = api.CallIdFromUri(call.CallUri)
+	}
+
+	perCall := b.N/calls + 1
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < perCall; n++ {
+				sendMedia(senders[i], callIds[i], media)
+			}
+		}(i)
+	}
+	wg.Wait()
+	// dropped packets are done with as well
+	for atomic.LoadInt64(&delivered)+int64(r.Drops()[DropQueueFull]) < int64(perCall*calls) {
+		runtime.Gosched()
+	}
+}
+
+func BenchmarkRouterMediaSingleWorker(b *testing.B) {
+	benchRouterMedia(b, 1, 64)
+}
+
+func BenchmarkRouterMediaSharded(b *testing.B) {
+	benchRouterMedia(b, runtime.NumCPU(), 64)
+}
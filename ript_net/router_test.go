@@ -0,0 +1,335 @@
+package ript_net
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+const testAdvertisement = "1 in: opus;\n" + "2 out: opus;\n"
+
+func awaitPacket(t testing.TB, face *testFace, pktType api.PacketType) api.Packet {
+	t.Helper()
+	select {
+	case pkt := <-face.sent:
+		if pkt.Type != pktType {
+			t.Fatalf("[%s] unexpected packet [%v], expected [%v]", face.name, pkt.Type, pktType)
+		}
+		return pkt
+	case <-time.After(2 * time.Second):
+		t.Fatalf("[%s] timed out waiting for [%v]", face.name, pktType)
+	}
+	return api.Packet{}
+}
+
+func expectNoPacket(t *testing.T, face *testFace) {
+	t.Helper()
+	select {
+	case pkt := <-face.sent:
+		t.Fatalf("[%s] unexpected packet [%v]", face.name, pkt.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// registers a handler and joins the call at callUri, or places a new call
+// if empty, returns the call response
+func joinCall(t testing.TB, face *testFace, callUri string) api.CallResponse {
+	t.Helper()
+	return joinCallWith(t, face, callUri, testAdvertisement)
+}
+
+func joinCallWith(t testing.TB, face *testFace, callUri, advertisement string) api.CallResponse {
+	t.Helper()
+	face.receive(api.Packet{
+		Type: api.RegisterHandlerPacket,
+		RegisterHandler: api.RegisterHandlerMessage{
+			HandlerRequest: api.HandlerRequest{
+				HandlerId:     string(face.name),
+				Advertisement: advertisement,
+			},
+		},
+	})
+	reg := awaitPacket(t, face, api.RegisterHandlerPacket)
+
+	face.recvChan <- api.PacketEvent{
+		Sender: face.name,
+		TgId:   defaultTrunkGroupId,
+		Packet: api.Packet{
+			Type: api.CallsPacket,
+			Calls: api.CallsMessage{
+				Request: api.CallRequest{
+					HandlerUri:  reg.RegisterHandler.HandlerResponse.Uri,
+					Destination: "meeting@example.com",
+					CallUri:     callUri,
+				},
+			},
+		},
+	}
+	return awaitPacket(t, face, api.CallsPacket).Calls.Response
+}
+
+// signaling is processed independently of the media plane, wait for
+// the call membership to settle before sending media
+func awaitMembers(t *testing.T, r *Router, callId string, members int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(r.service.callMembers(callId)) != members {
+		if time.Now().After(deadline) {
+			t.Fatalf("call [%s] did not reach [%d] members, has [%v]", callId, members, r.service.callMembers(callId))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func sendMedia(face *testFace, callId string, m api.StreamContentMedia) {
+	face.recvChan <- api.PacketEvent{
+		Sender: face.name,
+		CallId: callId,
+		Packet: api.Packet{
+			Type:        api.StreamMediaPacket,
+			StreamMedia: m,
+		},
+	}
+}
+
+func TestRouterMediaAuthorization(t *testing.T) {
+	r := NewRouter("test", NewRIPTService())
+
+	alice := newTestFace("alice")
+	bob := newTestFace("bob")
+	mallory := newTestFace("mallory")
+	r.AddFace(alice)
+	r.AddFace(bob)
+	r.AddFace(mallory)
+
+	call := joinCall(t, alice, "")
+	if bobCall := joinCall(t, bob, call.CallUri); bobCall.CallUri != call.CallUri {
+		t.Fatalf("expected to join the call [%s] != [%s]", bobCall.CallUri, call.CallUri)
+	}
+
+	directive, err := call.ClientDirective.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	callId := api.CallIdFromUri(call.CallUri)
+	media := api.StreamContentMedia{
+		SourceId: directive.SourceId,
+		SinkId:   directive.SinkId,
+		Media:    []byte{1, 2, 3},
+	}
+
+	// not a participant
+	sendMedia(mallory, callId, media)
+	// unknown call
+	sendMedia(alice, "no-such-call", media)
+	// ids never negotiated
+	bogus := media
+	bogus.SourceId = 42
+	sendMedia(alice, callId, bogus)
+	expectNoPacket(t, bob)
+
+	sendMedia(alice, callId, media)
+	fwd := awaitPacket(t, bob, api.StreamMediaPacket)
+	if fwd.StreamMedia.SourceId != media.SourceId {
+		t.Fatalf("unexpected media forwarded [%v]", fwd.StreamMedia)
+	}
+
+	drops := r.Drops()
+	for _, reason := range []DropReason{DropNotParticipant, DropUnknownCall, DropNotNegotiated} {
+		if drops[reason] != 1 {
+			t.Fatalf("expected one drop for [%s], got [%d]", reason, drops[reason])
+		}
+	}
+}
+
+func TestRouterForwardsWithinCall(t *testing.T) {
+	r := NewRouter("test", NewRIPTService())
+
+	alice := newTestFace("alice")
+	bob := newTestFace("bob")
+	carol := newTestFace("carol")
+	r.AddFace(alice)
+	r.AddFace(bob)
+	r.AddFace(carol)
+
+	call := joinCall(t, alice, "")
+	joinCall(t, bob, call.CallUri)
+	// same destination, but not asking to join
+	other := joinCall(t, carol, "")
+	if other.CallUri == call.CallUri {
+		t.Fatalf("expected separate calls")
+	}
+
+	directive, err := call.ClientDirective.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	callId := api.CallIdFromUri(call.CallUri)
+	media := api.StreamContentMedia{
+		SourceId: directive.SourceId,
+		SinkId:   directive.SinkId,
+	}
+
+	sendMedia(alice, callId, media)
+	awaitPacket(t, bob, api.StreamMediaPacket)
+	expectNoPacket(t, carol)
+	expectNoPacket(t, alice)
+
+	// after hangup bob no longer receives the call's media
+	bob.recvChan <- api.PacketEvent{
+		Sender: bob.name,
+		CallId: callId,
+		Packet: api.Packet{Type: api.CallHangupPacket},
+	}
+	// hangup is signaling, processed independently of the media plane
+	awaitMembers(t, r, callId, 1)
+	sendMedia(alice, callId, media)
+	expectNoPacket(t, bob)
+}
+
+func TestJoinNeedsTheCallUri(t *testing.T) {
+	r := NewRouter("test", NewRIPTService())
+	alice := newTestFace("alice")
+	mallory := newTestFace("mallory")
+	r.AddFace(alice)
+	r.AddFace(mallory)
+
+	call := joinCall(t, alice, "")
+	uri := call.CallUri[:strings.LastIndex(call.CallUri, "/")+1] + "no-such-call"
+	if res := joinCall(t, mallory, uri); res.CallUri != "" {
+		t.Fatalf("joined unknown call [%s]", res.CallUri)
+	}
+	if members := r.service.callMembers(api.CallIdFromUri(call.CallUri)); len(members) != 1 {
+		t.Fatalf("unexpected members %v", members)
+	}
+}
+
+// refused requests are answered with the reason
+func TestRouterRepliesWithRefusals(t *testing.T) {
+	r := NewRouter("test", NewRIPTService())
+	alice := newTestFace("alice")
+	r.AddFace(alice)
+
+	alice.recvChan <- api.PacketEvent{
+		Sender: alice.name,
+		TgId:   "no-such-trunk",
+		Packet: api.Packet{
+			Type: api.RegisterHandlerPacket,
+			RegisterHandler: api.RegisterHandlerMessage{
+				HandlerRequest: api.HandlerRequest{HandlerId: "alice"},
+			},
+		},
+	}
+	if pkt := awaitPacket(t, alice, api.RegisterHandlerPacket); pkt.Error != errUnknownTrunkGroup.Error() {
+		t.Fatalf("unexpected registration error [%s]", pkt.Error)
+	}
+
+	alice.recvChan <- api.PacketEvent{
+		Sender: alice.name,
+		TgId:   defaultTrunkGroupId,
+		Packet: api.Packet{
+			Type:  api.CallsPacket,
+			Calls: api.CallsMessage{Request: api.CallRequest{HandlerUri: "no-such-handler"}},
+		},
+	}
+	if pkt := awaitPacket(t, alice, api.CallsPacket); pkt.Error != errUnknownHandler.Error() {
+		t.Fatalf("unexpected calls error [%s]", pkt.Error)
+	}
+
+	alice.receive(api.Packet{
+		Type: api.RegisterHandlerPacket,
+		RegisterHandler: api.RegisterHandlerMessage{
+			HandlerRequest: api.HandlerRequest{HandlerId: "alice", Advertisement: testAdvertisement},
+		},
+	})
+	reg := awaitPacket(t, alice, api.RegisterHandlerPacket)
+	alice.recvChan <- api.PacketEvent{
+		Sender: alice.name,
+		TgId:   defaultTrunkGroupId,
+		Packet: api.Packet{
+			Type: api.CallsPacket,
+			Calls: api.CallsMessage{Request: api.CallRequest{
+				HandlerUri: reg.RegisterHandler.HandlerResponse.Uri,
+				CallUri:    callUri(defaultTrunkGroupId, "no-such-call"),
+			}},
+		},
+	}
+	if pkt := awaitPacket(t, alice, api.CallsPacket); pkt.Error != errUnknownCallToJoin.Error() {
+		t.Fatalf("unexpected join error [%s]", pkt.Error)
+	}
+}
+
+// ws clients send their requests without a trunk group
+func TestRouterWithWebSocketFace(t *testing.T) {
+	r := NewRouter("test", NewRIPTService())
+
+	wss := &WebSocketFaceServer{feedChan: make(chan Face, 1)}
+	server := httptest.NewServer(wss)
+	defer server.Close()
+	client, err := NewWebSocketClientFace("ws" + strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(nil)
+	recv := make(chan api.PacketEvent, 10)
+	client.SetReceiveChan(recv)
+	r.AddFace(<-wss.Feed())
+
+	await := func(pktType api.PacketType) api.Packet {
+		t.Helper()
+		select {
+		case evt := <-recv:
+			if evt.Packet.Type != pktType {
+				t.Fatalf("unexpected packet [%v], expected [%v]", evt.Packet.Type, pktType)
+			}
+			return evt.Packet
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for [%v]", pktType)
+		}
+		return api.Packet{}
+	}
+
+	client.Send(api.Packet{
+		Type: api.RegisterHandlerPacket,
+		RegisterHandler: api.RegisterHandlerMessage{
+			HandlerRequest: api.HandlerRequest{HandlerId: "ws", Advertisement: testAdvertisement},
+		},
+	})
+	reg := await(api.RegisterHandlerPacket)
+	client.Send(api.Packet{
+		Type: api.CallsPacket,
+		Calls: api.CallsMessage{
+			Request: api.CallRequest{HandlerUri: reg.RegisterHandler.HandlerResponse.Uri},
+		},
+	})
+	call := await(api.CallsPacket).Calls.Response
+	if call.CallUri == "" {
+		t.Fatalf("ws face could not place a call")
+	}
+	callId := api.CallIdFromUri(call.CallUri)
+
+	bob := newTestFace("bob")
+	r.AddFace(bob)
+	joinCall(t, bob, call.CallUri)
+	awaitMembers(t, r, callId, 2)
+
+	directive, err := call.ClientDirective.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Send(api.Packet{
+		Type:   api.StreamMediaPacket,
+		CallId: callId,
+		StreamMedia: api.StreamContentMedia{
+			SeqNo:    1,
+			SourceId: directive.SourceId,
+			SinkId:   directive.SinkId,
+		},
+	})
+	if pkt := awaitPacket(t, bob, api.StreamMediaPacket); pkt.StreamMedia.SeqNo != 1 {
+		t.Fatalf("unexpected media [%+v]", pkt.StreamMedia)
+	}
+}
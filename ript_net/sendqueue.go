@@ -0,0 +1,189 @@
+package ript_net
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+// Outbound queue per face, drained by its own goroutine so that a slow
+// receiver can't stall the router. Signaling and media are queued
+// separately, signaling is always sent first.
+
+const defaultSendQueueSize = 50
+
+var errSendQueueOverflow = errors.New("ript_net: send queue overflow")
+
+type DropPolicy int
+
+const (
+	// discard the oldest queued packet to make room
+	DropOldest DropPolicy = iota
+	// discard the packet being queued
+	DropNewest
+	// never drop, the face is closed once its queue overflows
+	NeverDrop
+)
+
+func ParseDropPolicy(s string) (DropPolicy, error) {
+	switch s {
+	case "oldest":
+		return DropOldest, nil
+	case "newest":
+		return DropNewest, nil
+	case "never":
+		return NeverDrop, nil
+	}
+	return DropOldest, fmt.Errorf("unknown drop policy [%s]", s)
+}
+
+type SendQueueConfig struct {
+	// capacity of each (signaling and media) queue, 0 picks the default
+	Size            int
+	MediaPolicy     DropPolicy
+	SignalingPolicy DropPolicy
+}
+
+// DefaultSendQueueConfig drops the oldest media and never drops signaling
+func DefaultSendQueueConfig() SendQueueConfig {
+	return SendQueueConfig{
+		Size:            defaultSendQueueSize,
+		MediaPolicy:     DropOldest,
+		SignalingPolicy: NeverDrop,
+	}
+}
+
+type QueueDepth struct {
+	Signaling int
+	Media     int
+}
+
+type sendQueue struct {
+	face      Face
+	config    SendQueueConfig
+	lock      sync.Mutex
+	cond      *sync.Cond
+	signaling []api.Packet
+	media     []api.Packet
+	closed    bool
+	// invoked when the face fails to send, or its never drop queue
+	// overflows
+	onError func(Face, error)
+	// invoked for every packet dropped by the policy
+	onDrop func()
+}
+
+func newSendQueue(face Face, config SendQueueConfig, onError func(Face, error), onDrop func()) *sendQueue {
+	if config.Size <= 0 {
+		config.Size = defaultSendQueueSize
+	}
+	q := &sendQueue{
+		face:    face,
+		config:  config,
+		onError: onError,
+		onDrop:  onDrop,
+	}
+	q.cond = sync.NewCond(&q.lock)
+	go q.drain()
+	return q
+}
+
+// enqueue applies the drop policy when the queue is full. Returns
+// false if the packet (or an older one) was dropped. Never blocks, a
+// face that can't keep up with a never drop queue gets closed instead.
+func (q *sendQueue) enqueue(pkt api.Packet) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return false
+	}
+
+	queue, policy := &q.signaling, q.config.SignalingPolicy
+	if isMediaPacket(pkt.Type) {
+		queue, policy = &q.media, q.config.MediaPolicy
+	} else if isAdvisoryPacket(pkt) && policy == NeverDrop {
+		// not worth closing the face over
+		policy = DropNewest
+	}
+
+	full := len(*queue) >= q.config.Size
+	if full && policy == NeverDrop {
+		q.closeLocked()
+		// the callbacks take the router's locks, which the caller may hold
+		go func() {
+			q.face.Close(errSendQueueOverflow)
+			q.onError(q.face, errSendQueueOverflow)
+		}()
+		return false
+	}
+	if full {
+		q.onDrop()
+		if policy == DropNewest {
+			return false
+		}
+		*queue = (*queue)[1:]
+	}
+
+	*queue = append(*queue, pkt)
+	q.cond.Broadcast()
+	return !full
+}
+
+func (q *sendQueue) depth() QueueDepth {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return QueueDepth{
+		Signaling: len(q.signaling),
+		Media:     len(q.media),
+	}
+}
+
+func (q *sendQueue) close() {
+	q.lock.Lock()
+	q.closeLocked()
+	q.lock.Unlock()
+}
+
+// Needs lock held.
+func (q *sendQueue) closeLocked() {
+	q.closed = true
+	q.signaling = nil
+	q.media = nil
+	q.cond.Broadcast()
+}
+
+func (q *sendQueue) next() (api.Packet, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for !q.closed && len(q.signaling) == 0 && len(q.media) == 0 {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return api.Packet{}, false
+	}
+
+	var pkt api.Packet
+	if len(q.signaling) > 0 {
+		pkt, q.signaling = q.signaling[0], q.signaling[1:]
+	} else {
+		pkt, q.media = q.media[0], q.media[1:]
+	}
+	return pkt, true
+}
+
+func (q *sendQueue) drain() {
+	for {
+		pkt, ok := q.next()
+		if !ok {
+			return
+		}
+		if err := q.face.Send(pkt); err != nil {
+			q.onError(q.face, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package ript_net
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+// face whose Send blocks until released, like a receiver that stopped pulling
+type stalledFace struct {
+	*testFace
+	release chan struct{}
+}
+
+func newStalledFace(name string) *stalledFace {
+	return &stalledFace{
+		testFace: newTestFace(name),
+		release:  make(chan struct{}),
+	}
+}
+
+func (f *stalledFace) Send(pkt api.Packet) error {
+	<-f.release
+	return f.testFace.Send(pkt)
+}
+
+func TestSendQueueDropPolicies(t *testing.T) {
+	face := newStalledFace("stalled")
+	drops := 0
+	q := newSendQueue(face, SendQueueConfig{
+		Size:            2,
+		MediaPolicy:     DropOldest,
+		SignalingPolicy: NeverDrop,
+	}, func(Face, error) {}, func() { drops++ })
+	defer q.close()
+
+	// first packet is picked up by the drain goroutine and stuck in Send
+	q.enqueue(api.Packet{Type: api.StreamMediaPacket, StreamMedia: api.StreamContentMedia{SeqNo: 0}})
+	time.Sleep(50 * time.Millisecond)
+
+	for i := uint64(1); i <= 4; i++ {
+		q.enqueue(api.Packet{Type: api.StreamMediaPacket, StreamMedia: api.StreamContentMedia{SeqNo: i}})
+	}
+	q.enqueue(api.Packet{Type: api.CallsPacket})
+
+	if d := q.depth(); d.Media != 2 || d.Signaling != 1 {
+		t.Fatalf("unexpected depth [%+v]", d)
+	}
+	if drops != 2 {
+		t.Fatalf("expected 2 drops, got [%d]", drops)
+	}
+
+	close(face.release)
+	// stuck packet, then signaling ahead of the remaining (newest) media
+	expected := []api.Packet{
+		{Type: api.StreamMediaPacket, StreamMedia: api.StreamContentMedia{SeqNo: 0}},
+		{Type: api.CallsPacket},
+		{Type: api.StreamMediaPacket, StreamMedia: api.StreamContentMedia{SeqNo: 3}},
+		{Type: api.StreamMediaPacket, StreamMedia: api.StreamContentMedia{SeqNo: 4}},
+	}
+	for _, e := range expected {
+		pkt := awaitPacket(t, face.testFace, e.Type)
+		if pkt.StreamMedia.SeqNo != e.StreamMedia.SeqNo {
+			t.Fatalf("unexpected SeqNo [%d], expected [%d]", pkt.StreamMedia.SeqNo, e.StreamMedia.SeqNo)
+		}
+	}
+}
+
+func TestSendQueueNeverDropClosesOnOverflow(t *testing.T) {
+	face := newStalledFace("stalled")
+	defer close(face.release)
+	failed := make(chan error, 1)
+	q := newSendQueue(face, SendQueueConfig{
+		Size:            1,
+		SignalingPolicy: NeverDrop,
+	}, func(_ Face, err error) { failed <- err }, func() {})
+
+	// one stuck in Send, one queued
+	q.enqueue(api.Packet{Type: api.CallsPacket})
+	time.Sleep(50 * time.Millisecond)
+	q.enqueue(api.Packet{Type: api.CallsPacket})
+
+	done := make(chan bool)
+	go func() { done <- q.enqueue(api.Packet{Type: api.CallsPacket}) }()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatalf("expected the overflowing packet to be refused")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("enqueue blocked on a full never drop queue")
+	}
+
+	for _, ch := range []chan error{face.closed, failed} {
+		select {
+		case err := <-ch:
+			if err != errSendQueueOverflow {
+				t.Fatalf("unexpected error [%v]", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("face not closed on overflow")
+		}
+	}
+	if q.enqueue(api.Packet{Type: api.CallsPacket}) {
+		t.Fatalf("closed queue accepted a packet")
+	}
+}
+
+func TestSendQueueDropsActiveSpeakersWhenFull(t *testing.T) {
+	face := newStalledFace("stalled")
+	defer close(face.release)
+	q := newSendQueue(face, SendQueueConfig{
+		Size:            1,
+		SignalingPolicy: NeverDrop,
+	}, func(_ Face, err error) { t.Errorf("face failed [%v]", err) }, func() {})
+	defer q.close()
+
+	speakers := api.Packet{
+		Type:      api.CallEventPacket,
+		CallEvent: api.CallEvent{Type: api.CallEventActiveSpeakers},
+	}
+	q.enqueue(speakers)
+	time.Sleep(50 * time.Millisecond)
+	q.enqueue(speakers)
+	if q.enqueue(speakers) {
+		t.Fatalf("expected the speakers event to be dropped")
+	}
+	select {
+	case err := <-face.closed:
+		t.Fatalf("face closed over a speakers event [%v]", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRouterNotStalledBySlowFace(t *testing.T) {
+	r := NewRouter("test", NewRIPTService())
+
+	alice := newTestFace("alice")
+	bob := newTestFace("bob")
+	slow := newStalledFace("slow")
+	defer close(slow.release)
+	r.AddFace(alice)
+	r.AddFace(bob)
+	r.AddFace(slow)
+
+	call := joinCall(t, alice, "")
+	joinCall(t, bob, call.CallUri)
+	// slow face joins too, but never gets its responses delivered
+	slow.recvChan <- api.PacketEvent{
+		Sender: slow.name,
+		TgId:   defaultTrunkGroupId,
+		Packet: api.Packet{
+			Type: api.CallsPacket,
+			Calls: api.CallsMessage{Request: api.CallRequest{
+				HandlerUri:  joinHandlerUri(t, r, bob),
+				Destination: "meeting@example.com",
+				CallUri:     call.CallUri,
+			}},
+		},
+	}
+
+	directive, err := call.ClientDirective.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	callId := api.CallIdFromUri(call.CallUri)
+	awaitMembers(t, r, callId, 3)
+	for i := 0; i < 3*defaultSendQueueSize; i++ {
+		sendMedia(alice, callId, api.StreamContentMedia{
+			SeqNo:    uint64(i),
+			SourceId: directive.SourceId,
+			SinkId:   directive.SinkId,
+		})
+		awaitPacket(t, bob, api.StreamMediaPacket)
+	}
+
+	depth := r.QueueDepths()[slow.name]
+	if depth.Media != defaultSendQueueSize {
+		t.Fatalf("unexpected slow face depth [%+v]", depth)
+	}
+	if r.Drops()[DropQueueFull] == 0 {
+		t.Fatalf("expected queue drops to be counted")
+	}
+}
+
+// registers another handler over the given (responsive) face
+func joinHandlerUri(t *testing.T, r *Router, face *testFace) string {
+	face.receive(api.Packet{
+		Type: api.RegisterHandlerPacket,
+		RegisterHandler: api.RegisterHandlerMessage{
+			HandlerRequest: api.HandlerRequest{
+				HandlerId:     "slow-handler",
+				Advertisement: testAdvertisement,
+			},
+		},
+	})
+	return awaitPacket(t, face, api.RegisterHandlerPacket).RegisterHandler.HandlerResponse.Uri
+}
@@ -1,10 +1,13 @@
 package ript_net
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 
 	"github.com/WhatIETF/goRIPT/api"
+	"github.com/WhatIETF/goRIPT/audit"
 	"github.com/google/uuid"
 )
 
@@ -16,7 +19,17 @@ const (
 	baseTrunkGroupsUrl          = baseUrl + "/providertgs"
 	defaultTrunkGroupId         = "trunkAbc"
 	trunkGroupDirectionOutbound = "outbound"
-	defaultTrunkMediaCap        = "1 out: opus;\n" + "2 out: opus;\n"
+	defaultTrunkMediaCap        = "1 out: opus; PCMU; PCMA;\n" + "2 out: opus; PCMU; PCMA;\n"
+)
+
+// why the service refused a handler registration or /calls request, the
+// router replies with them in the packet's Error
+var (
+	errUnknownTrunkGroup = errors.New("ript_net: unknown trunkGroupId")
+	errUnknownHandler    = errors.New("ript_net: incorrect handler for /calls")
+	errUnknownCallToJoin = errors.New("ript_net: unknown call to join")
+	errBadAdvertisement  = errors.New("ript_net: bad handler advertisement")
+	errNoMatchingCaps    = errors.New("ript_net: no matching caps found")
 )
 
 type TrunkGroupDirection string
@@ -26,7 +39,8 @@ type TrunkGroup struct {
 	uri       string
 	direction string
 	mediaCap  api.Advertisement
-	call      Call
+	// new calls are mixed by the relay, guarded by callLock
+	mixing bool
 }
 
 // Handler Information
@@ -35,19 +49,48 @@ type Handler struct {
 	adRaw  api.Advertisement
 	adInfo api.AdvertisementInfo
 	uri    string
+	// trunk group the handler was registered on
+	tgId string
 }
 
 // capture service representation
 // direction, allowed identities, allowed numbers, media capabilities of the service
 type Call struct {
-	id  string
-	uri string
+	id          string
+	uri         string
+	tgId        string
+	destination string
+	// faces in the call along with the directives negotiated for them
+	participants map[api.FaceName][]api.DirectiveInfo
+	// ids the participants are known by to the others, face names are
+	// transport addresses
+	participantIds map[api.FaceName]string
+	// peer relays serving the same call, mapped to the peer's call id
+	peers map[api.FaceName]string
+	// participants get a single mixed stream instead of every source
+	mixing bool
+	// loudness of the sources, for selective forwarding
+	speakers *speakerTracker
 }
 
 /// local cache (replace this with db or file/json store)
 type RIPTService struct {
 	trunkGroups map[string]*TrunkGroup
+	handlerLock sync.RWMutex
 	handlers    map[string]Handler
+	// calls are read by the media shards concurrently
+	callLock sync.RWMutex
+	calls    map[string]*Call
+	// peer relay call ids onto local calls
+	peerCalls map[peerCallKey]*Call
+	audit     *audit.Logger
+	// calls that gained their first or lost their last local participant,
+	// to announce to peers. Guarded by callLock, announceReady is
+	// signaled when there are some (nil without a router).
+	announcements []api.PeerCallMessage
+	announceReady chan struct{}
+	// invoked when a call ends
+	onCallEnded func(callId string)
 }
 
 func NewRIPTService() *RIPTService {
@@ -65,14 +108,21 @@ func NewRIPTService() *RIPTService {
 	return &RIPTService{
 		trunkGroups: tgs,
 		handlers:    map[string]Handler{},
+		calls:       map[string]*Call{},
+		peerCalls:   map[peerCallKey]*Call{},
 	}
 }
 
+// SetAuditLogger enables audit records for handler and call activity
+func (s *RIPTService) SetAuditLogger(l *audit.Logger) {
+	s.audit = l
+}
+
 // TODO: handle error processing
 func (s *RIPTService) handle(pkt api.Packet) {
 	switch pkt.Type {
 	case api.RegisterHandlerPacket:
-		s.registerHandler(pkt.RegisterHandler)
+		s.registerHandler("", "", pkt.RegisterHandler)
 	default:
 		log.Fatalf("riptService: Unknown pakcet type [%v]", pkt.Type)
 	}
@@ -93,17 +143,27 @@ func (s *RIPTService) listTrunkGroups() api.TrunkGroupsInfoMessage {
 	}
 }
 
-func (s *RIPTService) registerHandler(message api.RegisterHandlerMessage) (api.RegisterHandlerMessage, error) {
+// registerHandler registers the handler on the trunk group, ws faces name
+// none and get the default one
+func (s *RIPTService) registerHandler(sender api.FaceName, tgId string, message api.RegisterHandlerMessage) (api.RegisterHandlerMessage, error) {
+	if tgId == "" {
+		tgId = defaultTrunkGroupId
+	}
+	if _, ok := s.trunkGroups[tgId]; !ok {
+		return api.RegisterHandlerMessage{}, errUnknownTrunkGroup
+	}
+
 	hId, err := uuid.NewUUID()
 	if err != nil {
-		return api.RegisterHandlerMessage{}, nil
+		return api.RegisterHandlerMessage{}, fmt.Errorf("ript_net: handlerId gen failure")
 	}
 
-	uri := baseTrunkGroupsUrl + "/" + defaultTrunkGroupId + "/" + hId.String()
+	uri := baseTrunkGroupsUrl + "/" + tgId + "/" + hId.String()
 	ad := api.Advertisement(message.HandlerRequest.Advertisement)
 	parsed, err := ad.Parse()
 	if err != nil {
-		return api.RegisterHandlerMessage{}, nil
+		log.Printf("service: bad advertisement from [%s]: %v", sender, err)
+		return api.RegisterHandlerMessage{}, errBadAdvertisement
 	}
 
 	h := Handler{
@@ -111,11 +171,20 @@ func (s *RIPTService) registerHandler(message api.RegisterHandlerMessage) (api.R
 		adRaw:  ad,
 		adInfo: parsed,
 		uri:    uri,
+		tgId:   tgId,
 	}
 
 	log.Printf("service: created handler [%v]", h)
 
+	s.handlerLock.Lock()
 	s.handlers[message.HandlerRequest.HandlerId] = h
+	s.handlerLock.Unlock()
+	s.audit.Log(audit.Record{
+		Event:  audit.EventHandlerRegistered,
+		Face:   string(sender),
+		Uri:    uri,
+		Detail: h.id,
+	})
 
 	// send the response message
 	return api.RegisterHandlerMessage{
@@ -125,17 +194,25 @@ func (s *RIPTService) registerHandler(message api.RegisterHandlerMessage) (api.R
 	}, nil
 }
 
-func (s *RIPTService) processCalls(tgId string, message api.CallsMessage) (api.CallsMessage, error) {
-	// get tg
-	tg, ok := s.trunkGroups[tgId]
-	if !ok {
-		return api.CallsMessage{}, fmt.Errorf("ript_net: unknown trunkGroupId for /calls")
+func (s *RIPTService) processCalls(sender api.FaceName, tgId string, message api.CallsMessage) (api.CallsMessage, error) {
+	response, err := s.setupCall(sender, tgId, message)
+	if err != nil {
+		s.audit.Log(audit.Record{
+			Event:  audit.EventCallRejected,
+			Face:   string(sender),
+			Uri:    message.Request.HandlerUri,
+			Detail: err.Error(),
+		})
 	}
+	return response, err
+}
 
+func (s *RIPTService) setupCall(sender api.FaceName, tgId string, message api.CallsMessage) (api.CallsMessage, error) {
 	handlerUrl := message.Request.HandlerUri
 	//retrieve caps for this handler
 	var handler Handler
 	var found = false
+	s.handlerLock.RLock()
 	for _, h := range s.handlers {
 		if h.uri == handlerUrl {
 			handler = h
@@ -143,35 +220,66 @@ func (s *RIPTService) processCalls(tgId string, message api.CallsMessage) (api.C
 			break
 		}
 	}
+	s.handlerLock.RUnlock()
 
 	if !found {
-		return api.CallsMessage{}, fmt.Errorf("ript_net: incorrect handler for /calls")
+		return api.CallsMessage{}, errUnknownHandler
+	}
+
+	// ws faces have no per trunk group resources, their calls go to the
+	// handler's trunk group
+	if tgId == "" {
+		tgId = handler.tgId
+	}
+	tg, ok := s.trunkGroups[tgId]
+	if !ok {
+		return api.CallsMessage{}, errUnknownTrunkGroup
 	}
 
 	// match the caps
 	directives, ok := Match(tg.mediaCap, handler.adRaw)
 	if !ok {
-		return api.CallsMessage{}, fmt.Errorf("ript_net: no matching caps found")
+		return api.CallsMessage{}, errNoMatchingCaps
 	}
 
-	// since we have a match, generate a new Call object
-	callId, err := uuid.NewUUID()
+	s.callLock.Lock()
+	defer s.callLock.Unlock()
+
+	var call *Call
+	var err error
+	if message.Request.CallUri != "" {
+		call, err = s.callToJoin(tgId, message.Request.CallUri)
+	} else {
+		call, err = s.createCall(sender, tgId, message.Request.Destination, "")
+	}
 	if err != nil {
-		return api.CallsMessage{}, fmt.Errorf("ript_net: callId gen failure")
+		return api.CallsMessage{}, err
 	}
 
-	uri := baseTrunkGroupsUrl + "/" + tgId + "/calls/" + callId.String()
-
-	call := Call{
-		id:  callId.String(),
-		uri: uri,
+	participantId, ok := call.participantIds[sender]
+	if !ok {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return api.CallsMessage{}, fmt.Errorf("ript_net: participantId gen failure")
+		}
+		participantId = id.String()
+		call.participantIds[sender] = participantId
+	}
+	call.participants[sender] = directives
+	log.Printf("service: [%s] joined call [%s] as [%s]", sender, call.id, participantId)
+	s.audit.Log(audit.Record{
+		Event:  audit.EventCallJoined,
+		Face:   string(sender),
+		Uri:    call.uri,
+		Detail: handler.uri,
+	})
+	if len(call.participants) == 1 {
+		s.notifyLocalCall(call, true)
 	}
-
-	// save the call on the trunk
-	tg.call = call
 
 	response := api.CallResponse{
 		CallUri:         call.uri,
+		ParticipantId:   participantId,
 		ClientDirective: directives[0].GenServerDirectives(),
 		ServerDirective: directives[0].GenServerDirectives(),
 	}
@@ -179,10 +287,310 @@ func (s *RIPTService) processCalls(tgId string, message api.CallsMessage) (api.C
 	return api.CallsMessage{Response: response}, nil
 }
 
+// callToJoin returns the call at uri. Call ids are random, knowing the uri
+// of a call is what allows joining it. Needs callLock held.
+func (s *RIPTService) callToJoin(tgId, uri string) (*Call, error) {
+	call, ok := s.calls[api.CallIdFromUri(uri)]
+	if !ok || call.uri != uri || call.tgId != tgId {
+		log.Printf("service: unknown call [%s] to join", uri)
+		return nil, errUnknownCallToJoin
+	}
+	return call, nil
+}
+
+// createCall places a new call, with a random id unless given one (a peer
+// relay's). Needs callLock held.
+func (s *RIPTService) createCall(creator api.FaceName, tgId, destination, callId string) (*Call, error) {
+	if callId == "" {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return nil, fmt.Errorf("ript_net: callId gen failure")
+		}
+		callId = id.String()
+	}
+
+	call := &Call{
+		id:             callId,
+		uri:            callUri(tgId, callId),
+		tgId:           tgId,
+		destination:    destination,
+		participants:   map[api.FaceName][]api.DirectiveInfo{},
+		participantIds: map[api.FaceName]string{},
+		peers:          map[api.FaceName]string{},
+		mixing:         s.trunkGroups[tgId].mixing,
+		speakers:       newSpeakerTracker(),
+	}
+	s.calls[call.id] = call
+	log.Printf("service: created call [%s] to [%s]", call.id, call.destination)
+	s.audit.Log(audit.Record{
+		Event:  audit.EventCallCreated,
+		Face:   string(creator),
+		Uri:    call.uri,
+		Detail: call.destination,
+	})
+	return call, nil
+}
+
+// Where to forward a media packet to
+type mediaRoute struct {
+	call         *Call
+	participants []api.FaceName
+	peers        []api.FaceName
+	mixing       bool
+	// participants that negotiated another codec than the media's
+	codecs map[api.FaceName]string
+	// media relayed by a peer, only goes to local participants
+	fromPeer bool
+}
+
+// mediaTargets checks that the sender is a participant of the call
+// and the media carries ids negotiated for it, and returns the local call
+// and the other participants to forward to. A non empty DropReason
+// means the packet must not be forwarded.
+func (s *RIPTService) mediaTargets(callId string, sender api.FaceName, m api.StreamContentMedia) (mediaRoute, DropReason) {
+	s.callLock.RLock()
+	defer s.callLock.RUnlock()
+
+	if call, ok := s.peerCall(sender, callId); ok {
+		if _, ok := call.peers[sender]; !ok {
+			return mediaRoute{}, DropNotParticipant
+		}
+		// the remote participants negotiated with the same trunk group,
+		// so their sources are ones our participants were given too
+		if !peerSourceNegotiated(call, m.SourceId) {
+			return mediaRoute{}, DropNotNegotiated
+		}
+		// split horizon: peers forward their own participants' media
+		// to every other relay already
+		route := mediaRoute{call: call, mixing: call.mixing, fromPeer: true}
+		for face := range call.participants {
+			route.participants = append(route.participants, face)
+		}
+		route.codecs = participantCodecs(call, route.participants, m.PayloadType)
+		return route, ""
+	}
+
+	call, ok := s.calls[callId]
+	if !ok {
+		return mediaRoute{}, DropUnknownCall
+	}
+	directives, ok := call.participants[sender]
+	if !ok {
+		return mediaRoute{}, DropNotParticipant
+	}
+
+	negotiated := false
+	for _, d := range directives {
+		if d.SourceId == m.SourceId && d.SinkId == m.SinkId {
+			negotiated = true
+			break
+		}
+	}
+	if !negotiated {
+		return mediaRoute{}, DropNotNegotiated
+	}
+
+	route := mediaRoute{call: call, mixing: call.mixing}
+	for face := range call.participants {
+		if face != sender {
+			route.participants = append(route.participants, face)
+		}
+	}
+	for peer := range call.peers {
+		route.peers = append(route.peers, peer)
+	}
+	route.codecs = participantCodecs(call, route.participants, m.PayloadType)
+	return route, ""
+}
+
+// Needs callLock held.
+func peerSourceNegotiated(call *Call, sourceId uint8) bool {
+	for _, directives := range call.participants {
+		for _, d := range directives {
+			if d.SourceId == sourceId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// participantCodecs lists the faces that negotiated another codec than
+// the media's, nil if there are none. Needs callLock held.
+func participantCodecs(call *Call, faces []api.FaceName, payloadType uint32) map[api.FaceName]string {
+	codec := api.PayloadTypeCodec(payloadType)
+	if codec == "" {
+		return nil
+	}
+	var codecs map[api.FaceName]string
+	for _, face := range faces {
+		directives := call.participants[face]
+		if len(directives) == 0 || directives[0].Codec.Codec == codec {
+			continue
+		}
+		if codecs == nil {
+			codecs = map[api.FaceName]string{}
+		}
+		codecs[face] = directives[0].Codec.Codec
+	}
+	return codecs
+}
+
+// callMembers returns the faces participating in the call
+func (s *RIPTService) callMembers(callId string) []api.FaceName {
+	s.callLock.RLock()
+	defer s.callLock.RUnlock()
+
+	call, ok := s.calls[callId]
+	if !ok {
+		return nil
+	}
+
+	members := make([]api.FaceName, 0, len(call.participants))
+	for face := range call.participants {
+		members = append(members, face)
+	}
+	return members
+}
+
+// counts returns the number of active calls and registered handlers
+func (s *RIPTService) counts() (calls, handlers int) {
+	s.callLock.RLock()
+	calls = len(s.calls)
+	s.callLock.RUnlock()
+	s.handlerLock.RLock()
+	handlers = len(s.handlers)
+	s.handlerLock.RUnlock()
+	return calls, handlers
+}
+
+// participantIds maps the faces to their participant ids in the call,
+// leaving out faces that aren't participants (peers)
+func (s *RIPTService) participantIds(callId string, faces []api.FaceName) []string {
+	s.callLock.RLock()
+	defer s.callLock.RUnlock()
+
+	call, ok := s.calls[callId]
+	if !ok {
+		return nil
+	}
+	ids := make([]string, 0, len(faces))
+	for _, face := range faces {
+		if id, ok := call.participantIds[face]; ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// participantDirective returns the first directive negotiated for the face
+func (s *RIPTService) participantDirective(callId string, face api.FaceName) (api.DirectiveInfo, bool) {
+	s.callLock.RLock()
+	defer s.callLock.RUnlock()
+
+	call, ok := s.calls[callId]
+	if !ok || len(call.participants[face]) == 0 {
+		return api.DirectiveInfo{}, false
+	}
+	return call.participants[face][0], true
+}
+
+// SetTrunkGroupMixing selects mixing for calls set up on the trunk group from now on
+func (s *RIPTService) SetTrunkGroupMixing(tgId string, mixing bool) error {
+	s.callLock.Lock()
+	defer s.callLock.Unlock()
+
+	tg, ok := s.trunkGroups[tgId]
+	if !ok {
+		return fmt.Errorf("ript_net: unknown trunkGroupId [%s]", tgId)
+	}
+	tg.mixing = mixing
+	return nil
+}
+
+// SetCallMixing switches mixing of an ongoing call
+func (s *RIPTService) SetCallMixing(callId string, mixing bool) error {
+	s.callLock.Lock()
+	defer s.callLock.Unlock()
+
+	call, ok := s.calls[callId]
+	if !ok {
+		return fmt.Errorf("ript_net: unknown call [%s]", callId)
+	}
+	call.mixing = mixing
+	return nil
+}
+
+// leaveCall handles hangup of a face from the given call
+func (s *RIPTService) leaveCall(callId string, face api.FaceName) error {
+	s.callLock.Lock()
+	defer s.callLock.Unlock()
+
+	call, ok := s.calls[callId]
+	if !ok {
+		return fmt.Errorf("ript_net: unknown call [%s]", callId)
+	}
+	if _, ok := call.participants[face]; !ok {
+		return fmt.Errorf("ript_net: [%s] is not in call [%s]", face, callId)
+	}
+	s.removeFromCall(call, face)
+	return nil
+}
+
+// removeParticipant drops the face from all the calls it joined.
+func (s *RIPTService) removeParticipant(face api.FaceName) {
+	s.callLock.Lock()
+	defer s.callLock.Unlock()
+
+	for _, call := range s.calls {
+		if _, ok := call.participants[face]; ok {
+			s.removeFromCall(call, face)
+		}
+		if _, ok := call.peers[face]; ok {
+			s.removePeerFromCall(call, face)
+		}
+	}
+}
+
+// Calls without participants are ended. Needs callLock held.
+func (s *RIPTService) removeFromCall(call *Call, face api.FaceName) {
+	delete(call.participants, face)
+	delete(call.participantIds, face)
+	log.Printf("service: [%s] left call [%s]", face, call.id)
+	s.audit.Log(audit.Record{
+		Event: audit.EventCallLeft,
+		Face:  string(face),
+		Uri:   call.uri,
+	})
+	if len(call.participants) == 0 {
+		s.notifyLocalCall(call, false)
+	}
+	s.endCallIfEmpty(call)
+}
+
+// Needs callLock held.
+func (s *RIPTService) endCallIfEmpty(call *Call) {
+	if len(call.participants) == 0 && len(call.peers) == 0 {
+		delete(s.calls, call.id)
+		log.Printf("service: ended call [%s]", call.id)
+		s.audit.Log(audit.Record{
+			Event: audit.EventCallEnded,
+			Uri:   call.uri,
+		})
+		if s.onCallEnded != nil {
+			s.onCallEnded(call.id)
+		}
+	}
+}
+
 /////
 // Helpers
 ////
 
+func callUri(tgId, callId string) string {
+	return baseTrunkGroupsUrl + "/" + tgId + "/calls/" + callId
+}
+
 // Crude and incorrect match implementation. Needs to be redone
 func Match(s, o api.Advertisement) ([]api.DirectiveInfo, bool) {
 	source, err := s.Parse()
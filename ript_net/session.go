@@ -0,0 +1,131 @@
+package ript_net
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+// Faces of request/response transports, identified by the session token
+// issued on join rather than the client's address, which changes with
+// connection migration and NAT rebinding.
+
+const sessionTokenSize = 16
+
+type faceSessions struct {
+	lock  sync.RWMutex
+	faces map[string]Face
+}
+
+func newFaceSessions() *faceSessions {
+	return &faceSessions{faces: map[string]Face{}}
+}
+
+func newSessionToken() (string, error) {
+	token := make([]byte, sessionTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// add returns the new session's token
+func (s *faceSessions) add(face Face) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+	s.lock.Lock()
+	s.faces[token] = face
+	s.lock.Unlock()
+	return token, nil
+}
+
+// lookup returns the face of the request's session, nil if none
+func (s *faceSessions) lookup(request *http.Request) (string, Face) {
+	token := request.Header.Get(api.SessionHeader)
+	if token == "" {
+		return "", nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return token, s.faces[token]
+}
+
+func (s *faceSessions) remove(token string) {
+	s.lock.Lock()
+	delete(s.faces, token)
+	s.lock.Unlock()
+}
+
+// removeIf drops the sessions whose face matches, returns the faces
+func (s *faceSessions) removeIf(match func(Face) bool) []Face {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var removed []Face
+	for token, face := range s.faces {
+		if match(face) {
+			removed = append(removed, face)
+			delete(s.faces, token)
+		}
+	}
+	return removed
+}
+
+// Tracks whether a session is in use: a request or an open stream. Clients
+// that crash or lose the network simply stop using it.
+type sessionActivity struct {
+	lock       sync.Mutex
+	streams    int
+	lastActive time.Time
+	// client address of the QUIC connection last used, empty over TCP
+	conn string
+}
+
+func (a *sessionActivity) touch() {
+	a.lock.Lock()
+	a.lastActive = time.Now()
+	a.lock.Unlock()
+}
+
+// usedConn notes the QUIC connection the session was used over
+func (a *sessionActivity) usedConn(addr string) {
+	a.lock.Lock()
+	a.conn = addr
+	a.lock.Unlock()
+}
+
+// lastConn returns the client address of the QUIC connection last used
+func (a *sessionActivity) lastConn() string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.conn
+}
+
+func (a *sessionActivity) streamStarted() {
+	a.lock.Lock()
+	a.streams++
+	a.lastActive = time.Now()
+	a.lock.Unlock()
+}
+
+func (a *sessionActivity) streamEnded() {
+	a.lock.Lock()
+	a.streams--
+	a.lastActive = time.Now()
+	a.lock.Unlock()
+}
+
+// idle returns for how long the session has been unused at now
+func (a *sessionActivity) idle(now time.Time) time.Duration {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.streams > 0 {
+		return 0
+	}
+	return now.Sub(a.lastActive)
+}
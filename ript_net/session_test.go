@@ -0,0 +1,73 @@
+package ript_net
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+func TestFaceSessions(t *testing.T) {
+	sessions := newFaceSessions()
+	face := newTestFace("alice")
+	token, err := sessions.add(face)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := sessions.add(newTestFace("bob"))
+	if token == other || len(token) != 2*sessionTokenSize {
+		t.Fatalf("bad tokens [%s] [%s]", token, other)
+	}
+
+	req := httptest.NewRequest("GET", "/media/leave", nil)
+	if _, found := sessions.lookup(req); found != nil {
+		t.Fatalf("found face without a token")
+	}
+
+	req.Header.Set(api.SessionHeader, token)
+	if _, found := sessions.lookup(req); found != face {
+		t.Fatalf("unexpected face [%v]", found)
+	}
+
+	sessions.remove(token)
+	if _, found := sessions.lookup(req); found != nil {
+		t.Fatalf("found face of a removed session")
+	}
+}
+
+func TestSessionActivity(t *testing.T) {
+	var activity sessionActivity
+	activity.touch()
+	later := time.Now().Add(time.Minute)
+	if idle := activity.idle(later); idle < time.Minute-time.Second {
+		t.Fatalf("unexpected idle time [%v]", idle)
+	}
+
+	// open streams keep the session in use
+	activity.streamStarted()
+	if idle := activity.idle(later); idle != 0 {
+		t.Fatalf("idle [%v] with an open stream", idle)
+	}
+	activity.streamEnded()
+	if idle := activity.idle(later); idle == 0 {
+		t.Fatalf("not idle after the stream ended")
+	}
+}
+
+func TestFaceSessionsRemoveIf(t *testing.T) {
+	sessions := newFaceSessions()
+	alice, bob := newTestFace("alice"), newTestFace("bob")
+	sessions.add(alice)
+	bobToken, _ := sessions.add(bob)
+
+	removed := sessions.removeIf(func(face Face) bool { return face == alice })
+	if len(removed) != 1 || removed[0] != alice {
+		t.Fatalf("unexpected removal [%v]", removed)
+	}
+	req := httptest.NewRequest("GET", "/media/leave", nil)
+	req.Header.Set(api.SessionHeader, bobToken)
+	if _, found := sessions.lookup(req); found != bob {
+		t.Fatalf("lost the other session")
+	}
+}
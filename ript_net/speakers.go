@@ -0,0 +1,150 @@
+package ript_net
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+// Active speaker detection for selective forwarding. Every source's
+// audio level is smoothed, and only the N loudest sources are forwarded
+// to each receiver. Sources that stopped sending drop out after a while.
+
+const (
+	// weight of the newest level in the moving average
+	speakerSmoothing = 0.3
+	speakerTimeout   = time.Second
+)
+
+type speakerLevel struct {
+	level    float64
+	lastSeen time.Time
+}
+
+type speakerTracker struct {
+	lock    sync.Mutex
+	sources map[api.FaceName]*speakerLevel
+	// loudest first
+	active []api.FaceName
+}
+
+func newSpeakerTracker() *speakerTracker {
+	return &speakerTracker{
+		sources: map[api.FaceName]*speakerLevel{},
+	}
+}
+
+// update records the level of a packet from the source and returns the
+// ranking of the current sources (loudest first), and whether the top n
+// changed.
+func (t *speakerTracker) update(source api.FaceName, level uint8, n int, now time.Time) ([]api.FaceName, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if level == api.AudioLevelUnknown {
+		level = api.AudioLevelSilence
+	}
+
+	s, ok := t.sources[source]
+	if !ok {
+		s = &speakerLevel{level: float64(level)}
+		t.sources[source] = s
+	}
+	s.level = speakerSmoothing*float64(level) + (1-speakerSmoothing)*s.level
+	s.lastSeen = now
+
+	ranking := make([]api.FaceName, 0, len(t.sources))
+	for name, s := range t.sources {
+		if now.Sub(s.lastSeen) > speakerTimeout {
+			delete(t.sources, name)
+			continue
+		}
+		ranking = append(ranking, name)
+	}
+	sort.Slice(ranking, func(i, j int) bool {
+		li, lj := t.sources[ranking[i]].level, t.sources[ranking[j]].level
+		if li != lj {
+			return li > lj
+		}
+		// keep the order stable between equally loud sources
+		return ranking[i] < ranking[j]
+	})
+
+	top := ranking
+	if len(top) > n {
+		top = top[:n]
+	}
+	changed := len(top) != len(t.active)
+	for i := 0; !changed && i < len(top); i++ {
+		changed = top[i] != t.active[i]
+	}
+	if changed {
+		t.active = append([]api.FaceName(nil), top...)
+	}
+	return ranking, changed
+}
+
+// isAdvisoryPacket tells packets that the next one supersedes, which are
+// dropped rather than held for a receiver that is behind
+func isAdvisoryPacket(pkt api.Packet) bool {
+	return pkt.Type == api.CallEventPacket && pkt.CallEvent.Type == api.CallEventActiveSpeakers
+}
+
+// selectSpeakers narrows the receivers of a source's media to those it
+// is among the loudest for, announcing changes of the active speakers
+func (r *Router) selectSpeakers(call *Call, source api.FaceName, level uint8, receivers []api.FaceName) []api.FaceName {
+	n := r.config.ActiveSpeakers
+	ranking, changed := call.speakers.update(source, level, n, time.Now())
+	if changed {
+		top := ranking
+		if len(top) > n {
+			top = top[:n]
+		}
+		active := r.service.participantIds(call.id, top)
+		log.Printf("[%s] active speakers in call [%s]: %v", r.name, call.id, active)
+		// sent on the media shard, the send queue drops these when
+		// the receiver is behind rather than waiting
+		for _, member := range r.service.callMembers(call.id) {
+			r.send(member, api.Packet{
+				Type:   api.CallEventPacket,
+				CallId: call.id,
+				CallEvent: api.CallEvent{
+					Type:           api.CallEventActiveSpeakers,
+					ActiveSpeakers: active,
+				},
+			})
+		}
+	}
+	return selectTargets(source, ranking, receivers, n)
+}
+
+// selectTargets keeps the receivers the source is among the n loudest
+// for, not counting the receiver itself
+func selectTargets(source api.FaceName, ranking []api.FaceName, receivers []api.FaceName, n int) []api.FaceName {
+	rank := make(map[api.FaceName]int, len(ranking))
+	for i, name := range ranking {
+		rank[name] = i
+	}
+	sourceRank, ok := rank[source]
+	if !ok {
+		return nil
+	}
+	if sourceRank < n {
+		return receivers
+	}
+	if sourceRank > n {
+		return nil
+	}
+
+	// just outside the top n, which still counts for receivers in it
+	var targets []api.FaceName
+	for _, name := range receivers {
+		if r, ok := rank[name]; ok && r < n {
+			targets = append(targets, name)
+		}
+	}
+	return targets
+}
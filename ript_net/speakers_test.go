@@ -0,0 +1,95 @@
+package ript_net
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+func TestSelectTargets(t *testing.T) {
+	ranking := []api.FaceName{"alice", "bob", "carol", "dave"}
+	receivers := []api.FaceName{"alice", "bob", "carol", "dave", "eve"}
+	tests := []struct {
+		source   api.FaceName
+		expected []api.FaceName
+	}{
+		{"alice", receivers},
+		{"bob", receivers},
+		// third loudest is heard by the two loudest
+		{"carol", []api.FaceName{"alice", "bob"}},
+		{"dave", nil},
+		{"eve", nil},
+	}
+	for _, test := range tests {
+		targets := selectTargets(test.source, ranking, receivers, 2)
+		if !reflect.DeepEqual(targets, test.expected) {
+			t.Fatalf("[%s]: got %v, expected %v", test.source, targets, test.expected)
+		}
+	}
+}
+
+func TestSpeakerTrackerRanking(t *testing.T) {
+	tracker := newSpeakerTracker()
+	now := time.Now()
+
+	if _, changed := tracker.update("alice", 60, 1, now); !changed {
+		t.Fatalf("expected first speaker to change the top")
+	}
+	ranking, changed := tracker.update("bob", 120, 1, now)
+	if !changed || !reflect.DeepEqual(ranking, []api.FaceName{"bob", "alice"}) {
+		t.Fatalf("unexpected ranking %v, changed [%v]", ranking, changed)
+	}
+	if _, changed := tracker.update("bob", 120, 1, now); changed {
+		t.Fatalf("unexpected change")
+	}
+
+	// bob goes quiet, and eventually stops sending
+	ranking, _ = tracker.update("alice", 60, 1, now.Add(2*speakerTimeout))
+	if !reflect.DeepEqual(ranking, []api.FaceName{"alice"}) {
+		t.Fatalf("unexpected ranking %v", ranking)
+	}
+}
+
+func TestRouterForwardsActiveSpeakers(t *testing.T) {
+	r := NewRouterWithConfig("test", NewRIPTService(), RouterConfig{ActiveSpeakers: 1})
+
+	faces := map[string]*testFace{}
+	ids := map[string]string{}
+	var call api.CallResponse
+	for _, name := range []string{"alice", "bob", "carol"} {
+		faces[name] = newTestFace(name)
+		r.AddFace(faces[name])
+		call = joinCall(t, faces[name], call.CallUri)
+		ids[name] = call.ParticipantId
+	}
+	callId := api.CallIdFromUri(call.CallUri)
+	directive, err := call.ClientDirective.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(name string, level uint8) {
+		sendMedia(faces[name], callId, api.StreamContentMedia{
+			SourceId:   directive.SourceId,
+			SinkId:     directive.SinkId,
+			AudioLevel: level,
+		})
+	}
+
+	send("alice", 100)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		pkt := awaitPacket(t, faces[name], api.CallEventPacket)
+		// by participant id, face names are addresses
+		if !reflect.DeepEqual(pkt.CallEvent.ActiveSpeakers, []string{ids["alice"]}) {
+			t.Fatalf("unexpected active speakers %v", pkt.CallEvent.ActiveSpeakers)
+		}
+	}
+	awaitPacket(t, faces["bob"], api.StreamMediaPacket)
+	awaitPacket(t, faces["carol"], api.StreamMediaPacket)
+
+	// quieter bob is only heard by alice
+	send("bob", 20)
+	awaitPacket(t, faces["alice"], api.StreamMediaPacket)
+	expectNoPacket(t, faces["carol"])
+}
@@ -0,0 +1,33 @@
+package ript_net
+
+import (
+	"log"
+	"net/http"
+)
+
+// The h3 routes are also served over TLS on TCP, HTTP/2 or HTTP/1.1, for
+// networks that block UDP. The faces behind both are the same, sessions
+// are tied to the token rather than the connection.
+
+// transport the request came over, reported by the face it joined
+func requestTransport(r *http.Request) string {
+	switch r.ProtoMajor {
+	case 3:
+		return "h3"
+	case 2:
+		return "h2"
+	default:
+		return "http1"
+	}
+}
+
+// altSvcHandler has every response point the client at h3, setHeaders
+// being the h3 server's SetQuicHeaders
+func altSvcHandler(h http.Handler, setHeaders func(http.Header) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := setHeaders(w.Header()); err != nil {
+			log.Printf("can't advertise h3: %v", err)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,40 @@
+package ript_net
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTCPFallbackHandler(t *testing.T) {
+	var transport string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		transport = requestTransport(r)
+	})
+	setHeaders := func(hdr http.Header) error {
+		hdr.Add("Alt-Svc", `h3-27=":2399"; ma=2592000`)
+		return nil
+	}
+
+	server := httptest.NewUnstartedServer(altSvcHandler(h, setHeaders))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL + "/media/join")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || transport != "h2" {
+		t.Fatalf("expected h2, got [%s] [%s]", resp.Proto, transport)
+	}
+	if alt := resp.Header.Get("Alt-Svc"); alt != `h3-27=":2399"; ma=2592000` {
+		t.Fatalf("unexpected Alt-Svc [%s]", alt)
+	}
+
+	req := httptest.NewRequest("GET", "/media/join", nil)
+	if requestTransport(req) != "http1" {
+		t.Fatalf("expected http1")
+	}
+}
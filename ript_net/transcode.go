@@ -0,0 +1,278 @@
+package ript_net
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/WhatIETF/goRIPT/api"
+	"github.com/WhatIETF/goRIPT/g711"
+	"github.com/WhatIETF/goRIPT/mixer"
+)
+
+// Transcoding between the codecs negotiated for the participants of a
+// call, so e.g. a G.711 trunk can talk to opus handlers. Media is decoded
+// once per packet and re-encoded once per target codec. Opus needs the
+// relay side codec, G.711 μ-law and A-law are always available.
+
+const (
+	// longest frame accepted, 120ms
+	maxFrameMs = 120
+	// largest encoded frame
+	maxEncodedFrame = 1275
+)
+
+type mediaCodec struct {
+	codec      mixer.Codec
+	sampleRate int
+}
+
+func g711Codec(law g711.Law) mediaCodec {
+	c := g711.Codec{Law: law}
+	return mediaCodec{
+		codec: mixer.Codec{
+			NewDecoder: func() (mixer.Decoder, error) { return c, nil },
+			NewEncoder: func() (mixer.Encoder, error) { return c, nil },
+		},
+		sampleRate: g711.SampleRate,
+	}
+}
+
+func (r *Router) mediaCodec(name string) (mediaCodec, bool) {
+	switch name {
+	case "PCMU":
+		return g711Codec(g711.Ulaw), true
+	case "PCMA":
+		return g711Codec(g711.Alaw), true
+	case "opus":
+		if r.config.OpusCodec != nil {
+			return mediaCodec{codec: *r.config.OpusCodec, sampleRate: OpusSampleRate}, true
+		}
+	}
+	return mediaCodec{}, false
+}
+
+type transcodeKey struct {
+	source api.FaceName
+	codec  string
+}
+
+// per call codec state, codecs like opus are stateful so every source
+// keeps its own decoder and encoders
+type transcoder struct {
+	lock     sync.Mutex
+	decoders map[transcodeKey]mixer.Decoder
+	encoders map[transcodeKey]mixer.Encoder
+}
+
+func (r *Router) transcoder(callId string) *transcoder {
+	r.transcodeLock.Lock()
+	defer r.transcodeLock.Unlock()
+	t, ok := r.transcoders[callId]
+	if !ok {
+		t = &transcoder{
+			decoders: map[transcodeKey]mixer.Decoder{},
+			encoders: map[transcodeKey]mixer.Encoder{},
+		}
+		r.transcoders[callId] = t
+	}
+	return t
+}
+
+// mediaConversion is a packet being converted for its receivers. Its
+// media is decoded once, and encoded once per target codec.
+type mediaConversion struct {
+	pkt api.Packet
+	// decoded frames and their rate, nil until first needed
+	pcm        [][]int16
+	sampleRate int
+	err        error
+	done       map[string]api.Packet
+}
+
+func newMediaConversion(pkt api.Packet) *mediaConversion {
+	return &mediaConversion{
+		pkt:  pkt,
+		done: map[string]api.Packet{},
+	}
+}
+
+// convertMedia returns the packet with its media in the target codec
+func (r *Router) convertMedia(call *Call, source api.FaceName, c *mediaConversion, to string) (api.Packet, error) {
+	if converted, ok := c.done[to]; ok {
+		return converted, nil
+	}
+
+	toCodec, ok := r.mediaCodec(to)
+	payloadType, known := api.CodecPayloadType(to)
+	if !ok || !known {
+		return api.Packet{}, fmt.Errorf("can't encode [%s]", to)
+	}
+
+	t := r.transcoder(call.id)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// the source's decoder is stateful, it must see every packet once
+	if c.pcm == nil && c.err == nil {
+		c.pcm, c.sampleRate, c.err = r.decodeMedia(t, source, c.pkt.StreamMedia)
+	}
+	if c.err != nil {
+		return api.Packet{}, c.err
+	}
+
+	encoder, err := t.encoder(transcodeKey{source, to}, toCodec)
+	if err != nil {
+		return api.Packet{}, err
+	}
+
+	converted := make([][]byte, len(c.pcm))
+	for i, frame := range c.pcm {
+		pcm := resample(frame, c.sampleRate, toCodec.sampleRate)
+		out := make([]byte, maxEncodedFrame)
+		if len(pcm) > len(out) {
+			out = make([]byte, len(pcm))
+		}
+		n, err := encoder.Encode(pcm, out)
+		if err != nil {
+			return api.Packet{}, err
+		}
+		converted[i] = out[:n]
+	}
+
+	pkt := c.pkt
+	m := pkt.StreamMedia
+	m.PayloadType = payloadType
+	m.Media = api.PackFrames(converted)
+	pkt.StreamMedia = m
+	c.done[to] = pkt
+	return pkt, nil
+}
+
+// decodeMedia decodes the frames of the media with the source's decoder,
+// returning them along with their rate. Needs the transcoder's lock held.
+func (r *Router) decodeMedia(t *transcoder, source api.FaceName, m api.StreamContentMedia) ([][]int16, int, error) {
+	from := api.PayloadTypeCodec(m.PayloadType)
+	fromCodec, ok := r.mediaCodec(from)
+	if !ok {
+		return nil, 0, fmt.Errorf("can't decode [%s]", from)
+	}
+	frames, err := api.UnpackFrames(m.Media)
+	if err != nil {
+		return nil, 0, err
+	}
+	decoder, err := t.decoder(transcodeKey{source, from}, fromCodec)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	decoded := make([][]int16, len(frames))
+	for i, frame := range frames {
+		pcm := make([]int16, fromCodec.sampleRate*maxFrameMs/1000)
+		n, err := decoder.Decode(frame, pcm)
+		if err != nil {
+			return nil, 0, err
+		}
+		decoded[i] = pcm[:n]
+	}
+	return decoded, fromCodec.sampleRate, nil
+}
+
+// Needs lock held.
+func (t *transcoder) decoder(key transcodeKey, codec mediaCodec) (mixer.Decoder, error) {
+	if d, ok := t.decoders[key]; ok {
+		return d, nil
+	}
+	d, err := codec.codec.NewDecoder()
+	if err != nil {
+		return nil, err
+	}
+	t.decoders[key] = d
+	return d, nil
+}
+
+// Needs lock held.
+func (t *transcoder) encoder(key transcodeKey, codec mediaCodec) (mixer.Encoder, error) {
+	if e, ok := t.encoders[key]; ok {
+		return e, nil
+	}
+	e, err := codec.codec.NewEncoder()
+	if err != nil {
+		return nil, err
+	}
+	t.encoders[key] = e
+	return e, nil
+}
+
+// resamplingCodec runs the codec at another rate, for mixing
+func resamplingCodec(c mediaCodec, rate int) mixer.Codec {
+	return mixer.Codec{
+		NewDecoder: func() (mixer.Decoder, error) {
+			d, err := c.codec.NewDecoder()
+			if err != nil {
+				return nil, err
+			}
+			return resamplingDecoder{d, c.sampleRate, rate}, nil
+		},
+		NewEncoder: func() (mixer.Encoder, error) {
+			e, err := c.codec.NewEncoder()
+			if err != nil {
+				return nil, err
+			}
+			return resamplingEncoder{e, rate, c.sampleRate}, nil
+		},
+	}
+}
+
+type resamplingDecoder struct {
+	mixer.Decoder
+	from, to int
+}
+
+func (d resamplingDecoder) Decode(frame []byte, pcm []int16) (int, error) {
+	buf := make([]int16, d.from*maxFrameMs/1000)
+	n, err := d.Decoder.Decode(frame, buf)
+	if err != nil {
+		return 0, err
+	}
+	return copy(pcm, resample(buf[:n], d.from, d.to)), nil
+}
+
+type resamplingEncoder struct {
+	mixer.Encoder
+	from, to int
+}
+
+func (e resamplingEncoder) Encode(pcm []int16, frame []byte) (int, error) {
+	return e.Encoder.Encode(resample(pcm, e.from, e.to), frame)
+}
+
+// resample averages when downsampling and interpolates linearly when
+// upsampling
+func resample(pcm []int16, from, to int) []int16 {
+	if from == to || len(pcm) == 0 {
+		return pcm
+	}
+
+	out := make([]int16, len(pcm)*to/from)
+	for i := range out {
+		if to < from {
+			start, end := i*from/to, (i+1)*from/to
+			var sum int
+			for _, v := range pcm[start:end] {
+				sum += int(v)
+			}
+			out[i] = int16(sum / (end - start))
+			continue
+		}
+
+		pos := float64(i) * float64(from) / float64(to)
+		j := int(pos)
+		if j+1 >= len(pcm) {
+			out[i] = pcm[len(pcm)-1]
+			continue
+		}
+		frac := pos - float64(j)
+		out[i] = int16(float64(pcm[j])*(1-frac) + float64(pcm[j+1])*frac)
+	}
+	return out
+}
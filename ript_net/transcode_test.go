@@ -0,0 +1,232 @@
+package ript_net
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/WhatIETF/goRIPT/api"
+	"github.com/WhatIETF/goRIPT/g711"
+	"github.com/WhatIETF/goRIPT/mixer"
+	"github.com/WhatIETF/goRIPT/recording"
+)
+
+func TestResample(t *testing.T) {
+	up := resample([]int16{0, 100, 200}, 8000, 16000)
+	if len(up) != 6 || up[1] != 50 || up[2] != 100 || up[5] != 200 {
+		t.Fatalf("unexpected upsampling %v", up)
+	}
+	down := resample([]int16{0, 100, 200, 300}, 16000, 8000)
+	if len(down) != 2 || down[0] != 50 || down[1] != 250 {
+		t.Fatalf("unexpected downsampling %v", down)
+	}
+}
+
+func TestRouterTranscodesBetweenG711Laws(t *testing.T) {
+	r := NewRouter("test", NewRIPTService())
+
+	alice := newTestFace("alice")
+	bob := newTestFace("bob")
+	r.AddFace(alice)
+	r.AddFace(bob)
+
+	call := joinCallWith(t, alice, "", "1 in: PCMU;\n2 out: PCMU;\n")
+	joinCallWith(t, bob, call.CallUri, "1 in: PCMA;\n2 out: PCMA;\n")
+	callId := api.CallIdFromUri(call.CallUri)
+	awaitMembers(t, r, callId, 2)
+
+	pcm := []int16{0, 1000, -1000, 32000, -32000}
+	ulaw := make([]byte, len(pcm))
+	g711.Codec{Law: g711.Ulaw}.Encode(pcm, ulaw)
+
+	directive, err := call.ClientDirective.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMedia(alice, callId, api.StreamContentMedia{
+		PayloadType: api.PayloadTypePCMU,
+		SourceId:    directive.SourceId,
+		SinkId:      directive.SinkId,
+		Media:       api.PackFrames([][]byte{ulaw}),
+	})
+
+	pkt := awaitPacket(t, bob, api.StreamMediaPacket)
+	if pkt.StreamMedia.PayloadType != api.PayloadTypePCMA {
+		t.Fatalf("unexpected payload type [%d]", pkt.StreamMedia.PayloadType)
+	}
+	frames, err := api.UnpackFrames(pkt.StreamMedia.Media)
+	if err != nil || len(frames) != 1 {
+		t.Fatalf("bad payload [%v]", err)
+	}
+
+	expected := make([]byte, len(pcm))
+	decoded := make([]int16, len(pcm))
+	g711.Codec{Law: g711.Ulaw}.Decode(ulaw, decoded)
+	g711.Codec{Law: g711.Alaw}.Encode(decoded, expected)
+	if string(frames[0]) != string(expected) {
+		t.Fatalf("unexpected transcoding [%x], expected [%x]", frames[0], expected)
+	}
+}
+
+// byteCodec counting the frames it decodes
+type countingDecoder struct {
+	byteCodec
+	decoded *int64
+}
+
+func (d countingDecoder) Decode(frame []byte, pcm []int16) (int, error) {
+	atomic.AddInt64(d.decoded, 1)
+	return d.byteCodec.Decode(frame, pcm)
+}
+
+func TestRouterDecodesOncePerPacket(t *testing.T) {
+	var decoded int64
+	r := NewRouterWithConfig("test", NewRIPTService(), RouterConfig{
+		OpusCodec: &mixer.Codec{
+			NewDecoder: func() (mixer.Decoder, error) { return countingDecoder{decoded: &decoded}, nil },
+			NewEncoder: func() (mixer.Encoder, error) { return byteCodec{}, nil },
+		},
+	})
+
+	alice := newTestFace("alice")
+	bob := newTestFace("bob")
+	carol := newTestFace("carol")
+	r.AddFace(alice)
+	r.AddFace(bob)
+	r.AddFace(carol)
+
+	call := joinCall(t, alice, "")
+	joinCallWith(t, bob, call.CallUri, "1 in: PCMU;\n2 out: PCMU;\n")
+	joinCallWith(t, carol, call.CallUri, "1 in: PCMA;\n2 out: PCMA;\n")
+	callId := api.CallIdFromUri(call.CallUri)
+	awaitMembers(t, r, callId, 3)
+
+	directive, err := call.ClientDirective.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, mixFrameSamples)
+	sendMedia(alice, callId, api.StreamContentMedia{
+		PayloadType: api.PayloadTypeOpus,
+		SourceId:    directive.SourceId,
+		SinkId:      directive.SinkId,
+		Media:       api.PackFrames([][]byte{frame, frame}),
+	})
+
+	if pkt := awaitPacket(t, bob, api.StreamMediaPacket); pkt.StreamMedia.PayloadType != api.PayloadTypePCMU {
+		t.Fatalf("unexpected payload type for bob [%d]", pkt.StreamMedia.PayloadType)
+	}
+	if pkt := awaitPacket(t, carol, api.StreamMediaPacket); pkt.StreamMedia.PayloadType != api.PayloadTypePCMA {
+		t.Fatalf("unexpected payload type for carol [%d]", pkt.StreamMedia.PayloadType)
+	}
+	if n := atomic.LoadInt64(&decoded); n != 2 {
+		t.Fatalf("expected each frame to be decoded once, decoded [%d]", n)
+	}
+}
+
+func TestRouterDoesNotTranscodeProtectedMedia(t *testing.T) {
+	r := NewRouter("test", NewRIPTService())
+
+	alice := newTestFace("alice")
+	bob := newTestFace("bob")
+	carol := newTestFace("carol")
+	r.AddFace(alice)
+	r.AddFace(bob)
+	r.AddFace(carol)
+
+	call := joinCallWith(t, alice, "", "1 in: PCMU;\n2 out: PCMU;\n")
+	joinCallWith(t, bob, call.CallUri, "1 in: PCMA;\n2 out: PCMA;\n")
+	joinCallWith(t, carol, call.CallUri, "1 in: PCMU;\n2 out: PCMU;\n")
+	callId := api.CallIdFromUri(call.CallUri)
+	awaitMembers(t, r, callId, 3)
+
+	directive, err := call.ClientDirective.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMedia(alice, callId, api.StreamContentMedia{
+		PayloadType: api.PayloadTypePCMU,
+		SourceId:    directive.SourceId,
+		SinkId:      directive.SinkId,
+		Media:       []byte("ciphertext"),
+		Flags:       api.MediaFlagProtected,
+	})
+
+	// carol shares alice's codec and gets the packet, bob would need it
+	// transcoded
+	pkt := awaitPacket(t, carol, api.StreamMediaPacket)
+	if string(pkt.StreamMedia.Media) != "ciphertext" {
+		t.Fatalf("unexpected payload [%x]", pkt.StreamMedia.Media)
+	}
+	expectNoPacket(t, bob)
+	if r.Drops()[DropProtected] != 1 {
+		t.Fatalf("expected the packet to be dropped for bob, drops %v", r.Drops())
+	}
+}
+
+func TestRouterRecordsOpusOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ript-recording")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recorder, err := recording.NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.SetTrunkGroup(defaultTrunkGroupId, true)
+
+	// no opus codec, G.711 can't be transcoded for the recording
+	r := NewRouterWithConfig("test", NewRIPTService(), RouterConfig{Recorder: recorder})
+	alice := newTestFace("alice")
+	bob := newTestFace("bob")
+	r.AddFace(alice)
+	r.AddFace(bob)
+
+	call := joinCallWith(t, alice, "", "1 in: PCMU;\n2 out: PCMU;\n")
+	joinCallWith(t, bob, call.CallUri, "1 in: PCMU;\n2 out: PCMU;\n")
+	callId := api.CallIdFromUri(call.CallUri)
+	awaitMembers(t, r, callId, 2)
+	aliceDirective, err := call.ClientDirective.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMedia(alice, callId, api.StreamContentMedia{
+		PayloadType: api.PayloadTypePCMU,
+		SourceId:    aliceDirective.SourceId,
+		SinkId:      aliceDirective.SinkId,
+		Media:       api.PackFrames([][]byte{make([]byte, 160)}),
+	})
+	// recorded before it's forwarded
+	awaitPacket(t, bob, api.StreamMediaPacket)
+	if recordings, _ := recorder.List(); len(recordings) != 0 {
+		t.Fatalf("G.711 media recorded as opus [%v]", recordings)
+	}
+
+	carol := newTestFace("carol")
+	r.AddFace(carol)
+	carolCall := joinCall(t, carol, call.CallUri)
+	carolDirective, err := carolCall.ClientDirective.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMedia(carol, callId, api.StreamContentMedia{
+		PayloadType: api.PayloadTypeOpus,
+		SourceId:    carolDirective.SourceId,
+		SinkId:      carolDirective.SinkId,
+		Media:       api.PackFrames([][]byte{{1 << 3, 0xaa}}),
+	})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		recordings, _ := recorder.List()
+		if len(recordings) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected recordings [%v]", recordings)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
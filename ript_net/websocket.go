@@ -4,14 +4,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/WhatIETF/goRIPT/api"
+	"github.com/WhatIETF/goRIPT/audit"
 	"log"
 	"net/http"
+	"sync"
 
 	"github.com/gorilla/websocket"
 )
 
 type WebSocketFace struct {
-	conn      *websocket.Conn
+	conn *websocket.Conn
+	// guards writes to conn and the fields below, Read and the router's
+	// sends run concurrently
+	lock      sync.Mutex
 	haveRecv  bool
 	recvChan  chan api.PacketEvent
 	closeChan chan error
@@ -31,24 +36,26 @@ func NewWebSocketFace(conn *websocket.Conn) *WebSocketFace {
 
 func (ws *WebSocketFace) handleClose(code int, text string) error {
 	log.Printf("[%s] Connection closed [%d] [%s]", ws.Name(), code, text)
+	ws.lock.Lock()
 	ws.closed = true
+	ws.lock.Unlock()
 	ws.closeChan <- fmt.Errorf("WebSocket closed [%d] [%s]", code, text)
 	return nil
 }
 
 func (ws *WebSocketFace) Read() {
 	var err error
-	log.Printf("read: ws closes ? [%v]", ws.closed)
-	for !ws.closed {
+	log.Printf("read: ws closes ? [%v]", ws.isClosed())
+	for !ws.isClosed() {
 		var msgType int
 		var message []byte
 		msgType, message, err = ws.conn.ReadMessage()
 		if err != nil {
-			log.Fatalf("ws read error [%v]", err)
+			log.Printf("ws read error [%v]", err)
 			break
 		}
 		if msgType != websocket.TextMessage {
-			log.Fatalf("ws msgType mimsmatch got [%v]", msgType)
+			err = fmt.Errorf("ws msgType mimsmatch got [%v]", msgType)
 			break
 		}
 
@@ -58,18 +65,22 @@ func (ws *WebSocketFace) Read() {
 			break
 		}
 
-		log.Printf("ws:read: haveRecv [%v], pkt [%v]", ws.haveRecv, pkt)
-		if !ws.haveRecv {
+		ws.lock.Lock()
+		haveRecv, recvChan := ws.haveRecv, ws.recvChan
+		ws.lock.Unlock()
+		log.Printf("ws:read: haveRecv [%v], pkt [%v]", haveRecv, pkt)
+		if !haveRecv {
 			continue
 		}
 
-		ws.recvChan <- api.PacketEvent{
+		recvChan <- api.PacketEvent{
 			Sender: ws.Name(),
+			CallId: pkt.CallId,
 			Packet: pkt,
 		}
 	}
 
-	if err != nil && !ws.closed {
+	if err != nil && !ws.isClosed() {
 		log.Printf("read error [%+v]", err)
 		ws.Close(err)
 	}
@@ -79,19 +90,29 @@ func (ws *WebSocketFace) Name() api.FaceName {
 	return api.FaceName(ws.conn.RemoteAddr().String())
 }
 
-func (ws *WebSocketFace) Send(pkt api.Packet) error {
-	if ws.closed {
-		return fmt.Errorf("Cannot send on closed channel")
-	}
+func (ws *WebSocketFace) isClosed() bool {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	return ws.closed
+}
 
+func (ws *WebSocketFace) Send(pkt api.Packet) error {
 	enc, err := json.Marshal(pkt)
 	if err != nil {
 		return err
 	}
+
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if ws.closed {
+		return fmt.Errorf("Cannot send on closed channel")
+	}
 	return ws.conn.WriteMessage(websocket.TextMessage, enc)
 }
 
 func (ws *WebSocketFace) SetReceiveChan(recv chan api.PacketEvent) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
 	ws.haveRecv = true
 	ws.recvChan = recv
 }
@@ -107,9 +128,11 @@ func (ws *WebSocketFace) Close(err error) {
 	}
 
 	closeMsg := websocket.FormatCloseMessage(closeCode, closeInfo)
+	ws.lock.Lock()
 	ws.conn.WriteMessage(websocket.CloseMessage, closeMsg)
 	ws.closed = true
 	ws.conn.Close()
+	ws.lock.Unlock()
 	ws.closeChan <- err
 }
 
@@ -121,6 +144,10 @@ func (ws *WebSocketFace) CanStream() bool {
 	return true
 }
 
+func (ws *WebSocketFace) Transport() string {
+	return "ws"
+}
+
 /////
 
 func NewWebSocketClientFace(url string) (*WebSocketFace, error) {
@@ -132,26 +159,67 @@ func NewWebSocketClientFace(url string) (*WebSocketFace, error) {
 	return NewWebSocketFace(conn), nil
 }
 
+type WebSocketServerConfig struct {
+	// shared secret peer relays must present, peer links are refused
+	// without one
+	PeerSecret string
+	// ws is served over TLS (wss) when set, peer links are only accepted
+	// over TLS
+	CertFile string
+	KeyFile  string
+	// optional, refused peer links are recorded when set
+	Audit *audit.Logger
+}
+
 type WebSocketFaceServer struct {
 	*http.Server
+	config   WebSocketServerConfig
 	recvChan chan api.PacketEvent
 	feedChan chan Face
 }
 
 func NewWebSocketFaceServer(port int) *WebSocketFaceServer {
+	return NewWebSocketFaceServerWithConfig(port, WebSocketServerConfig{})
+}
+
+func NewWebSocketFaceServerWithConfig(port int, config WebSocketServerConfig) *WebSocketFaceServer {
 	wss := &WebSocketFaceServer{
 		Server: &http.Server{
 			Addr: fmt.Sprintf(":%d", port),
 		},
+		config:   config,
 		feedChan: make(chan Face, 10),
 	}
 
 	wss.Handler = wss
-	go wss.ListenAndServe()
+	go wss.serve()
 	return wss
 }
 
+func (wss *WebSocketFaceServer) serve() {
+	var err error
+	if wss.config.CertFile != "" {
+		err = wss.ListenAndServeTLS(wss.config.CertFile, wss.config.KeyFile)
+	} else {
+		err = wss.ListenAndServe()
+	}
+	log.Printf("ws server stopped: %v", err)
+}
+
 func (wss *WebSocketFaceServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == PeerPath && r.TLS == nil {
+		log.Printf("refusing peer link without TLS from [%s]", r.RemoteAddr)
+		wss.refusePeer(r, "no tls")
+		http.Error(w, "peer links need wss", http.StatusForbidden)
+		return
+	}
+	if r.URL.Path == PeerPath && !authorizePeer(r, wss.config.PeerSecret) {
+		log.Printf("refusing peer link from [%s]", r.RemoteAddr)
+		wss.refusePeer(r, "bad peer secret")
+		http.Error(w, "peer not authorized", http.StatusForbidden)
+		return
+	}
+
 	upgrader := websocket.Upgrader{}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -159,9 +227,22 @@ func (wss *WebSocketFaceServer) ServeHTTP(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if r.URL.Path == PeerPath {
+		wss.feedChan <- NewWebSocketPeerFace(conn, "")
+		return
+	}
 	wss.feedChan <- NewWebSocketFace(conn)
 }
 
+func (wss *WebSocketFaceServer) refusePeer(r *http.Request, detail string) {
+	wss.config.Audit.Log(audit.Record{
+		Event:  audit.EventAuthFailure,
+		Face:   r.RemoteAddr,
+		Uri:    r.URL.Path,
+		Detail: detail,
+	})
+}
+
 func (wss *WebSocketFaceServer) Feed() chan Face {
 	return wss.feedChan
 }
@@ -1,28 +1,105 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/WhatIETF/goRIPT/audit"
+	"github.com/WhatIETF/goRIPT/metrics"
+	"github.com/WhatIETF/goRIPT/mixer"
+	"github.com/WhatIETF/goRIPT/recording"
 	"github.com/WhatIETF/goRIPT/ript_net"
+	"github.com/WhatIETF/goRIPT/testData"
 )
 
+// relay side opus, set when built with -tags opus
+var opusCodec *mixer.Codec
+
 // TODO: Move config handling into a utility
 func main() {
 	var h3Port int
+	var tcpPort int
 	var wssPort int
 	var serverHost string
 	var certFile string
 	var keyFile string
+	var devPKIDir string
+	var limits ript_net.RateLimitConfig
+	var peerLimits ript_net.RateLimitConfig
+	var auditConfig audit.Config
+	var queueSize int
+	var mediaDropPolicy string
+	var peers string
+	var peerSecret string
+	var peerCAFile string
+	var wssTLS bool
+	var adminAddr string
+	var recordingDir string
+	var activeSpeakers int
+	var requestTimeout time.Duration
+	var qlogConfig ript_net.QlogConfig
 
 	flag.StringVar(&serverHost, "host", "", "server address.")
 	flag.IntVar(&h3Port, "h3port", 2399, "H3 port on which to listen")
+	flag.IntVar(&tcpPort, "tcpport", 2399, "TCP port serving the h3 routes over HTTP/2 and HTTP/1.1 for clients without UDP (0 disables)")
 	flag.IntVar(&wssPort, "wssport", 8080, "WSS port on which to listen")
 	flag.StringVar(&certFile, "certfile", "", "Full path for server cert file")
 	flag.StringVar(&keyFile, "keyfile", "", "Full path for server key file")
+	flag.StringVar(&devPKIDir, "devpki", "", "generate an ephemeral CA and server cert into this dir (overrides certfile/keyfile)")
+	flag.Float64Var(&limits.Signaling.PacketsPerSec, "sig-pps", 0, "per face signaling packets/sec limit (0 disables)")
+	flag.Float64Var(&limits.Signaling.BytesPerSec, "sig-bps", 0, "per face signaling bytes/sec limit (0 disables)")
+	flag.Float64Var(&limits.Media.PacketsPerSec, "media-pps", 0, "per face media packets/sec limit (0 disables)")
+	flag.Float64Var(&limits.Media.BytesPerSec, "media-bps", 0, "per face media bytes/sec limit (0 disables)")
+	flag.IntVar(&limits.MaxViolations, "max-violations", 0, "rate limit hits before a face is disconnected (0 never)")
+	flag.Float64Var(&peerLimits.Signaling.PacketsPerSec, "peer-sig-pps", 0, "per peer link signaling packets/sec limit (0 disables)")
+	flag.Float64Var(&peerLimits.Media.PacketsPerSec, "peer-media-pps", 0, "per peer link media packets/sec limit (0 disables)")
+	flag.Float64Var(&peerLimits.Media.BytesPerSec, "peer-media-bps", 0, "per peer link media bytes/sec limit (0 disables), peers are never disconnected")
+	flag.IntVar(&queueSize, "send-queue-size", 50, "per face outbound queue size (signaling and media each)")
+	flag.StringVar(&mediaDropPolicy, "media-drop-policy", "oldest", "media drop policy on full send queues (oldest/newest/never, never closes the face instead)")
+	flag.StringVar(&auditConfig.Path, "audit-log", "", "path of the signaling audit log (disabled if empty)")
+	flag.Int64Var(&auditConfig.MaxSize, "audit-max-size", 10<<20, "rotate the audit log beyond this many bytes")
+	flag.IntVar(&auditConfig.MaxFiles, "audit-max-files", 5, "number of rotated audit logs to keep")
+	flag.BoolVar(&auditConfig.HashChain, "audit-hash-chain", false, "chain audit records by hash to make them tamper evident")
+	flag.StringVar(&peers, "peers", "", "comma separated peer relay urls to cascade calls with (wss://host:port/peer)")
+	flag.StringVar(&peerCAFile, "peer-cafile", "", "CA cert of the peer relays (system roots if empty)")
+	flag.BoolVar(&wssTLS, "wss-tls", false, "serve ws over TLS with the server cert, peer links are only accepted over TLS")
+	flag.StringVar(&peerSecret, "peer-secret", os.Getenv("RIPT_PEER_SECRET"), "shared secret of the peer relays, peer links are refused without one (default $RIPT_PEER_SECRET)")
+	flag.StringVar(&adminAddr, "admin-addr", "localhost:9090", "address of the (unauthenticated) admin API, empty disables it")
+	flag.StringVar(&recordingDir, "recording-dir", "", "directory for call recordings (recording disabled if empty)")
+	flag.IntVar(&activeSpeakers, "active-speakers", 0, "forward only the N loudest sources to each participant (0 forwards all)")
+	flag.DurationVar(&requestTimeout, "h3-request-timeout", 2*time.Second, "how long h3 requests wait for the router's reply")
+	flag.DurationVar(&limits.ViolationWindow, "violation-window", 10*time.Second, "window over which rate limit hits are counted")
+	flag.StringVar(&qlogConfig.Dir, "qlog-dir", "", "directory for qlog traces of h3 connections (disabled if empty)")
+	flag.BoolVar(&qlogConfig.All, "qlog", false, "trace every h3 connection, otherwise only clients enabled through the admin API")
+	flag.DurationVar(&qlogConfig.Retention, "qlog-retention", 24*time.Hour, "delete qlog traces older than this (0 keeps them)")
 
 	flag.Parse()
 
 	// validate arguments
+	if devPKIDir != "" {
+		pki, err := testData.NewPKI(0)
+		if err != nil {
+			panic(err)
+		}
+		hosts := []string{"localhost", "127.0.0.1", "::1"}
+		if serverHost != "" {
+			hosts = append(hosts, serverHost)
+		}
+		certFile, keyFile, err = pki.WriteServerFiles(devPKIDir, testData.CertOptions{Hosts: hosts})
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Using ephemeral PKI, CA file %s/%s\n", devPKIDir, testData.CAFileName)
+	}
+
 	if certFile == "" {
 		certFile = "/etc/letsencrypt/live/ietf107.ript-dev.com/fullchain.pem"
 		fmt.Printf("Using Cert file %s\n", certFile)
@@ -35,17 +112,124 @@ func main() {
 
 	fmt.Printf("Host: %s, H3Port %d, WSSPort %d\n", serverHost, h3Port, wssPort)
 
+	queueConfig := ript_net.DefaultSendQueueConfig()
+	queueConfig.Size = queueSize
+	policy, err := ript_net.ParseDropPolicy(mediaDropPolicy)
+	if err != nil {
+		panic(err)
+	}
+	queueConfig.MediaPolicy = policy
+
+	var auditLog *audit.Logger
+	if auditConfig.Path != "" {
+		auditLog, err = audit.NewLogger(auditConfig)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var recorder *recording.Recorder
+	if recordingDir != "" {
+		recorder, err = recording.NewRecorder(recordingDir)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var qlog *ript_net.Qlogger
+	if qlogConfig.Dir != "" {
+		qlog, err = ript_net.NewQlogger(qlogConfig)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var reg *metrics.Registry
+	if adminAddr != "" {
+		reg = metrics.NewRegistry()
+	}
+
+	var peerTLS *tls.Config
+	if peerCAFile != "" {
+		pool := x509.NewCertPool()
+		if err := testData.AddRootCAFile(pool, peerCAFile); err != nil {
+			panic(err)
+		}
+		peerTLS = &tls.Config{RootCAs: pool}
+	}
+
 	service := ript_net.NewRIPTService()
-	router := ript_net.NewRouter("ript-relay", service)
+	service.SetAuditLogger(auditLog)
+	router := ript_net.NewRouterWithConfig("ript-relay", service, ript_net.RouterConfig{
+		RateLimits:     limits,
+		PeerRateLimits: peerLimits,
+		SendQueue:      queueConfig,
+		Audit:          auditLog,
+		Recorder:       recorder,
+		OpusCodec:      opusCodec,
+		ActiveSpeakers: activeSpeakers,
+		Metrics:        reg,
+		PeerSecret:     peerSecret,
+		PeerTLS:        peerTLS,
+	})
+	if opusCodec == nil {
+		fmt.Println("Built without opus, call mixing and opus transcoding are unavailable")
+	}
+
+	if adminAddr != "" {
+		admin := ript_net.NewAdminServer(adminAddr)
+		router.AdminRoutes(admin.Router)
+		if recorder != nil {
+			recorder.AdminRoutes(admin.Router)
+		}
+		if qlog != nil {
+			qlog.AdminRoutes(admin.Router)
+		}
+		admin.Router.Handle("/metrics", reg).Methods(http.MethodGet)
+		admin.Start()
+	}
 
 	// h3 Server
-	h3Server := ript_net.NewQuicFaceServer(h3Port, serverHost, certFile, keyFile)
+	h3Server := ript_net.NewQuicFaceServer(h3Port, serverHost, certFile, keyFile, ript_net.QuicServerConfig{
+		RequestTimeout: requestTimeout,
+		Metrics:        reg,
+		Qlog:           qlog,
+		TCPPort:        tcpPort,
+		Audit:          auditLog,
+	})
 	router.AddFaceFactory(h3Server)
 
 	// ws Server
-	wsServer := ript_net.NewWebSocketFaceServer(wssPort)
+	wsConfig := ript_net.WebSocketServerConfig{
+		PeerSecret: peerSecret,
+		Audit:      auditLog,
+	}
+	if wssTLS {
+		wsConfig.CertFile, wsConfig.KeyFile = certFile, keyFile
+	}
+	wsServer := ript_net.NewWebSocketFaceServerWithConfig(wssPort, wsConfig)
 	router.AddFaceFactory(wsServer)
 
+	// relay cascading
+	for _, peer := range strings.Split(peers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			if err := router.AddPeer(peer); err != nil {
+				panic(err)
+			}
+		}
+	}
+
 	fmt.Println("Router is ready to serve ...")
-	select {}
+
+	// finish the recordings and the audit log before exiting
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	fmt.Printf("Shutting down on [%v]\n", sig)
+	if err := recorder.Close(); err != nil {
+		fmt.Printf("recorder close error [%v]\n", err)
+	}
+	if err := auditLog.Close(); err != nil {
+		fmt.Printf("audit log close error [%v]\n", err)
+	}
 }
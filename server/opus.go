@@ -0,0 +1,14 @@
+//go:build opus
+// +build opus
+
+package main
+
+import (
+	"github.com/WhatIETF/goRIPT/mixer"
+	"github.com/WhatIETF/goRIPT/ript_net"
+)
+
+func init() {
+	codec := mixer.OpusCodec(ript_net.OpusSampleRate, 1)
+	opusCodec = &codec
+}
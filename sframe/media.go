@@ -0,0 +1,52 @@
+package sframe
+
+import (
+	"encoding/binary"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+// mediaAAD binds the cleartext fields of a media packet to its encrypted
+// payload, so a relay can read but not rewrite them. The audio level is
+// bound too, relays select speakers on it, as are the flags marking the
+// payload protected.
+func mediaAAD(m *api.StreamContentMedia) []byte {
+	aad := make([]byte, 1+8+8+4+1+1+1+1)
+	aad[0] = byte(m.Type)
+	binary.BigEndian.PutUint64(aad[1:], m.SeqNo)
+	binary.BigEndian.PutUint64(aad[9:], m.Timestamp)
+	binary.BigEndian.PutUint32(aad[17:], m.PayloadType)
+	aad[21] = m.SourceId
+	aad[22] = m.SinkId
+	aad[23] = m.AudioLevel
+	aad[24] = m.Flags
+	return aad
+}
+
+// ProtectMedia replaces the media payload with its encrypted frame and
+// marks it protected, so relays leave the payload alone.
+func (c *Context) ProtectMedia(m *api.StreamContentMedia) error {
+	protected := *m
+	protected.Flags |= api.MediaFlagProtected
+	frame, err := c.Protect(m.Media, mediaAAD(&protected))
+	if err != nil {
+		return err
+	}
+	protected.Media = frame
+	*m = protected
+	return nil
+}
+
+// UnprotectMedia replaces the encrypted frame with the decrypted media payload.
+func (c *Context) UnprotectMedia(m *api.StreamContentMedia) error {
+	if !m.Protected() {
+		return ErrNotProtected
+	}
+	payload, err := c.Unprotect(m.Media, mediaAAD(m))
+	if err != nil {
+		return err
+	}
+	m.Media = payload
+	m.Flags &^= api.MediaFlagProtected
+	return nil
+}
@@ -0,0 +1,227 @@
+package sframe
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// End-to-end media frame encryption, loosely modelled on SFrame
+// (draft-omara-sframe). Only the media payload is encrypted; the
+// StreamContentMedia header (SeqNo, SourceId, SinkId ..) stays in the clear
+// so the relay can route on it, but is bound to the ciphertext via the AAD.
+//
+// Every sending context picks a random sender id, and frame keys and
+// salts are derived from the base key and the sender id. Participants
+// sharing a base key, or a client restarted on the same key, thus never
+// share a nonce space, and each counter only ever grows under its key.
+//
+// Frame layout:  KID (uvarint) | SID (8 bytes) | CTR (uvarint) | AES-GCM(payload) | tag
+
+const (
+	keyLen   = 16
+	saltLen  = 12
+	sidLen   = 8
+	tagLen   = 16
+	hkdfSalt = "SFrame10"
+	hkdfKey  = "key"
+	hkdfIV   = "salt"
+)
+
+var (
+	ErrUnknownKey   = errors.New("sframe: unknown key id")
+	ErrShortFrame   = errors.New("sframe: frame too short")
+	ErrNoSendKey    = errors.New("sframe: no send key set")
+	ErrAuthenticate = errors.New("sframe: authentication failed")
+	ErrNotProtected = errors.New("sframe: media not protected")
+)
+
+// bound on the frame keys derived for other senders
+const maxSenderKeys = 1024
+
+type keyState struct {
+	aead cipher.AEAD
+	salt []byte
+}
+
+type senderKey struct {
+	kid uint64
+	sid [sidLen]byte
+}
+
+// Context holds the keys shared by the call participants.
+// A single context can be used for both protect and unprotect.
+type Context struct {
+	mu       sync.Mutex
+	baseKeys map[uint64][]byte
+	// frame keys by key id and sender
+	keys    map[senderKey]*keyState
+	sid     [sidLen]byte
+	sendKid uint64
+	haveKid bool
+	// per key id, never reset as the key stays the same
+	ctrs map[uint64]uint64
+}
+
+func NewContext() (*Context, error) {
+	c := &Context{
+		baseKeys: map[uint64][]byte{},
+		keys:     map[senderKey]*keyState{},
+		ctrs:     map[uint64]uint64{},
+	}
+	if _, err := io.ReadFull(rand.Reader, c.sid[:]); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// AddKey sets the base key shared out of band for the given key id.
+func (c *Context) AddKey(kid uint64, baseKey []byte) error {
+	if len(baseKey) == 0 {
+		return errors.New("sframe: empty base key")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.baseKeys[kid] = append([]byte(nil), baseKey...)
+	for k := range c.keys {
+		if k.kid == kid {
+			delete(c.keys, k)
+		}
+	}
+	return nil
+}
+
+// SetSendKey selects the key used by Protect.
+func (c *Context) SetSendKey(kid uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.baseKeys[kid]; !ok {
+		return ErrUnknownKey
+	}
+	c.sendKid = kid
+	c.haveKid = true
+	return nil
+}
+
+// frameKey derives the key and salt of a sender's frames. Needs mu held.
+func (c *Context) frameKey(k senderKey) (*keyState, error) {
+	if ks, ok := c.keys[k]; ok {
+		return ks, nil
+	}
+	baseKey, ok := c.baseKeys[k.kid]
+	if !ok {
+		return nil, fmt.Errorf("%w [%d]", ErrUnknownKey, k.kid)
+	}
+
+	r := hkdf.New(sha256.New, baseKey, []byte(hkdfSalt), append([]byte(hkdfKey), k.sid[:]...))
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, err
+	}
+
+	r = hkdf.New(sha256.New, baseKey, []byte(hkdfSalt), append([]byte(hkdfIV), k.sid[:]...))
+	salt := make([]byte, saltLen)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.keys) >= maxSenderKeys {
+		c.keys = map[senderKey]*keyState{}
+	}
+	ks := &keyState{aead: aead, salt: salt}
+	c.keys[k] = ks
+	return ks, nil
+}
+
+// Protect encrypts payload and returns the frame. aad carries the
+// cleartext metadata that must not be altered in transit.
+func (c *Context) Protect(payload, aad []byte) ([]byte, error) {
+	c.mu.Lock()
+	if !c.haveKid {
+		c.mu.Unlock()
+		return nil, ErrNoSendKey
+	}
+	kid := c.sendKid
+	ks, err := c.frameKey(senderKey{kid, c.sid})
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	ctr := c.ctrs[kid]
+	c.ctrs[kid]++
+	c.mu.Unlock()
+
+	hdr := make([]byte, 2*binary.MaxVarintLen64+sidLen)
+	n := binary.PutUvarint(hdr, kid)
+	n += copy(hdr[n:], c.sid[:])
+	n += binary.PutUvarint(hdr[n:], ctr)
+	hdr = hdr[:n]
+
+	frame := make([]byte, len(hdr), len(hdr)+len(payload)+tagLen)
+	copy(frame, hdr)
+	return ks.aead.Seal(frame, nonce(ks.salt, ctr), payload, append(hdr, aad...)), nil
+}
+
+// Unprotect authenticates and decrypts a frame produced by Protect.
+func (c *Context) Unprotect(frame, aad []byte) ([]byte, error) {
+	k := senderKey{}
+	var n int
+	k.kid, n = binary.Uvarint(frame)
+	if n <= 0 || len(frame) < n+sidLen {
+		return nil, ErrShortFrame
+	}
+	copy(k.sid[:], frame[n:])
+	n += sidLen
+	ctr, m := binary.Uvarint(frame[n:])
+	if m <= 0 {
+		return nil, ErrShortFrame
+	}
+	hdrLen := n + m
+	if len(frame) < hdrLen+tagLen {
+		return nil, ErrShortFrame
+	}
+
+	c.mu.Lock()
+	ks, err := c.frameKey(k)
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := frame[:hdrLen:hdrLen]
+	payload, err := ks.aead.Open(nil, nonce(ks.salt, ctr), frame[hdrLen:], append(hdr, aad...))
+	if err != nil {
+		return nil, ErrAuthenticate
+	}
+	return payload, nil
+}
+
+func nonce(salt []byte, ctr uint64) []byte {
+	n := make([]byte, saltLen)
+	copy(n, salt)
+	var c [8]byte
+	binary.BigEndian.PutUint64(c[:], ctr)
+	for i := 0; i < 8; i++ {
+		n[saltLen-8+i] ^= c[i]
+	}
+	return n
+}
@@ -0,0 +1,176 @@
+package sframe
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/WhatIETF/goRIPT/api"
+)
+
+func newTestContext(t *testing.T, kid uint64, key string) *Context {
+	c, err := NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddKey(kid, []byte(key)); err != nil {
+		t.Fatalf("add key error [%v]", err)
+	}
+	if err := c.SetSendKey(kid); err != nil {
+		t.Fatalf("set send key error [%v]", err)
+	}
+	return c
+}
+
+func TestProtectUnprotectMedia(t *testing.T) {
+	sender := newTestContext(t, 1, "shared secret")
+	receiver := newTestContext(t, 1, "shared secret")
+
+	payload := []byte("opus frames")
+	m := api.StreamContentMedia{
+		Type:        api.StreamContentTypeMedia,
+		SeqNo:       42,
+		Timestamp:   1234,
+		PayloadType: api.PayloadTypeOpus,
+		SourceId:    1,
+		SinkId:      2,
+		Media:       append([]byte{}, payload...),
+	}
+
+	if err := sender.ProtectMedia(&m); err != nil {
+		t.Fatalf("protect error [%v]", err)
+	}
+	if bytes.Contains(m.Media, payload) {
+		t.Fatalf("payload not encrypted")
+	}
+	if !m.Protected() {
+		t.Fatalf("media not marked protected")
+	}
+
+	// relay forwards the packet unchanged
+	fwd := m
+	if err := receiver.UnprotectMedia(&fwd); err != nil {
+		t.Fatalf("unprotect error [%v]", err)
+	}
+	if !bytes.Equal(fwd.Media, payload) || fwd.Protected() {
+		t.Fatalf("payload mismatch [%x] != [%x]", fwd.Media, payload)
+	}
+}
+
+func TestUnprotectRejectsTampering(t *testing.T) {
+	sender := newTestContext(t, 1, "shared secret")
+
+	m := api.StreamContentMedia{SeqNo: 1, SourceId: 1, SinkId: 2, Media: []byte("hello")}
+	if err := sender.ProtectMedia(&m); err != nil {
+		t.Fatalf("protect error [%v]", err)
+	}
+
+	// rewritten routing header
+	tampered := m
+	tampered.SourceId = 3
+	if err := sender.UnprotectMedia(&tampered); !errors.Is(err, ErrAuthenticate) {
+		t.Fatalf("expected auth failure, got [%v]", err)
+	}
+
+	// rewritten audio level
+	tampered = m
+	tampered.AudioLevel = 127
+	if err := sender.UnprotectMedia(&tampered); !errors.Is(err, ErrAuthenticate) {
+		t.Fatalf("expected auth failure, got [%v]", err)
+	}
+
+	// rewritten flags
+	tampered = m
+	tampered.Flags |= 0x80
+	if err := sender.UnprotectMedia(&tampered); !errors.Is(err, ErrAuthenticate) {
+		t.Fatalf("expected auth failure, got [%v]", err)
+	}
+	tampered = m
+	tampered.Flags = 0
+	if err := sender.UnprotectMedia(&tampered); !errors.Is(err, ErrNotProtected) {
+		t.Fatalf("expected unprotected media to be refused, got [%v]", err)
+	}
+
+	// wrong key
+	other := newTestContext(t, 1, "other secret")
+	fwd := m
+	if err := other.UnprotectMedia(&fwd); !errors.Is(err, ErrAuthenticate) {
+		t.Fatalf("expected auth failure, got [%v]", err)
+	}
+
+	// unknown key id
+	unknown := newTestContext(t, 7, "shared secret")
+	fwd = m
+	if err := unknown.UnprotectMedia(&fwd); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected unknown key, got [%v]", err)
+	}
+}
+
+func TestProtectUsesFreshNonce(t *testing.T) {
+	c := newTestContext(t, 1, "shared secret")
+
+	f1, err := c.Protect([]byte("same"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := c.Protect([]byte("same"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(f1, f2) {
+		t.Fatalf("identical frames for repeated payload")
+	}
+}
+
+func TestSendersSharingAKeyUseDistinctNonces(t *testing.T) {
+	alice := newTestContext(t, 1, "shared secret")
+	bob := newTestContext(t, 1, "shared secret")
+
+	// both start at counter 0
+	f1, err := alice.Protect([]byte("same"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := bob.Protect([]byte("same"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// same plaintext, the ciphertexts only match on a shared keystream
+	ciphertext := func(f []byte) []byte { return f[len(f)-tagLen-4 : len(f)-tagLen] }
+	if bytes.Equal(ciphertext(f1), ciphertext(f2)) {
+		t.Fatalf("senders share a keystream")
+	}
+
+	// and each decrypts the other's frames
+	if _, err := alice.Unprotect(f2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Unprotect(f1, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetSendKeyKeepsCounter(t *testing.T) {
+	c := newTestContext(t, 1, "shared secret")
+	if err := c.AddKey(2, []byte("next secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	f1, err := c.Protect([]byte("same"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetSendKey(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetSendKey(1); err != nil {
+		t.Fatal(err)
+	}
+	f2, err := c.Protect([]byte("same"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(f1, f2) {
+		t.Fatalf("counter reset under a live key")
+	}
+}
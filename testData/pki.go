@@ -0,0 +1,217 @@
+package testData
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path"
+	"time"
+)
+
+// Ephemeral PKI generated at runtime, so tests and local dev setups
+// don't depend on the checked in (and expiring) certificates.
+
+const (
+	defaultValidity = 24 * time.Hour
+	// file names match the static ones in this directory
+	CAFileName   = "ca.pem"
+	CertFileName = "cert.pem"
+	KeyFileName  = "priv.key"
+)
+
+// CertOptions for issuing a leaf certificate. Hosts may hold DNS names
+// or IP addresses. A zero ValidFor defaults to 24 hours.
+type CertOptions struct {
+	CommonName string
+	Hosts      []string
+	ValidFor   time.Duration
+}
+
+// KeyPair is an issued certificate along with its PEM encodings
+type KeyPair struct {
+	Certificate tls.Certificate
+	CertPEM     []byte
+	KeyPEM      []byte
+}
+
+type PKI struct {
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	CAPEM  []byte
+}
+
+// NewPKI creates a self-signed CA valid for the given duration.
+func NewPKI(validFor time.Duration) (*PKI, error) {
+	if validFor == 0 {
+		validFor = defaultValidity
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := newTemplate("goRIPT test CA", validFor)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PKI{
+		caCert: cert,
+		caKey:  key,
+		CAPEM:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}, nil
+}
+
+// IssueServer returns a server certificate for the given hosts
+func (p *PKI) IssueServer(opts CertOptions) (*KeyPair, error) {
+	if len(opts.Hosts) == 0 {
+		return nil, errors.New("pki: server certificate needs at least one host")
+	}
+	return p.issue(opts, x509.ExtKeyUsageServerAuth)
+}
+
+// IssueClient returns a client certificate for mutual tls
+func (p *PKI) IssueClient(opts CertOptions) (*KeyPair, error) {
+	return p.issue(opts, x509.ExtKeyUsageClientAuth)
+}
+
+// CertPool returns a pool containing (only) the CA certificate
+func (p *PKI) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(p.caCert)
+	return pool
+}
+
+// ServerTLSConfig issues a server certificate and wraps it in a tls config
+func (p *PKI) ServerTLSConfig(opts CertOptions) (*tls.Config, error) {
+	kp, err := p.IssueServer(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{kp.Certificate},
+	}, nil
+}
+
+// WriteServerFiles issues a server certificate and writes the CA, cert and key
+// PEM files to dir. Returns the cert and key file paths as expected by the server.
+func (p *PKI) WriteServerFiles(dir string, opts CertOptions) (string, string, error) {
+	kp, err := p.IssueServer(opts)
+	if err != nil {
+		return "", "", err
+	}
+
+	certFile := path.Join(dir, CertFileName)
+	keyFile := path.Join(dir, KeyFileName)
+	if err := ioutil.WriteFile(path.Join(dir, CAFileName), p.CAPEM, 0644); err != nil {
+		return "", "", err
+	}
+	if err := ioutil.WriteFile(certFile, kp.CertPEM, 0644); err != nil {
+		return "", "", err
+	}
+	if err := ioutil.WriteFile(keyFile, kp.KeyPEM, 0600); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+func (p *PKI) issue(opts CertOptions, usage x509.ExtKeyUsage) (*KeyPair, error) {
+	if opts.ValidFor == 0 {
+		opts.ValidFor = defaultValidity
+	}
+	if opts.CommonName == "" && len(opts.Hosts) > 0 {
+		opts.CommonName = opts.Hosts[0]
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := newTemplate(opts.CommonName, opts.ValidFor)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	for _, h := range opts.Hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.caCert, &key.PublicKey, p.caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyPair{
+		Certificate: cert,
+		CertPEM:     certPEM,
+		KeyPEM:      keyPEM,
+	}, nil
+}
+
+func newTemplate(cn string, validFor time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	// backdate a little to tolerate clock skew
+	notBefore := time.Now().Add(-time.Minute)
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"goRIPT"}},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(validFor),
+	}, nil
+}
+
+// AddRootCAFile adds the CA certificate(s) in caFile to a cert pool
+func AddRootCAFile(certPool *x509.CertPool, caFile string) error {
+	raw, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	if ok := certPool.AppendCertsFromPEM(raw); !ok {
+		return errors.New("pki: no certificates found in " + caFile)
+	}
+	return nil
+}
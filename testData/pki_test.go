@@ -0,0 +1,111 @@
+package testData
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPKIMutualTLS(t *testing.T) {
+	pki, err := NewPKI(time.Hour)
+	if err != nil {
+		t.Fatalf("pki creation error [%v]", err)
+	}
+
+	server, err := pki.IssueServer(CertOptions{Hosts: []string{"localhost", "127.0.0.1"}})
+	if err != nil {
+		t.Fatalf("server cert error [%v]", err)
+	}
+	client, err := pki.IssueClient(CertOptions{CommonName: "ript-client"})
+	if err != nil {
+		t.Fatalf("client cert error [%v]", err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server.Certificate},
+		ClientCAs:    pki.CertPool(),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("foobar"))
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		ServerName:   "localhost",
+		RootCAs:      pki.CertPool(),
+		Certificates: []tls.Certificate{client.Certificate},
+	})
+	if err != nil {
+		t.Fatalf("handshake error [%v]", err)
+	}
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "foobar" {
+		t.Fatalf("unexpected data [%s]", data)
+	}
+}
+
+func TestPKIExpiryAndFiles(t *testing.T) {
+	pki, err := NewPKI(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "ript-pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, err := pki.WriteServerFiles(dir, CertOptions{
+		Hosts:    []string{"relay.example.com"},
+		ValidFor: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("write error [%v]", err)
+	}
+
+	kp, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("load error [%v]", err)
+	}
+	leaf, err := x509.ParseCertificate(kp.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validity := leaf.NotAfter.Sub(leaf.NotBefore); validity != time.Hour {
+		t.Fatalf("unexpected validity [%v]", validity)
+	}
+
+	pool := x509.NewCertPool()
+	if err := AddRootCAFile(pool, dir+"/"+CAFileName); err != nil {
+		t.Fatal(err)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: "relay.example.com", Roots: pool})
+	if err != nil {
+		t.Fatalf("verify error [%v]", err)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:     "relay.example.com",
+		Roots:       pool,
+		CurrentTime: time.Now().Add(2 * time.Hour),
+	})
+	if err == nil {
+		t.Fatalf("expected expired certificate")
+	}
+}